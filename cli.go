@@ -3,9 +3,12 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 )
@@ -19,6 +22,7 @@ func newRootCommand() *cobra.Command {
 	rootCommand.SilenceUsage = true
 	rootCommand.AddCommand(newServeCommand())
 	rootCommand.AddCommand(newGenerateJwtKeyCommand())
+	rootCommand.AddCommand(newKeysCommand())
 	return rootCommand
 }
 
@@ -64,6 +68,136 @@ func newGenerateJwtKeyCommand() *cobra.Command {
 	}
 }
 
+const (
+	flagKeyring = "keyring"
+	flagAlg     = "alg"
+	flagKeyID   = "kid"
+	flagRetain  = "retain"
+	flagWrite   = "write"
+	flagStage   = "stage"
+	flagPromote = "promote"
+
+	keyringFileMode = 0o600
+)
+
+func newKeysCommand() *cobra.Command {
+	keysCommand := &cobra.Command{
+		Use:   "keys",
+		Short: "Manage the access-token signing keyring",
+	}
+	keysCommand.AddCommand(newKeysRotateCommand())
+	return keysCommand
+}
+
+func newKeysRotateCommand() *cobra.Command {
+	rotateCommand := &cobra.Command{
+		Use:   "rotate",
+		Short: "Produce the next keyring state with a new current signing key",
+		Long: "Generates a new current key, demotes the existing current key to a verification-only " +
+			"previous key, and keeps at most --retain previous keys. Prints the keyring JSON unless --write is set. " +
+			"Once the current key is published in the JWKS, rotate in two steps: --stage publishes the next key, " +
+			"and --promote makes it current after verifiers' cached JWKS have expired.",
+		RunE: runKeysRotateCommand,
+	}
+	rotateCommand.Flags().String(flagKeyring, "", "keyring file to rotate (missing file starts a new keyring)")
+	rotateCommand.Flags().String(flagAlg, "ES256", "algorithm of the new current key: ES256, EdDSA, or HS256")
+	rotateCommand.Flags().String(flagKeyID, "", "kid for the new current key (default: derived)")
+	rotateCommand.Flags().Int(flagRetain, defaultKeyringRetain, "number of previous keys kept for verification")
+	rotateCommand.Flags().Bool(flagWrite, false, "write the rotated keyring back to --keyring instead of stdout")
+	rotateCommand.Flags().Bool(flagStage, false, "publish a new next key in the JWKS without signing with it")
+	rotateCommand.Flags().Bool(flagPromote, false, "make the staged next key current (at least 5 minutes after --stage)")
+	rotateCommand.MarkFlagsMutuallyExclusive(flagStage, flagPromote)
+	return rotateCommand
+}
+
+func runKeysRotateCommand(cmd *cobra.Command, args []string) error {
+	keyringPath, _ := cmd.Flags().GetString(flagKeyring)
+	algorithm, _ := cmd.Flags().GetString(flagAlg)
+	keyID, _ := cmd.Flags().GetString(flagKeyID)
+	retainCount, _ := cmd.Flags().GetInt(flagRetain)
+	writeInPlace, _ := cmd.Flags().GetBool(flagWrite)
+	stageNext, _ := cmd.Flags().GetBool(flagStage)
+	promoteNext, _ := cmd.Flags().GetBool(flagPromote)
+	if writeInPlace && keyringPath == "" {
+		return fmt.Errorf("--%s requires --%s", flagWrite, flagKeyring)
+	}
+	if retainCount < 0 {
+		return fmt.Errorf("--%s must not be negative", flagRetain)
+	}
+
+	var existingKeyring keyringFile
+	if keyringPath != "" {
+		keyringBytes, readError := os.ReadFile(keyringPath)
+		switch {
+		case readError == nil:
+			if _, parseError := parseKeyringFile(keyringBytes); parseError != nil {
+				return fmt.Errorf("bad keyring %s: %w", keyringPath, parseError)
+			}
+			if unmarshalError := json.Unmarshal(keyringBytes, &existingKeyring); unmarshalError != nil {
+				return fmt.Errorf("bad keyring %s: %w", keyringPath, unmarshalError)
+			}
+		case os.IsNotExist(readError):
+		default:
+			return fmt.Errorf("read keyring: %w", readError)
+		}
+	}
+
+	var rotatedKeyring keyringFile
+	var rotateError error
+	switch {
+	case stageNext:
+		rotatedKeyring, rotateError = stageKeyring(existingKeyring, algorithm, keyID)
+	case promoteNext:
+		rotatedKeyring, rotateError = promoteKeyring(existingKeyring, retainCount)
+	case existingKeyring.Next != nil:
+		rotateError = fmt.Errorf("kid %q is staged; run with --%s", existingKeyring.Next.KeyID, flagPromote)
+	case existingKeyring.Current.PrivateKeyPem != "":
+		// Verifiers caching the JWKS would reject tokens from a key they have not seen yet.
+		rotateError = fmt.Errorf("current key is published in the JWKS; run with --%s, wait %s, then --%s", flagStage, jwksCacheMaxAge, flagPromote)
+	default:
+		rotatedKeyring, rotateError = rotateKeyring(existingKeyring, algorithm, keyID, retainCount)
+	}
+	if rotateError != nil {
+		return fmt.Errorf("rotate keyring: %w", rotateError)
+	}
+	rotatedBytes, marshalError := rotatedKeyring.marshal()
+	if marshalError != nil {
+		return marshalError
+	}
+
+	if !writeInPlace {
+		if _, writeError := cmd.OutOrStdout().Write(rotatedBytes); writeError != nil {
+			return fmt.Errorf("write keyring: %w", writeError)
+		}
+		return nil
+	}
+	temporaryFile, createError := os.CreateTemp(filepath.Dir(keyringPath), ".keyring-*")
+	if createError != nil {
+		return fmt.Errorf("write keyring: %w", createError)
+	}
+	defer os.Remove(temporaryFile.Name())
+	if chmodError := temporaryFile.Chmod(keyringFileMode); chmodError != nil {
+		temporaryFile.Close()
+		return fmt.Errorf("write keyring: %w", chmodError)
+	}
+	if _, writeError := temporaryFile.Write(rotatedBytes); writeError != nil {
+		temporaryFile.Close()
+		return fmt.Errorf("write keyring: %w", writeError)
+	}
+	if closeError := temporaryFile.Close(); closeError != nil {
+		return fmt.Errorf("write keyring: %w", closeError)
+	}
+	if renameError := os.Rename(temporaryFile.Name(), keyringPath); renameError != nil {
+		return fmt.Errorf("write keyring: %w", renameError)
+	}
+	if stageNext {
+		_, _ = fmt.Fprintf(cmd.OutOrStdout(), "staged %s: next kid %s, promote after %s\n", keyringPath, rotatedKeyring.Next.KeyID, jwksCacheMaxAge)
+		return nil
+	}
+	_, _ = fmt.Fprintf(cmd.OutOrStdout(), "rotated %s: current kid %s\n", keyringPath, rotatedKeyring.Current.KeyID)
+	return nil
+}
+
 var randomRead = rand.Read
 
 func generateRandomHex(byteLength int) (string, error) {
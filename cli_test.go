@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/hex"
 	"errors"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -59,3 +61,65 @@ func TestGenerateJwtKeyCommandPropagatesEntropyError(t *testing.T) {
 		t.Fatalf("expected error when entropy source fails")
 	}
 }
+
+func TestKeysRotateCommandWritesNextKeyringState(t *testing.T) {
+	currentTime := stubRateClock(t)
+	keyringPath := filepath.Join(t.TempDir(), "keyring.json")
+	runRotate := func(extraArgs ...string) error {
+		rootCommand := newRootCommand()
+		var commandOutput bytes.Buffer
+		rootCommand.SetOut(&commandOutput)
+		rootCommand.SetArgs(append([]string{"keys", "rotate", "--keyring", keyringPath, "--write"}, extraArgs...))
+		return rootCommand.Execute()
+	}
+
+	if executeError := runRotate(); executeError != nil {
+		t.Fatalf("initial rotation: unexpected error: %v", executeError)
+	}
+	if executeError := runRotate(); executeError == nil {
+		t.Fatalf("expected a published key to refuse immediate rotation")
+	}
+	if executeError := runRotate("--stage"); executeError != nil {
+		t.Fatalf("stage: unexpected error: %v", executeError)
+	}
+	if executeError := runRotate("--promote"); executeError == nil {
+		t.Fatalf("expected promotion inside the JWKS cache lifetime to be refused")
+	}
+	*currentTime = currentTime.Add(jwksCacheMaxAge)
+	if executeError := runRotate("--promote"); executeError != nil {
+		t.Fatalf("promote: unexpected error: %v", executeError)
+	}
+
+	keyringBytes, readError := os.ReadFile(keyringPath)
+	if readError != nil {
+		t.Fatalf("read keyring: %v", readError)
+	}
+	rotatedKeyring, parseError := parseKeyringFile(keyringBytes)
+	if parseError != nil {
+		t.Fatalf("parseKeyringFile: %v", parseError)
+	}
+	if len(rotatedKeyring.Previous) != 1 {
+		t.Fatalf("expected one previous key after two rotations, got %d", len(rotatedKeyring.Previous))
+	}
+	if fileInfo, statError := os.Stat(keyringPath); statError != nil || fileInfo.Mode().Perm() != keyringFileMode {
+		t.Fatalf("expected keyring file mode %o, got %v (%v)", keyringFileMode, fileInfo.Mode().Perm(), statError)
+	}
+}
+
+func TestKeysRotateCommandPrintsWithoutWriting(t *testing.T) {
+	rootCommand := newRootCommand()
+	var commandOutput bytes.Buffer
+	rootCommand.SetOut(&commandOutput)
+	rootCommand.SetArgs([]string{"keys", "rotate", "--alg", "EdDSA", "--kid", "2025-06"})
+	if executeError := rootCommand.Execute(); executeError != nil {
+		t.Fatalf("unexpected error: %v", executeError)
+	}
+
+	printedKeyring, parseError := parseKeyringFile(commandOutput.Bytes())
+	if parseError != nil {
+		t.Fatalf("parseKeyringFile: %v", parseError)
+	}
+	if printedKeyring.Current.KeyID != "2025-06" || printedKeyring.Current.SigningMethod.Alg() != "EdDSA" {
+		t.Fatalf("unexpected current key: %+v", printedKeyring.Current)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const (
+	envKeyTrustedProxies = "TRUSTED_PROXIES"
+
+	headerForwarded     = "Forwarded"
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-IP"
+)
+
+// The forwarding chain is walked from the nearest hop outwards past trusted proxies. An
+// unparsable hop stops the walk so a client cannot inject a value past it.
+func resolveClientIP(httpRequest *http.Request, trustedProxies []netip.Prefix) string {
+	peerAddress := clientIP(httpRequest.RemoteAddr)
+	peerIP, peerError := netip.ParseAddr(peerAddress)
+	if peerError != nil || !ipTrusted(peerIP, trustedProxies) {
+		return peerAddress
+	}
+
+	resolvedIP := peerIP
+	forwardingChain := forwardedChain(httpRequest.Header)
+	for hopIndex := len(forwardingChain) - 1; hopIndex >= 0; hopIndex-- {
+		hopIP, hopError := parseForwardedNode(forwardingChain[hopIndex])
+		if hopError != nil {
+			break
+		}
+		resolvedIP = hopIP
+		if !ipTrusted(hopIP, trustedProxies) {
+			break
+		}
+	}
+	return resolvedIP.String()
+}
+
+func forwardedChain(requestHeaders http.Header) []string {
+	var forwardingChain []string
+	for _, forwardedValue := range requestHeaders.Values(headerForwarded) {
+		for _, forwardedElement := range strings.Split(forwardedValue, ",") {
+			for _, forwardedPair := range strings.Split(forwardedElement, ";") {
+				pairName, pairValue, found := strings.Cut(strings.TrimSpace(forwardedPair), "=")
+				if found && strings.EqualFold(pairName, "for") {
+					forwardingChain = append(forwardingChain, pairValue)
+				}
+			}
+		}
+	}
+	if len(forwardingChain) > 0 {
+		return forwardingChain
+	}
+	for _, forwardedForValue := range requestHeaders.Values(headerXForwardedFor) {
+		forwardingChain = append(forwardingChain, strings.Split(forwardedForValue, ",")...)
+	}
+	if len(forwardingChain) > 0 {
+		return forwardingChain
+	}
+	if realIP := requestHeaders.Get(headerXRealIP); realIP != "" {
+		return []string{realIP}
+	}
+	return nil
+}
+
+func peerTrusted(httpRequest *http.Request, trustedProxies []netip.Prefix) bool {
+	peerIP, peerError := netip.ParseAddr(clientIP(httpRequest.RemoteAddr))
+	return peerError == nil && ipTrusted(peerIP, trustedProxies)
+}
+
+func forwardedProto(requestHeaders http.Header) string {
+	var forwardedScheme string
+	for _, forwardedValue := range requestHeaders.Values(headerForwarded) {
+		for _, forwardedElement := range strings.Split(forwardedValue, ",") {
+			for _, forwardedPair := range strings.Split(forwardedElement, ";") {
+				pairName, pairValue, found := strings.Cut(strings.TrimSpace(forwardedPair), "=")
+				if found && strings.EqualFold(pairName, "proto") {
+					forwardedScheme = strings.Trim(pairValue, `"`)
+				}
+			}
+		}
+	}
+	if forwardedScheme == "" {
+		for _, protoValue := range requestHeaders.Values(forwardedProtoHeader) {
+			protoValues := strings.Split(protoValue, ",")
+			forwardedScheme = protoValues[len(protoValues)-1]
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(forwardedScheme))
+}
+
+// Obfuscated and "unknown" RFC 7239 nodes are errors.
+func parseForwardedNode(rawNode string) (netip.Addr, error) {
+	node := strings.Trim(strings.TrimSpace(rawNode), `"`)
+	if strings.HasPrefix(node, "[") {
+		closingIndex := strings.Index(node, "]")
+		if closingIndex < 0 {
+			return netip.Addr{}, fmt.Errorf("bad forwarded node %q", rawNode)
+		}
+		node = node[1:closingIndex]
+	} else if strings.Count(node, ":") == 1 {
+		node, _, _ = strings.Cut(node, ":")
+	}
+	nodeIP, parseError := netip.ParseAddr(node)
+	if parseError != nil {
+		return netip.Addr{}, fmt.Errorf("bad forwarded node %q", rawNode)
+	}
+	return nodeIP.Unmap(), nil
+}
+
+func ipTrusted(candidateIP netip.Addr, trustedProxies []netip.Prefix) bool {
+	candidateIP = candidateIP.Unmap()
+	for _, trustedPrefix := range trustedProxies {
+		if trustedPrefix.Contains(candidateIP) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTrustedProxies(rawProxies string) ([]netip.Prefix, error) {
+	var trustedProxies []netip.Prefix
+	for _, rawEntry := range strings.Split(rawProxies, ",") {
+		rawEntry = strings.TrimSpace(rawEntry)
+		if rawEntry == "" {
+			continue
+		}
+		if !strings.Contains(rawEntry, "/") {
+			entryIP, parseError := netip.ParseAddr(rawEntry)
+			if parseError != nil {
+				return nil, fmt.Errorf("bad trusted proxy %q", rawEntry)
+			}
+			entryIP = entryIP.Unmap()
+			trustedProxies = append(trustedProxies, netip.PrefixFrom(entryIP, entryIP.BitLen()))
+			continue
+		}
+		entryPrefix, parseError := netip.ParsePrefix(rawEntry)
+		if parseError != nil {
+			return nil, fmt.Errorf("bad trusted proxy %q", rawEntry)
+		}
+		trustedProxies = append(trustedProxies, entryPrefix.Masked())
+	}
+	return trustedProxies, nil
+}
+
+func loadTrustedProxies() ([]netip.Prefix, error) {
+	trustedProxies, parseError := parseTrustedProxies(os.Getenv(envKeyTrustedProxies))
+	if parseError != nil {
+		return nil, fmt.Errorf("bad %s: %w", envKeyTrustedProxies, parseError)
+	}
+	return trustedProxies, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClientIP_HonorsOnlyTrustedHops(t *testing.T) {
+	trustedProxies, parseErr := parseTrustedProxies("10.0.0.0/8, 192.0.2.10, fd00::/8")
+	if parseErr != nil {
+		t.Fatalf("parseTrustedProxies: %v", parseErr)
+	}
+
+	testCases := []struct {
+		name          string
+		remoteAddress string
+		headers       map[string]string
+		wantIP        string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.9:4000", map[string]string{headerXForwardedFor: "198.51.100.1"}, "203.0.113.9"},
+		{"trusted peer without headers", "10.1.2.3:4000", nil, "10.1.2.3"},
+		{"x-forwarded-for through two proxies", "10.1.2.3:4000", map[string]string{headerXForwardedFor: "198.51.100.1, 10.9.9.9"}, "198.51.100.1"},
+		{"spoofed leftmost entry is skipped", "10.1.2.3:4000", map[string]string{headerXForwardedFor: "1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"x-real-ip", "192.0.2.10:4000", map[string]string{headerXRealIP: "198.51.100.2"}, "198.51.100.2"},
+		{"forwarded wins over x-forwarded-for", "10.1.2.3:4000", map[string]string{
+			headerForwarded:     `for=198.51.100.3;proto=https, for="[2001:db8::17]:4711"`,
+			headerXForwardedFor: "198.51.100.99",
+		}, "2001:db8::17"},
+		{"forwarded with port", "[fd00::1]:4000", map[string]string{headerForwarded: `for="198.51.100.4:47011"`}, "198.51.100.4"},
+		{"obfuscated hop stops at the nearest trusted proxy", "10.1.2.3:4000", map[string]string{headerForwarded: "for=198.51.100.5, for=_hidden, for=10.4.4.4"}, "10.4.4.4"},
+		{"garbage header falls back to the peer", "10.1.2.3:4000", map[string]string{headerXForwardedFor: "not-an-ip"}, "10.1.2.3"},
+	}
+	for _, testCase := range testCases {
+		request := httptest.NewRequest(http.MethodPost, "http://ets.example/api", nil)
+		request.RemoteAddr = testCase.remoteAddress
+		for headerName, headerValue := range testCase.headers {
+			request.Header.Set(headerName, headerValue)
+		}
+		if gotIP := resolveClientIP(request, trustedProxies); gotIP != testCase.wantIP {
+			t.Fatalf("%s: expected %s, got %s", testCase.name, testCase.wantIP, gotIP)
+		}
+	}
+}
+
+func TestParseTrustedProxies_RejectsMalformedEntries(t *testing.T) {
+	for _, rawProxies := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0.0/8, ::1/129"} {
+		if _, parseErr := parseTrustedProxies(rawProxies); parseErr == nil {
+			t.Fatalf("expected %q to be rejected", rawProxies)
+		}
+	}
+	if trustedProxies, parseErr := parseTrustedProxies(""); parseErr != nil || len(trustedProxies) != 0 {
+		t.Fatalf("expected no trusted proxies by default, got %v %v", trustedProxies, parseErr)
+	}
+}
+
+func TestHandleTokenIssue_RateLimitsResolvedClientBehindProxy(t *testing.T) {
+	issueRules, parseErr := parseRateLimitRules("ip=1/m")
+	if parseErr != nil {
+		t.Fatalf("parseRateLimitRules: %v", parseErr)
+	}
+	trustedProxies, parseErr := parseTrustedProxies("127.0.0.1")
+	if parseErr != nil {
+		t.Fatalf("parseTrustedProxies: %v", parseErr)
+	}
+	gatewayConfig := newIssueTestConfig()
+	gatewayConfig.IssueRateLimitRules = issueRules
+	gatewayConfig.TrustedProxies = trustedProxies
+	issueGuard := newIssuanceGuard(gatewayConfig)
+
+	var statusCodes []int
+	for _, forwardedFor := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.1"} {
+		request := newIssueTokenRequest(t, "127.0.0.1:5000")
+		request.Header.Set(headerXForwardedFor, forwardedFor)
+		recorder := httptest.NewRecorder()
+		handleTokenIssue(recorder, request, gatewayConfig, issueGuard)
+		statusCodes = append(statusCodes, recorder.Code)
+	}
+	if statusCodes[0] != http.StatusOK || statusCodes[1] != http.StatusOK || statusCodes[2] != http.StatusTooManyRequests {
+		t.Fatalf("expected separate buckets per forwarded client, got %v", statusCodes)
+	}
+}
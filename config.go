@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/netip"
 	"net/url"
 	"os"
 	"strconv"
@@ -14,10 +15,14 @@ const (
 	envKeyOriginAllowlist        = "ORIGIN_ALLOWLIST"
 	envKeyTokenLifetimeSeconds   = "TOKEN_LIFETIME_SECONDS"
 	envKeyJwtHmacKey             = "TVM_JWT_HS256_KEY"
+	envKeyJwtSigningKeyFile      = "TVM_JWT_SIGNING_KEY_FILE"
+	envKeyJwtKeyID               = "TVM_JWT_KEY_ID"
+	envKeyJwtKeyringFile         = "TVM_JWT_KEYRING_FILE"
 	envKeyUpstreamBaseURL        = "UPSTREAM_BASE_URL"
 	envKeyUpstreamServiceSecret  = "UPSTREAM_SERVICE_SECRET"
 	envKeyRateLimitPerMinute     = "RATE_LIMIT_PER_MINUTE"
 	envKeyUpstreamTimeoutSeconds = "UPSTREAM_TIMEOUT_SECONDS"
+	envKeyUpstreamRoutesFile     = "UPSTREAM_ROUTES_FILE"
 
 	defaultListenAddress          = ":8080"
 	defaultTokenLifetimeSeconds   = 300
@@ -28,12 +33,29 @@ const (
 type serverConfig struct {
 	ListenAddress      string
 	AllowedOrigins     map[string]struct{}
+	OriginPatterns     []originPattern
+	Cors               corsPolicySet
 	TokenLifetime      time.Duration
 	JwtHmacKey         []byte
-	UpstreamBaseURL    *url.URL
-	UpstreamSecretKey  string
+	TokenKeyring       *tokenKeyring
+	UpstreamRoutes     []upstreamRoute
 	RateLimitPerMinute int
-	UpstreamTimeout    time.Duration
+	RateLimit          rateLimitSettings
+	RateLimitRules     []rateLimitRule
+	// IssueRateLimitRules and IssueMaxActiveTokensPerIP guard /tvm/issue.
+	IssueRateLimitRules       []rateLimitRule
+	IssueMaxActiveTokensPerIP int
+	// IssueAllowUnprovenJwk accepts issuance requests without a DPoP proof.
+	IssueAllowUnprovenJwk bool
+	TrustedProxies        []netip.Prefix
+	// DpopNonces is nil unless DPOP_NONCE_SECRET is set.
+	DpopNonces       *dpopNonceIssuer
+	DpopReplayWindow time.Duration
+	DpopRequireAth   bool
+	// DpopAllowedAlgs is nil when every supported algorithm is allowed.
+	DpopAllowedAlgs map[string]struct{}
+	UpstreamTimeout time.Duration
+	ReplayCache     proofReplayCache
 }
 
 func loadConfig() (serverConfig, error) {
@@ -41,12 +63,9 @@ func loadConfig() (serverConfig, error) {
 	if originAllowlistEnv == "" {
 		return serverConfig{}, fmt.Errorf("missing %s", envKeyOriginAllowlist)
 	}
-	allowedOrigins := make(map[string]struct{})
-	for _, originItem := range strings.Split(originAllowlistEnv, ",") {
-		trimmed := strings.TrimSpace(originItem)
-		if trimmed != "" {
-			allowedOrigins[trimmed] = struct{}{}
-		}
+	allowedOrigins, originPatterns, originsError := parseOriginAllowlist(strings.Split(originAllowlistEnv, ","))
+	if originsError != nil {
+		return serverConfig{}, fmt.Errorf("bad %s: %w", envKeyOriginAllowlist, originsError)
 	}
 
 	listenAddress := os.Getenv(envKeyListenAddress)
@@ -76,29 +95,162 @@ func loadConfig() (serverConfig, error) {
 	}
 
 	jwtHmacSecret := strings.TrimSpace(os.Getenv(envKeyJwtHmacKey))
-	if len(jwtHmacSecret) < 16 {
+	accessTokenKeyring, keyringError := loadTokenKeyring(jwtHmacSecret)
+	if keyringError != nil {
+		return serverConfig{}, keyringError
+	}
+	if accessTokenKeyring == nil && len(jwtHmacSecret) < minimumHmacSecretLength {
 		return serverConfig{}, fmt.Errorf("weak or missing %s", envKeyJwtHmacKey)
 	}
 
-	upstreamBaseURLString := strings.TrimSpace(os.Getenv(envKeyUpstreamBaseURL))
-	if upstreamBaseURLString == "" {
-		return serverConfig{}, fmt.Errorf("missing %s", envKeyUpstreamBaseURL)
+	upstreamTimeout := time.Duration(upstreamTimeoutSeconds) * time.Second
+	upstreamRoutes, routesError := loadUpstreamRoutes(upstreamTimeout)
+	if routesError != nil {
+		return serverConfig{}, routesError
 	}
-	upstreamBaseURL, parseURLError := url.Parse(upstreamBaseURLString)
-	if parseURLError != nil {
-		return serverConfig{}, fmt.Errorf("bad %s: %v", envKeyUpstreamBaseURL, parseURLError)
+
+	signingKeyring := serverConfig{JwtHmacKey: []byte(jwtHmacSecret), TokenKeyring: accessTokenKeyring}.accessTokenKeyring()
+	if assertionKeyError := checkIdentityAssertionKey(upstreamRoutes, signingKeyring); assertionKeyError != nil {
+		return serverConfig{}, assertionKeyError
+	}
+
+	corsPolicies, corsError := loadCorsPolicies()
+	if corsError != nil {
+		return serverConfig{}, corsError
+	}
+
+	rateLimit, rateLimitError := loadRateLimitSettings()
+	if rateLimitError != nil {
+		return serverConfig{}, rateLimitError
+	}
+
+	rateLimitRules, rulesError := loadRateLimitRules()
+	if rulesError != nil {
+		return serverConfig{}, rulesError
+	}
+
+	issueRateLimitRules, issueMaxActiveTokens, issueLimitsError := loadIssuanceLimits()
+	if issueLimitsError != nil {
+		return serverConfig{}, issueLimitsError
+	}
+
+	issueAllowUnprovenJwk, unprovenJwkError := loadIssueAllowUnprovenJwk()
+	if unprovenJwkError != nil {
+		return serverConfig{}, unprovenJwkError
+	}
+
+	trustedProxies, trustedProxiesError := loadTrustedProxies()
+	if trustedProxiesError != nil {
+		return serverConfig{}, trustedProxiesError
+	}
+
+	dpopNonces, dpopReplayWindow, dpopNonceError := loadDpopNonceSettings()
+	if dpopNonceError != nil {
+		return serverConfig{}, dpopNonceError
+	}
+
+	dpopAllowedAlgs, allowedAlgsError := loadDpopAllowedAlgs()
+	if allowedAlgsError != nil {
+		return serverConfig{}, allowedAlgsError
+	}
+
+	dpopRequireAth, requireAthError := loadDpopRequireAth()
+	if requireAthError != nil {
+		return serverConfig{}, requireAthError
 	}
 
-	upstreamServiceSecret := strings.TrimSpace(os.Getenv(envKeyUpstreamServiceSecret))
+	replayCache, replayError := loadReplayCache()
+	if replayError != nil {
+		return serverConfig{}, replayError
+	}
 
 	return serverConfig{
-		ListenAddress:      listenAddress,
-		AllowedOrigins:     allowedOrigins,
-		TokenLifetime:      time.Duration(tokenLifetimeSeconds) * time.Second,
-		JwtHmacKey:         []byte(jwtHmacSecret),
-		UpstreamBaseURL:    upstreamBaseURL,
-		UpstreamSecretKey:  upstreamServiceSecret,
-		RateLimitPerMinute: rateLimitPerMinute,
-		UpstreamTimeout:    time.Duration(upstreamTimeoutSeconds) * time.Second,
+		ListenAddress:             listenAddress,
+		AllowedOrigins:            allowedOrigins,
+		OriginPatterns:            originPatterns,
+		Cors:                      corsPolicies,
+		TokenLifetime:             time.Duration(tokenLifetimeSeconds) * time.Second,
+		JwtHmacKey:                []byte(jwtHmacSecret),
+		TokenKeyring:              accessTokenKeyring,
+		UpstreamRoutes:            upstreamRoutes,
+		RateLimitPerMinute:        rateLimitPerMinute,
+		RateLimit:                 rateLimit,
+		RateLimitRules:            rateLimitRules,
+		IssueRateLimitRules:       issueRateLimitRules,
+		IssueMaxActiveTokensPerIP: issueMaxActiveTokens,
+		IssueAllowUnprovenJwk:     issueAllowUnprovenJwk,
+		TrustedProxies:            trustedProxies,
+		DpopNonces:                dpopNonces,
+		DpopReplayWindow:          dpopReplayWindow,
+		DpopRequireAth:            dpopRequireAth,
+		DpopAllowedAlgs:           dpopAllowedAlgs,
+		UpstreamTimeout:           upstreamTimeout,
+		ReplayCache:               replayCache,
 	}, nil
 }
+
+// A nil keyring means tokens are signed with TVM_JWT_HS256_KEY alone.
+func loadTokenKeyring(jwtHmacSecret string) (*tokenKeyring, error) {
+	if keyringFilePath := strings.TrimSpace(os.Getenv(envKeyJwtKeyringFile)); keyringFilePath != "" {
+		keyringBytes, readKeyringError := os.ReadFile(keyringFilePath)
+		if readKeyringError != nil {
+			return nil, fmt.Errorf("read %s: %w", envKeyJwtKeyringFile, readKeyringError)
+		}
+		parsedKeyring, parseKeyringError := parseKeyringFile(keyringBytes)
+		if parseKeyringError != nil {
+			return nil, fmt.Errorf("bad %s: %w", envKeyJwtKeyringFile, parseKeyringError)
+		}
+		return &parsedKeyring, nil
+	}
+
+	signingKeyFile := strings.TrimSpace(os.Getenv(envKeyJwtSigningKeyFile))
+	if signingKeyFile == "" {
+		return nil, nil
+	}
+	signingKeyPem, readKeyError := os.ReadFile(signingKeyFile)
+	if readKeyError != nil {
+		return nil, fmt.Errorf("read %s: %w", envKeyJwtSigningKeyFile, readKeyError)
+	}
+	parsedSigningKey, parseKeyError := parseTokenSigningKey(signingKeyPem, strings.TrimSpace(os.Getenv(envKeyJwtKeyID)))
+	if parseKeyError != nil {
+		return nil, fmt.Errorf("bad %s: %w", envKeyJwtSigningKeyFile, parseKeyError)
+	}
+	signingKeyring := tokenKeyring{Current: parsedSigningKey}
+	// Keep accepting kid-less HS256 tokens while migrating away from the shared secret.
+	if len(jwtHmacSecret) >= minimumHmacSecretLength {
+		signingKeyring.Previous = append(signingKeyring.Previous, newHmacTokenKey([]byte(jwtHmacSecret)))
+	}
+	return &signingKeyring, nil
+}
+
+func loadUpstreamRoutes(upstreamTimeout time.Duration) ([]upstreamRoute, error) {
+	if routesFilePath := strings.TrimSpace(os.Getenv(envKeyUpstreamRoutesFile)); routesFilePath != "" {
+		routesBytes, readRoutesError := os.ReadFile(routesFilePath)
+		if readRoutesError != nil {
+			return nil, fmt.Errorf("read %s: %w", envKeyUpstreamRoutesFile, readRoutesError)
+		}
+		parsedRoutes, parseRoutesError := parseUpstreamRoutes(routesBytes, upstreamTimeout)
+		if parseRoutesError != nil {
+			return nil, fmt.Errorf("bad %s: %w", envKeyUpstreamRoutesFile, parseRoutesError)
+		}
+		return parsedRoutes, nil
+	}
+
+	upstreamBaseURLString := strings.TrimSpace(os.Getenv(envKeyUpstreamBaseURL))
+	if upstreamBaseURLString == "" {
+		return nil, fmt.Errorf("missing %s or %s", envKeyUpstreamBaseURL, envKeyUpstreamRoutesFile)
+	}
+	upstreamBaseURL, parseURLError := url.Parse(upstreamBaseURLString)
+	if parseURLError != nil {
+		return nil, fmt.Errorf("bad %s: %v", envKeyUpstreamBaseURL, parseURLError)
+	}
+	legacyRoute := upstreamRoute{
+		PathPrefix:      legacyApiPathPrefix,
+		UpstreamBaseURL: upstreamBaseURL,
+		UpstreamTimeout: upstreamTimeout,
+	}
+	if upstreamServiceSecret := strings.TrimSpace(os.Getenv(envKeyUpstreamServiceSecret)); upstreamServiceSecret != "" {
+		legacyRoute.UpstreamAuth = queryParameterAuth{ParameterName: defaultUpstreamSecretQueryParameter, Secret: upstreamServiceSecret}
+	}
+	return []upstreamRoute{legacyRoute}, nil
+}
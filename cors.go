@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envKeyCorsAllowHeaders     = "CORS_ALLOW_HEADERS"
+	envKeyCorsExposeHeaders    = "CORS_EXPOSE_HEADERS"
+	envKeyCorsMaxAgeSeconds    = "CORS_MAX_AGE_SECONDS"
+	envKeyCorsAllowCredentials = "CORS_ALLOW_CREDENTIALS"
+	envKeyCorsPolicyFile       = "CORS_POLICY_FILE"
+
+	headerAccessControlRequestMethod  = "Access-Control-Request-Method"
+	headerAccessControlRequestHeaders = "Access-Control-Request-Headers"
+	headerAccessControlMaxAge         = "Access-Control-Max-Age"
+	headerAccessControlExposeHeaders  = "Access-Control-Expose-Headers"
+	headerAccessControlAllowCreds     = "Access-Control-Allow-Credentials"
+
+	defaultCorsMaxAgeSeconds = 600
+	issueAllowMethodsValue   = "POST, OPTIONS"
+)
+
+// The SDK always sends these; operators can only add to them.
+var requiredCorsHeaders = []string{headerAuthorization, headerContentType, headerDpop}
+
+// defaultCorsExposeHeaders lets browser code read rate-limit feedback and DPoP nonces.
+var defaultCorsExposeHeaders = []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After", "DPoP-Nonce"}
+
+type corsPolicy struct {
+	AllowHeaders     map[string]struct{}
+	ExposeHeaders    []string
+	MaxAge           time.Duration
+	AllowCredentials bool
+}
+
+// The zero corsPolicySet answers like the original fixed CORS headers.
+type corsPolicySet struct {
+	Default    corsPolicy
+	PerOrigin  map[string]corsPolicy
+	PerPattern []patternCorsPolicy
+}
+
+type patternCorsPolicy struct {
+	Pattern originPattern
+	Policy  corsPolicy
+}
+
+type corsPolicyFile struct {
+	Origins map[string]corsPolicyConfig `json:"origins"`
+}
+
+// Fields left out inherit from the environment-level default.
+type corsPolicyConfig struct {
+	AllowHeaders     []string `json:"allowHeaders"`
+	ExposeHeaders    []string `json:"exposeHeaders"`
+	MaxAgeSeconds    *int     `json:"maxAgeSeconds"`
+	AllowCredentials *bool    `json:"allowCredentials"`
+}
+
+func (policySet corsPolicySet) policyFor(origin string) corsPolicy {
+	if originPolicy, found := policySet.PerOrigin[origin]; found {
+		return originPolicy
+	}
+	for _, patternPolicy := range policySet.PerPattern {
+		if patternPolicy.Pattern.matches(origin) {
+			return patternPolicy.Policy
+		}
+	}
+	return policySet.Default
+}
+
+func (policy corsPolicy) allowsHeader(headerName string) bool {
+	canonicalName := http.CanonicalHeaderKey(headerName)
+	for _, requiredHeader := range requiredCorsHeaders {
+		if canonicalName == http.CanonicalHeaderKey(requiredHeader) {
+			return true
+		}
+	}
+	_, allowed := policy.AllowHeaders[canonicalName]
+	return allowed
+}
+
+// handleCors returns false once it has written the response.
+func handleCors(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, gatewayConfig serverConfig, allowMethodsValue string) bool {
+	if !checkOrigin(httpResponseWriter, httpRequest, gatewayConfig.AllowedOrigins, gatewayConfig.OriginPatterns...) {
+		return false
+	}
+	policy := gatewayConfig.Cors.policyFor(httpRequest.Header.Get("Origin"))
+	responseHeaders := httpResponseWriter.Header()
+	responseHeaders.Set(headerAccessControlAllowMethods, allowMethodsValue)
+	if policy.AllowCredentials {
+		responseHeaders.Set(headerAccessControlAllowCreds, "true")
+	}
+	if httpRequest.Method != http.MethodOptions {
+		if len(policy.ExposeHeaders) > 0 {
+			responseHeaders.Set(headerAccessControlExposeHeaders, strings.Join(policy.ExposeHeaders, ", "))
+		}
+		return true
+	}
+
+	responseHeaders.Add(headerVary, headerAccessControlRequestMethod)
+	responseHeaders.Add(headerVary, headerAccessControlRequestHeaders)
+	if requestedMethod := strings.TrimSpace(httpRequest.Header.Get(headerAccessControlRequestMethod)); requestedMethod != "" && !methodListed(allowMethodsValue, requestedMethod) {
+		httpErrorJSON(httpResponseWriter, http.StatusForbidden, "cors_method_not_allowed")
+		return false
+	}
+	requestedHeaders := splitHeaderList(httpRequest.Header.Values(headerAccessControlRequestHeaders))
+	for _, requestedHeader := range requestedHeaders {
+		if !policy.allowsHeader(requestedHeader) {
+			httpErrorJSON(httpResponseWriter, http.StatusForbidden, "cors_header_not_allowed")
+			return false
+		}
+	}
+	if len(requestedHeaders) > 0 {
+		responseHeaders.Set(headerAccessControlAllowHeaders, strings.Join(requestedHeaders, ", "))
+	}
+	if policy.MaxAge > 0 {
+		responseHeaders.Set(headerAccessControlMaxAge, strconv.Itoa(int(policy.MaxAge/time.Second)))
+	}
+	httpResponseWriter.WriteHeader(http.StatusNoContent)
+	return false
+}
+
+func methodListed(allowMethodsValue string, httpMethod string) bool {
+	for _, listedMethod := range strings.Split(allowMethodsValue, ",") {
+		if strings.TrimSpace(listedMethod) == httpMethod {
+			return true
+		}
+	}
+	return false
+}
+
+func splitHeaderList(headerValues []string) []string {
+	var headerNames []string
+	for _, headerValue := range headerValues {
+		for _, headerName := range strings.Split(headerValue, ",") {
+			if trimmed := strings.TrimSpace(headerName); trimmed != "" {
+				headerNames = append(headerNames, trimmed)
+			}
+		}
+	}
+	return headerNames
+}
+
+func loadCorsPolicies() (corsPolicySet, error) {
+	allowHeaders, allowError := canonicalHeaderSet(splitHeaderList([]string{os.Getenv(envKeyCorsAllowHeaders)}))
+	if allowError != nil {
+		return corsPolicySet{}, fmt.Errorf("bad %s: %w", envKeyCorsAllowHeaders, allowError)
+	}
+	exposeHeaders := defaultCorsExposeHeaders
+	if exposeEnv := strings.TrimSpace(os.Getenv(envKeyCorsExposeHeaders)); exposeEnv != "" {
+		exposeHeaders = splitHeaderList([]string{exposeEnv})
+	}
+	maxAgeSeconds := defaultCorsMaxAgeSeconds
+	if maxAgeEnv := strings.TrimSpace(os.Getenv(envKeyCorsMaxAgeSeconds)); maxAgeEnv != "" {
+		parsedMaxAge, parseMaxAgeError := strconv.Atoi(maxAgeEnv)
+		if parseMaxAgeError != nil || parsedMaxAge < 0 {
+			return corsPolicySet{}, fmt.Errorf("bad %s", envKeyCorsMaxAgeSeconds)
+		}
+		maxAgeSeconds = parsedMaxAge
+	}
+	allowCredentials := false
+	if credentialsEnv := strings.TrimSpace(os.Getenv(envKeyCorsAllowCredentials)); credentialsEnv != "" {
+		parsedCredentials, parseCredentialsError := strconv.ParseBool(credentialsEnv)
+		if parseCredentialsError != nil {
+			return corsPolicySet{}, fmt.Errorf("bad %s", envKeyCorsAllowCredentials)
+		}
+		allowCredentials = parsedCredentials
+	}
+	policySet := corsPolicySet{Default: corsPolicy{
+		AllowHeaders:     allowHeaders,
+		ExposeHeaders:    exposeHeaders,
+		MaxAge:           time.Duration(maxAgeSeconds) * time.Second,
+		AllowCredentials: allowCredentials,
+	}}
+
+	policyFilePath := strings.TrimSpace(os.Getenv(envKeyCorsPolicyFile))
+	if policyFilePath == "" {
+		return policySet, nil
+	}
+	policyBytes, readPolicyError := os.ReadFile(policyFilePath)
+	if readPolicyError != nil {
+		return corsPolicySet{}, fmt.Errorf("read %s: %w", envKeyCorsPolicyFile, readPolicyError)
+	}
+	perOrigin, perPattern, parsePolicyError := parseCorsPolicyFile(policyBytes, policySet.Default)
+	if parsePolicyError != nil {
+		return corsPolicySet{}, fmt.Errorf("bad %s: %w", envKeyCorsPolicyFile, parsePolicyError)
+	}
+	policySet.PerOrigin = perOrigin
+	policySet.PerPattern = perPattern
+	return policySet, nil
+}
+
+// An exact origin's policy wins; otherwise the first matching pattern in key order.
+func parseCorsPolicyFile(policyBytes []byte, defaultPolicy corsPolicy) (map[string]corsPolicy, []patternCorsPolicy, error) {
+	var policyDocument corsPolicyFile
+	if unmarshalError := json.Unmarshal(policyBytes, &policyDocument); unmarshalError != nil {
+		return nil, nil, fmt.Errorf("decode cors policy: %w", unmarshalError)
+	}
+	originKeys := make([]string, 0, len(policyDocument.Origins))
+	for origin := range policyDocument.Origins {
+		originKeys = append(originKeys, origin)
+	}
+	sort.Strings(originKeys)
+
+	perOrigin := make(map[string]corsPolicy, len(policyDocument.Origins))
+	var perPattern []patternCorsPolicy
+	for _, origin := range originKeys {
+		if origin == "" || origin == "*" || strings.HasSuffix(origin, "/") {
+			return nil, nil, fmt.Errorf("origin %q must be a scheme://host[:port] origin", origin)
+		}
+		exactOrigins, originPatterns, patternError := parseOriginAllowlist([]string{origin})
+		if patternError != nil {
+			return nil, nil, patternError
+		}
+		originPolicy, policyError := policyDocument.Origins[origin].build(defaultPolicy)
+		if policyError != nil {
+			return nil, nil, fmt.Errorf("origin %q: %w", origin, policyError)
+		}
+		if len(exactOrigins) > 0 {
+			perOrigin[origin] = originPolicy
+			continue
+		}
+		perPattern = append(perPattern, patternCorsPolicy{Pattern: originPatterns[0], Policy: originPolicy})
+	}
+	return perOrigin, perPattern, nil
+}
+
+func (policyConfig corsPolicyConfig) build(defaultPolicy corsPolicy) (corsPolicy, error) {
+	originPolicy := defaultPolicy
+	if policyConfig.AllowHeaders != nil {
+		allowHeaders, allowError := canonicalHeaderSet(policyConfig.AllowHeaders)
+		if allowError != nil {
+			return corsPolicy{}, fmt.Errorf("allowHeaders: %w", allowError)
+		}
+		originPolicy.AllowHeaders = allowHeaders
+	}
+	if policyConfig.ExposeHeaders != nil {
+		if _, exposeError := canonicalHeaderSet(policyConfig.ExposeHeaders); exposeError != nil {
+			return corsPolicy{}, fmt.Errorf("exposeHeaders: %w", exposeError)
+		}
+		originPolicy.ExposeHeaders = policyConfig.ExposeHeaders
+	}
+	if policyConfig.MaxAgeSeconds != nil {
+		if *policyConfig.MaxAgeSeconds < 0 {
+			return corsPolicy{}, fmt.Errorf("maxAgeSeconds must not be negative")
+		}
+		originPolicy.MaxAge = time.Duration(*policyConfig.MaxAgeSeconds) * time.Second
+	}
+	if policyConfig.AllowCredentials != nil {
+		originPolicy.AllowCredentials = *policyConfig.AllowCredentials
+	}
+	return originPolicy, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandleCors_PreflightEchoesAllowedHeadersWithMaxAge(t *testing.T) {
+	allowedOrigins := map[string]struct{}{"https://app.example.com": {}}
+	policySet := corsPolicySet{Default: corsPolicy{
+		AllowHeaders: map[string]struct{}{"X-Request-Id": {}},
+		MaxAge:       10 * time.Minute,
+	}}
+
+	recorder := httptest.NewRecorder()
+	request := newPreflightRequest(http.MethodDelete, "authorization, dpop, x-request-id")
+	if handleCors(recorder, request, serverConfig{AllowedOrigins: allowedOrigins, Cors: policySet}, "GET, DELETE, OPTIONS") {
+		t.Fatalf("expected the preflight to be answered by handleCors")
+	}
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", recorder.Code)
+	}
+	if got := recorder.Header().Get(headerAccessControlAllowHeaders); got != "authorization, dpop, x-request-id" {
+		t.Fatalf("expected requested headers to be echoed, got %q", got)
+	}
+	if recorder.Header().Get(headerAccessControlMaxAge) != "600" || recorder.Header().Get(headerAccessControlAllowMethods) != "GET, DELETE, OPTIONS" {
+		t.Fatalf("unexpected preflight headers %v", recorder.Header())
+	}
+	if recorder.Header().Get(headerAccessControlAllowCreds) != "" {
+		t.Fatalf("expected credentials to stay disabled by default")
+	}
+}
+
+func TestHandleCors_RejectsUnlistedPreflightHeadersAndMethods(t *testing.T) {
+	allowedOrigins := map[string]struct{}{"https://app.example.com": {}}
+
+	headerRecorder := httptest.NewRecorder()
+	handleCors(headerRecorder, newPreflightRequest(http.MethodPost, "Authorization, X-Secret-Debug"), serverConfig{AllowedOrigins: allowedOrigins}, "GET, POST, OPTIONS")
+	if headerRecorder.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for an unlisted header, got %d", headerRecorder.Code)
+	}
+
+	methodRecorder := httptest.NewRecorder()
+	handleCors(methodRecorder, newPreflightRequest(http.MethodPut, ""), serverConfig{AllowedOrigins: allowedOrigins}, "GET, POST, OPTIONS")
+	if methodRecorder.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for an unlisted method, got %d", methodRecorder.Code)
+	}
+}
+
+func TestHandleCors_AppliesPerOriginPolicyToActualRequests(t *testing.T) {
+	allowedOrigins := map[string]struct{}{"https://app.example.com": {}, "https://admin.example.com": {}}
+	defaultPolicy := corsPolicy{ExposeHeaders: defaultCorsExposeHeaders, MaxAge: time.Minute}
+	perOrigin, _, parseErr := parseCorsPolicyFile([]byte(`{"origins":{
+		"https://admin.example.com":{"exposeHeaders":["X-Total-Count"],"allowCredentials":true}
+	}}`), defaultPolicy)
+	if parseErr != nil {
+		t.Fatalf("parseCorsPolicyFile: %v", parseErr)
+	}
+	policySet := corsPolicySet{Default: defaultPolicy, PerOrigin: perOrigin}
+
+	adminRecorder := httptest.NewRecorder()
+	adminRequest := httptest.NewRequest(http.MethodGet, "http://ets.example/api", nil)
+	adminRequest.Header.Set("Origin", "https://admin.example.com")
+	if !handleCors(adminRecorder, adminRequest, serverConfig{AllowedOrigins: allowedOrigins, Cors: policySet}, "GET, POST, OPTIONS") {
+		t.Fatalf("expected the actual request to proceed")
+	}
+	if adminRecorder.Header().Get(headerAccessControlExposeHeaders) != "X-Total-Count" || adminRecorder.Header().Get(headerAccessControlAllowCreds) != "true" {
+		t.Fatalf("expected the admin origin policy, got %v", adminRecorder.Header())
+	}
+	if perOrigin["https://admin.example.com"].MaxAge != time.Minute {
+		t.Fatalf("expected omitted fields to inherit the default policy")
+	}
+
+	appRecorder := httptest.NewRecorder()
+	appRequest := httptest.NewRequest(http.MethodGet, "http://ets.example/api", nil)
+	appRequest.Header.Set("Origin", "https://app.example.com")
+	handleCors(appRecorder, appRequest, serverConfig{AllowedOrigins: allowedOrigins, Cors: policySet}, "GET, POST, OPTIONS")
+	if appRecorder.Header().Get(headerAccessControlExposeHeaders) != "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After, DPoP-Nonce" {
+		t.Fatalf("expected the default exposed headers, got %q", appRecorder.Header().Get(headerAccessControlExposeHeaders))
+	}
+}
+
+func TestParseCorsPolicyFile_MatchesOriginPatterns(t *testing.T) {
+	defaultPolicy := corsPolicy{MaxAge: time.Minute}
+	perOrigin, perPattern, parseErr := parseCorsPolicyFile([]byte(`{"origins":{
+		"https://*.preview.example.com":{"maxAgeSeconds":5},
+		"https://pr-1.preview.example.com":{"maxAgeSeconds":10},
+		"http://localhost:3000-3999":{"allowCredentials":true}
+	}}`), defaultPolicy)
+	if parseErr != nil {
+		t.Fatalf("parseCorsPolicyFile: %v", parseErr)
+	}
+	policySet := corsPolicySet{Default: defaultPolicy, PerOrigin: perOrigin, PerPattern: perPattern}
+	if policySet.policyFor("https://pr-2.preview.example.com").MaxAge != 5*time.Second {
+		t.Fatalf("expected the wildcard policy for a preview origin")
+	}
+	if policySet.policyFor("https://pr-1.preview.example.com").MaxAge != 10*time.Second {
+		t.Fatalf("expected the exact policy to win over the wildcard")
+	}
+	if !policySet.policyFor("http://localhost:3100").AllowCredentials || policySet.policyFor("http://localhost:4000").AllowCredentials {
+		t.Fatalf("expected the port-range policy only inside the range")
+	}
+	if _, _, parseErr := parseCorsPolicyFile([]byte(`{"origins":{"https://*.com":{}}}`), defaultPolicy); parseErr == nil {
+		t.Fatalf("expected an unsafe pattern to be rejected")
+	}
+}
+
+func TestLoadCorsPolicies_ReadsEnvironmentAndPolicyFile(t *testing.T) {
+	policyFilePath := filepath.Join(t.TempDir(), "cors.json")
+	if writeErr := os.WriteFile(policyFilePath, []byte(`{"origins":{"https://app.example.com":{"maxAgeSeconds":30}}}`), 0o600); writeErr != nil {
+		t.Fatalf("os.WriteFile: %v", writeErr)
+	}
+	t.Setenv(envKeyCorsAllowHeaders, "X-Request-Id, Idempotency-Key")
+	t.Setenv(envKeyCorsExposeHeaders, "X-Total-Count")
+	t.Setenv(envKeyCorsMaxAgeSeconds, "120")
+	t.Setenv(envKeyCorsAllowCredentials, "true")
+	t.Setenv(envKeyCorsPolicyFile, policyFilePath)
+
+	policySet, loadErr := loadCorsPolicies()
+	if loadErr != nil {
+		t.Fatalf("loadCorsPolicies: %v", loadErr)
+	}
+	if !policySet.Default.allowsHeader("idempotency-key") || !policySet.Default.allowsHeader("DPoP") || policySet.Default.allowsHeader("X-Other") {
+		t.Fatalf("unexpected allowed headers %v", policySet.Default.AllowHeaders)
+	}
+	if policySet.Default.MaxAge != 2*time.Minute || !policySet.Default.AllowCredentials || policySet.Default.ExposeHeaders[0] != "X-Total-Count" {
+		t.Fatalf("unexpected default policy %+v", policySet.Default)
+	}
+	if appPolicy := policySet.policyFor("https://app.example.com"); appPolicy.MaxAge != 30*time.Second || !appPolicy.AllowCredentials {
+		t.Fatalf("unexpected per-origin policy %+v", appPolicy)
+	}
+
+	t.Setenv(envKeyCorsMaxAgeSeconds, "soon")
+	if _, loadErr := loadCorsPolicies(); loadErr == nil {
+		t.Fatalf("expected a malformed max-age to be rejected")
+	}
+}
+
+func newPreflightRequest(requestedMethod string, requestedHeaders string) *http.Request {
+	request := httptest.NewRequest(http.MethodOptions, "http://ets.example/api", nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	request.Header.Set(headerAccessControlRequestMethod, requestedMethod)
+	if requestedHeaders != "" {
+		request.Header.Set(headerAccessControlRequestHeaders, requestedHeaders)
+	}
+	return request
+}
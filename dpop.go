@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envKeyIssueAllowUnprovenJwk = "ISSUE_ALLOW_UNPROVEN_JWK"
+
+type dpopProofError struct {
+	code string
+}
+
+func (proofError dpopProofError) Error() string {
+	return proofError.code
+}
+
+type verifiedDpopProof struct {
+	Jwk        publicJwk
+	Thumbprint string
+	Payload    dpopPayload
+	IssuedAt   time.Time
+}
+
+// Binding the proof to a token, nonce, or replay cache is up to the caller.
+func verifyDpopProof(httpRequest *http.Request, gatewayConfig serverConfig) (verifiedDpopProof, error) {
+	rawDpopHeader := stringsTrimSpace(httpRequest.Header.Get(headerDpop))
+	if rawDpopHeader == "" {
+		return verifiedDpopProof{}, dpopProofError{"missing_dpop"}
+	}
+
+	dpopHeaderObject, dpopPayloadObject, dpopSigningInput, dpopSignatureBytes, parseDpopError := parseCompactJws(rawDpopHeader)
+	if errors.Is(parseDpopError, errUnexpectedJwsHeader) {
+		return verifiedDpopProof{}, dpopProofError{"bad_dpop_header"}
+	}
+	if parseDpopError != nil {
+		return verifiedDpopProof{}, dpopProofError{"bad_dpop"}
+	}
+	signingAlgorithm, supportedAlgorithm := dpopAlgorithms[dpopHeaderObject.Alg]
+	if !stringsEqualFold(dpopHeaderObject.Type, "dpop+jwt") || !supportedAlgorithm || !gatewayConfig.dpopAlgorithmAllowed(dpopHeaderObject.Alg) {
+		return verifiedDpopProof{}, dpopProofError{"bad_dpop_header"}
+	}
+
+	if !signingAlgorithm.signs(dpopHeaderObject.Jwk) {
+		return verifiedDpopProof{}, dpopProofError{"bad_dpop_key"}
+	}
+	signingKey, keyError := publicKeyFromJwk(dpopHeaderObject.Jwk)
+	if keyError != nil {
+		return verifiedDpopProof{}, dpopProofError{"bad_dpop_key"}
+	}
+	if !signingAlgorithm.verify(signingKey, dpopSigningInput, dpopSignatureBytes) {
+		return verifiedDpopProof{}, dpopProofError{"bad_dpop_sig"}
+	}
+	jwkThumbprintComputed, thumbError := jwkThumbprint(dpopHeaderObject.Jwk)
+	if thumbError != nil {
+		return verifiedDpopProof{}, dpopProofError{"bad_dpop_key"}
+	}
+
+	if dpopPayloadObject.HttpMethod != httpRequest.Method {
+		return verifiedDpopProof{}, dpopProofError{"htm_mismatch"}
+	}
+	if dpopPayloadObject.HttpUri != expectedHtu(httpRequest, gatewayConfig.TrustedProxies...) {
+		return verifiedDpopProof{}, dpopProofError{"htu_mismatch"}
+	}
+	if dpopPayloadObject.JwtID == "" {
+		return verifiedDpopProof{}, dpopProofError{"missing_dpop_jti"}
+	}
+	if len(dpopPayloadObject.JwtID) > maxDpopJtiBytes {
+		return verifiedDpopProof{}, dpopProofError{"dpop_jti_too_long"}
+	}
+	if dpopPayloadObject.IssuedAt == 0 {
+		return verifiedDpopProof{}, dpopProofError{"missing_dpop_iat"}
+	}
+
+	now := timeNow()
+	issuedAtTime := time.Unix(dpopPayloadObject.IssuedAt, 0)
+	if issuedAtTime.After(now.Add(dpopAllowedClockSkew)) {
+		return verifiedDpopProof{}, dpopProofError{"dpop_iat_in_future"}
+	}
+	if issuedAtTime.Before(now.Add(-1 * gatewayConfig.proofReplayWindow())) {
+		return verifiedDpopProof{}, dpopProofError{"dpop_iat_too_old"}
+	}
+
+	return verifiedDpopProof{
+		Jwk:        dpopHeaderObject.Jwk,
+		Thumbprint: jwkThumbprintComputed,
+		Payload:    dpopPayloadObject,
+		IssuedAt:   issuedAtTime,
+	}, nil
+}
+
+func loadIssueAllowUnprovenJwk() (bool, error) {
+	rawAllow := strings.TrimSpace(os.Getenv(envKeyIssueAllowUnprovenJwk))
+	if rawAllow == "" {
+		return false, nil
+	}
+	allowUnproven, parseError := strconv.ParseBool(rawAllow)
+	if parseError != nil {
+		return false, fmt.Errorf("bad %s: %q", envKeyIssueAllowUnprovenJwk, rawAllow)
+	}
+	return allowUnproven, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const envKeyDpopRequireAth = "DPOP_REQUIRE_ATH"
+
+// accessTokenHash is the RFC 9449 ath value: base64url SHA-256 of the access token's ASCII bytes.
+func accessTokenHash(accessToken string) string {
+	tokenDigest := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(tokenDigest[:])
+}
+
+// athMatches reports whether a proof's ath claim is the hash of the token it accompanies.
+func athMatches(proofHash string, accessToken string) bool {
+	return subtle.ConstantTimeCompare([]byte(proofHash), []byte(accessTokenHash(accessToken))) == 1
+}
+
+// loadDpopRequireAth reads DPOP_REQUIRE_ATH. When false, proofs without ath are still accepted,
+// but an ath that is present must match.
+func loadDpopRequireAth() (bool, error) {
+	rawRequire := strings.TrimSpace(os.Getenv(envKeyDpopRequireAth))
+	if rawRequire == "" {
+		return false, nil
+	}
+	requireAth, parseError := strconv.ParseBool(rawRequire)
+	if parseError != nil {
+		return false, fmt.Errorf("bad %s: %q", envKeyDpopRequireAth, rawRequire)
+	}
+	return requireAth, nil
+}
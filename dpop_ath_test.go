@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessTokenHash_MatchesRFC9449Example(t *testing.T) {
+	// Access token and ath value from RFC 9449 section 7.1.
+	if gotHash := accessTokenHash("Kz~8mXK1EalYznwH-LC-1fBAo.4Ljp~zsPE_NeO.gxU"); gotHash != "fUHyO2r2Z3DZ53EsNrWBb0xWXoaNy59IiKCAqksmQEo" {
+		t.Fatalf("unexpected ath %s", gotHash)
+	}
+}
+
+func TestHandleProtectedProxy_VerifiesAth(t *testing.T) {
+	tokenSigningKey := []byte("0123456789abcdef0123456789abcdef")
+	testClient := newDpopTestClient(t, tokenSigningKey)
+	otherClient := newDpopTestClient(t, tokenSigningKey)
+
+	testCases := []struct {
+		name       string
+		requireAth bool
+		ath        string
+		wantStatus int
+		wantError  string
+	}{
+		{"optional and absent", false, "", http.StatusNoContent, ""},
+		{"optional and matching", false, accessTokenHash(testClient.accessToken), http.StatusNoContent, ""},
+		{"optional but for another token", false, accessTokenHash(otherClient.accessToken), http.StatusUnauthorized, "ath_mismatch"},
+		{"required and absent", true, "", http.StatusUnauthorized, "missing_dpop_ath"},
+		{"required and matching", true, accessTokenHash(testClient.accessToken), http.StatusNoContent, ""},
+	}
+	for _, testCase := range testCases {
+		gatewayConfig := serverConfig{
+			AllowedOrigins:  map[string]struct{}{"https://app.example.com": {}},
+			TokenLifetime:   5 * time.Minute,
+			JwtHmacKey:      tokenSigningKey,
+			UpstreamTimeout: 10 * time.Second,
+			DpopRequireAth:  testCase.requireAth,
+		}
+		proofPayload := testClient.payload("ath-proof-" + testCase.name)
+		proofPayload.AccessTokenHash = testCase.ath
+
+		recorder := httptest.NewRecorder()
+		handleProtectedProxy(recorder, testClient.request(t, proofPayload), gatewayConfig, testApiRoute, newReplayStore(defaultReplayCacheCapacity), nil, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(http.StatusNoContent)
+		}))
+		if recorder.Code != testCase.wantStatus || !strings.Contains(recorder.Body.String(), testCase.wantError) {
+			t.Fatalf("%s: expected %d %q, got %d %s", testCase.name, testCase.wantStatus, testCase.wantError, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestLoadDpopRequireAth_ParsesBoolean(t *testing.T) {
+	t.Setenv(envKeyDpopRequireAth, "")
+	if requireAth, loadErr := loadDpopRequireAth(); loadErr != nil || requireAth {
+		t.Fatalf("expected ath to be optional by default, got %v %v", requireAth, loadErr)
+	}
+	t.Setenv(envKeyDpopRequireAth, "true")
+	if requireAth, loadErr := loadDpopRequireAth(); loadErr != nil || !requireAth {
+		t.Fatalf("expected ath to be required, got %v %v", requireAth, loadErr)
+	}
+	t.Setenv(envKeyDpopRequireAth, "always")
+	if _, loadErr := loadDpopRequireAth(); loadErr == nil {
+		t.Fatalf("expected a non-boolean value to be rejected")
+	}
+}
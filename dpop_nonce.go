@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envKeyDpopNonceSecret          = "DPOP_NONCE_SECRET"
+	envKeyDpopNonceLifetimeSeconds = "DPOP_NONCE_LIFETIME_SECONDS"
+	envKeyDpopReplayWindowSeconds  = "DPOP_REPLAY_WINDOW_SECONDS"
+
+	headerDpopNonce       = "DPoP-Nonce"
+	headerWWWAuthenticate = "WWW-Authenticate"
+
+	defaultDpopNonceLifetime = time.Minute
+	dpopNonceTagLength       = 16
+)
+
+// A nonce is a time slice index plus a truncated HMAC of it, so every replica with the secret
+// accepts it until the end of the following slice.
+type dpopNonceIssuer struct {
+	secret   []byte
+	lifetime time.Duration
+}
+
+func newDpopNonceIssuer(secret []byte, lifetime time.Duration) *dpopNonceIssuer {
+	return &dpopNonceIssuer{secret: secret, lifetime: lifetime}
+}
+
+func (issuer *dpopNonceIssuer) current() string {
+	return issuer.nonceFor(timeNow().UnixNano() / int64(issuer.lifetime))
+}
+
+func (issuer *dpopNonceIssuer) valid(nonce string) bool {
+	nonceBytes, decodeError := base64.RawURLEncoding.DecodeString(nonce)
+	if decodeError != nil || len(nonceBytes) != 8+dpopNonceTagLength {
+		return false
+	}
+	sliceIndex := int64(binary.BigEndian.Uint64(nonceBytes[:8]))
+	currentSlice := timeNow().UnixNano() / int64(issuer.lifetime)
+	if sliceIndex != currentSlice && sliceIndex != currentSlice-1 {
+		return false
+	}
+	return hmac.Equal(nonceBytes[8:], issuer.tag(sliceIndex))
+}
+
+func (issuer *dpopNonceIssuer) nonceFor(sliceIndex int64) string {
+	nonceBytes := binary.BigEndian.AppendUint64(make([]byte, 0, 8+dpopNonceTagLength), uint64(sliceIndex))
+	return base64.RawURLEncoding.EncodeToString(append(nonceBytes, issuer.tag(sliceIndex)...))
+}
+
+func (issuer *dpopNonceIssuer) tag(sliceIndex int64) []byte {
+	mac := hmac.New(sha256.New, issuer.secret)
+	_, _ = mac.Write([]byte("ets-dpop-nonce:"))
+	_ = binary.Write(mac, binary.BigEndian, sliceIndex)
+	return mac.Sum(nil)[:dpopNonceTagLength]
+}
+
+func requireDpopNonce(httpResponseWriter http.ResponseWriter, nonceIssuer *dpopNonceIssuer) {
+	httpResponseWriter.Header().Set(headerDpopNonce, nonceIssuer.current())
+	httpResponseWriter.Header().Set(headerWWWAuthenticate, `DPoP error="use_dpop_nonce", error_description="Authorization server requires nonce in DPoP proof"`)
+	httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "use_dpop_nonce")
+}
+
+// Proof IDs stay in the replay cache for as long as an iat is accepted.
+func (gatewayConfig serverConfig) proofReplayWindow() time.Duration {
+	if gatewayConfig.DpopReplayWindow > 0 {
+		return gatewayConfig.DpopReplayWindow
+	}
+	return defaultDpopReplayWindow
+}
+
+func loadDpopNonceSettings() (*dpopNonceIssuer, time.Duration, error) {
+	replayWindow := defaultDpopReplayWindow
+	if rawWindow := strings.TrimSpace(os.Getenv(envKeyDpopReplayWindowSeconds)); rawWindow != "" {
+		windowSeconds, parseError := strconv.Atoi(rawWindow)
+		if parseError != nil || windowSeconds <= 0 {
+			return nil, 0, fmt.Errorf("bad %s: %q", envKeyDpopReplayWindowSeconds, rawWindow)
+		}
+		replayWindow = time.Duration(windowSeconds) * time.Second
+	}
+
+	nonceSecret := strings.TrimSpace(os.Getenv(envKeyDpopNonceSecret))
+	if nonceSecret == "" {
+		return nil, replayWindow, nil
+	}
+	if len(nonceSecret) < minimumHmacSecretLength {
+		return nil, 0, fmt.Errorf("weak %s: use at least %d bytes", envKeyDpopNonceSecret, minimumHmacSecretLength)
+	}
+	nonceLifetime := defaultDpopNonceLifetime
+	if rawLifetime := strings.TrimSpace(os.Getenv(envKeyDpopNonceLifetimeSeconds)); rawLifetime != "" {
+		lifetimeSeconds, parseError := strconv.Atoi(rawLifetime)
+		if parseError != nil || lifetimeSeconds <= 0 {
+			return nil, 0, fmt.Errorf("bad %s: %q", envKeyDpopNonceLifetimeSeconds, rawLifetime)
+		}
+		nonceLifetime = time.Duration(lifetimeSeconds) * time.Second
+	}
+	return newDpopNonceIssuer([]byte(nonceSecret), nonceLifetime), replayWindow, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDpopNonceIssuer_AcceptsCurrentAndPreviousSlice(t *testing.T) {
+	currentTime := stubRateClock(t)
+	nonceIssuer := newDpopNonceIssuer([]byte("0123456789abcdef0123456789abcdef"), time.Minute)
+	mintedNonce := nonceIssuer.current()
+
+	if !nonceIssuer.valid(mintedNonce) {
+		t.Fatalf("expected a fresh nonce to be valid")
+	}
+	otherIssuer := newDpopNonceIssuer([]byte("fedcba9876543210fedcba9876543210"), time.Minute)
+	if otherIssuer.valid(mintedNonce) {
+		t.Fatalf("expected a nonce minted with another secret to be rejected")
+	}
+	tamperedBytes, _ := base64.RawURLEncoding.DecodeString(mintedNonce)
+	tamperedBytes[len(tamperedBytes)-1] ^= 1
+	for _, badNonce := range []string{"", "not base64!", base64.RawURLEncoding.EncodeToString(tamperedBytes)} {
+		if nonceIssuer.valid(badNonce) {
+			t.Fatalf("expected %q to be rejected", badNonce)
+		}
+	}
+
+	*currentTime = currentTime.Add(time.Minute)
+	if !nonceIssuer.valid(mintedNonce) {
+		t.Fatalf("expected the previous slice's nonce to stay valid")
+	}
+	*currentTime = currentTime.Add(time.Minute)
+	if nonceIssuer.valid(mintedNonce) {
+		t.Fatalf("expected a nonce two slices old to be rejected")
+	}
+}
+
+func TestHandleProtectedProxy_RequiresServerNonce(t *testing.T) {
+	tokenSigningKey := []byte("0123456789abcdef0123456789abcdef")
+	nonceIssuer := newDpopNonceIssuer([]byte("nonce-secret-0123456789abcdef012"), time.Minute)
+	gatewayConfig := serverConfig{
+		AllowedOrigins:  map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:   5 * time.Minute,
+		JwtHmacKey:      tokenSigningKey,
+		UpstreamTimeout: 10 * time.Second,
+		DpopNonces:      nonceIssuer,
+	}
+	replayCache := newReplayStore(defaultReplayCacheCapacity)
+	testClient := newDpopTestClient(t, tokenSigningKey)
+	upstreamProxy := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusNoContent)
+	})
+
+	challengeRecorder := httptest.NewRecorder()
+	handleProtectedProxy(challengeRecorder, testClient.request(t, testClient.payload("proof-without-nonce")), gatewayConfig, testApiRoute, replayCache, nil, upstreamProxy)
+	if challengeRecorder.Code != http.StatusUnauthorized || !strings.Contains(challengeRecorder.Body.String(), "use_dpop_nonce") {
+		t.Fatalf("expected use_dpop_nonce, got %d %s", challengeRecorder.Code, challengeRecorder.Body.String())
+	}
+	if !strings.Contains(challengeRecorder.Header().Get(headerWWWAuthenticate), `error="use_dpop_nonce"`) {
+		t.Fatalf("expected a DPoP WWW-Authenticate challenge, got %q", challengeRecorder.Header().Get(headerWWWAuthenticate))
+	}
+	issuedNonce := challengeRecorder.Header().Get(headerDpopNonce)
+	if issuedNonce == "" || replayCache.liveCount() != 0 {
+		t.Fatalf("expected a nonce and an untouched replay cache, got %q and %d entries", issuedNonce, replayCache.liveCount())
+	}
+
+	retryPayload := testClient.payload("proof-with-nonce")
+	retryPayload.Nonce = issuedNonce
+	retryRecorder := httptest.NewRecorder()
+	handleProtectedProxy(retryRecorder, testClient.request(t, retryPayload), gatewayConfig, testApiRoute, replayCache, nil, upstreamProxy)
+	if retryRecorder.Code != http.StatusNoContent || retryRecorder.Header().Get(headerDpopNonce) == "" {
+		t.Fatalf("expected the retry to pass and carry the next nonce, got %d", retryRecorder.Code)
+	}
+}
+
+func TestHandleProtectedProxy_HonorsConfiguredReplayWindow(t *testing.T) {
+	tokenSigningKey := []byte("0123456789abcdef0123456789abcdef")
+	gatewayConfig := serverConfig{
+		AllowedOrigins:   map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:    5 * time.Minute,
+		JwtHmacKey:       tokenSigningKey,
+		UpstreamTimeout:  10 * time.Second,
+		DpopReplayWindow: 30 * time.Second,
+	}
+	testClient := newDpopTestClient(t, tokenSigningKey)
+	stalePayload := testClient.payload("stale-proof")
+	stalePayload.IssuedAt = time.Now().Add(-time.Minute).Unix()
+
+	recorder := httptest.NewRecorder()
+	handleProtectedProxy(recorder, testClient.request(t, stalePayload), gatewayConfig, testApiRoute, newReplayStore(defaultReplayCacheCapacity), nil, http.NotFoundHandler())
+	if recorder.Code != http.StatusUnauthorized || !strings.Contains(recorder.Body.String(), "dpop_iat_too_old") {
+		t.Fatalf("expected a minute-old proof to fall outside a 30s window, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestLoadDpopNonceSettings_ParsesEnvironment(t *testing.T) {
+	t.Setenv(envKeyDpopNonceSecret, "")
+	t.Setenv(envKeyDpopNonceLifetimeSeconds, "")
+	t.Setenv(envKeyDpopReplayWindowSeconds, "")
+	nonceIssuer, replayWindow, loadErr := loadDpopNonceSettings()
+	if loadErr != nil || nonceIssuer != nil || replayWindow != defaultDpopReplayWindow {
+		t.Fatalf("expected nonces off and the default window, got %v %v %v", nonceIssuer, replayWindow, loadErr)
+	}
+
+	t.Setenv(envKeyDpopNonceSecret, "0123456789abcdef0123456789abcdef")
+	t.Setenv(envKeyDpopNonceLifetimeSeconds, "30")
+	t.Setenv(envKeyDpopReplayWindowSeconds, "60")
+	nonceIssuer, replayWindow, loadErr = loadDpopNonceSettings()
+	if loadErr != nil || nonceIssuer == nil || nonceIssuer.lifetime != 30*time.Second || replayWindow != time.Minute {
+		t.Fatalf("expected configured nonces, got %+v %v %v", nonceIssuer, replayWindow, loadErr)
+	}
+
+	for _, badSetting := range []struct{ envKey, value string }{
+		{envKeyDpopNonceSecret, "short"},
+		{envKeyDpopNonceLifetimeSeconds, "0"},
+		{envKeyDpopReplayWindowSeconds, "soon"},
+	} {
+		t.Run(badSetting.envKey, func(t *testing.T) {
+			t.Setenv(badSetting.envKey, badSetting.value)
+			if _, _, loadErr := loadDpopNonceSettings(); loadErr == nil {
+				t.Fatalf("expected %s=%q to be rejected", badSetting.envKey, badSetting.value)
+			}
+		})
+	}
+}
+
+// dpopTestClient holds a DPoP key and an access token bound to it.
+type dpopTestClient struct {
+	privateKey  *ecdsa.PrivateKey
+	jwk         publicJwk
+	accessToken string
+}
+
+func newDpopTestClient(t *testing.T, signingKey []byte) dpopTestClient {
+	t.Helper()
+	privateKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	clientJwk := publicJwk{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(privateKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(privateKey.Y.FillBytes(make([]byte, 32))),
+	}
+	thumbprint, thumbErr := jwkThumbprint(clientJwk)
+	if thumbErr != nil {
+		t.Fatalf("jwkThumbprint: %v", thumbErr)
+	}
+	return dpopTestClient{
+		privateKey:  privateKey,
+		jwk:         clientJwk,
+		accessToken: issueTestAccessTokenWithThumbprint(t, signingKey, "token-"+thumbprint[:8], thumbprint),
+	}
+}
+
+// payload returns a valid proof body for a POST to the test /api route.
+func (client dpopTestClient) payload(jwtID string) dpopPayload {
+	return dpopPayload{HttpMethod: http.MethodPost, HttpUri: "http://ets.example/api", JwtID: jwtID, IssuedAt: time.Now().Unix()}
+}
+
+func (client dpopTestClient) request(t *testing.T, payload dpopPayload) *http.Request {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, "http://ets.example/api", strings.NewReader(`{}`))
+	request.Header.Set("Origin", "https://app.example.com")
+	request.Header.Set(headerAuthorization, "Bearer "+client.accessToken)
+	request.Header.Set(headerDpop, mustSignDpopPayload(t, client.privateKey, client.jwk, payload))
+	return request
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleTokenIssue_RequiresProofOfPossession(t *testing.T) {
+	issueURL := "http://ets.example/tvm/issue"
+	keyHolder := newDpopTestClient(t, []byte("0123456789abcdef0123456789abcdef"))
+	otherHolder := newDpopTestClient(t, []byte("0123456789abcdef0123456789abcdef"))
+	validProof := func(jwtID string) string {
+		return mustCreateDpopProof(t, keyHolder.privateKey, keyHolder.jwk, http.MethodPost, issueURL, jwtID, time.Now())
+	}
+
+	testCases := []struct {
+		name          string
+		allowUnproven bool
+		proof         string
+		wantStatus    int
+		wantErrorCode string
+	}{
+		{"valid proof", false, validProof("issue-a"), http.StatusOK, ""},
+		{"missing proof", false, "", http.StatusUnauthorized, "missing_dpop"},
+		{"proof from another key", false, mustCreateDpopProof(t, otherHolder.privateKey, otherHolder.jwk, http.MethodPost, issueURL, "issue-b", time.Now()), http.StatusUnauthorized, "dpop_jwk_mismatch"},
+		{"proof for another URL", false, mustCreateDpopProof(t, keyHolder.privateKey, keyHolder.jwk, http.MethodPost, "http://ets.example/api", "issue-c", time.Now()), http.StatusUnauthorized, "htu_mismatch"},
+		{"proof for another method", false, mustCreateDpopProof(t, keyHolder.privateKey, keyHolder.jwk, http.MethodGet, issueURL, "issue-d", time.Now()), http.StatusUnauthorized, "htm_mismatch"},
+		{"compatibility mode without proof", true, "", http.StatusOK, ""},
+		{"compatibility mode still checks a sent proof", true, mustCreateDpopProof(t, otherHolder.privateKey, otherHolder.jwk, http.MethodPost, issueURL, "issue-e", time.Now()), http.StatusUnauthorized, "dpop_jwk_mismatch"},
+	}
+	for _, testCase := range testCases {
+		gatewayConfig := newIssueTestConfig()
+		gatewayConfig.IssueAllowUnprovenJwk = testCase.allowUnproven
+		bodyBytes, marshalErr := json.Marshal(tokenIssueRequest{DpopPublicJwk: keyHolder.jwk})
+		if marshalErr != nil {
+			t.Fatalf("json.Marshal: %v", marshalErr)
+		}
+		request := httptest.NewRequest(http.MethodPost, issueURL, bytes.NewReader(bodyBytes))
+		request.Header.Set("Origin", "https://app.example.com")
+		if testCase.proof != "" {
+			request.Header.Set(headerDpop, testCase.proof)
+		}
+
+		recorder := httptest.NewRecorder()
+		handleTokenIssue(recorder, request, gatewayConfig, issuanceGuard{})
+		if recorder.Code != testCase.wantStatus || !strings.Contains(recorder.Body.String(), testCase.wantErrorCode) {
+			t.Fatalf("%s: expected %d %q, got %d %s", testCase.name, testCase.wantStatus, testCase.wantErrorCode, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestVerifyDpopProof_RejectsStaleAndIncompleteProofs(t *testing.T) {
+	testClient := newDpopTestClient(t, []byte("0123456789abcdef0123456789abcdef"))
+	stalePayload := testClient.payload("stale")
+	stalePayload.IssuedAt = time.Now().Add(-10 * time.Minute).Unix()
+	futurePayload := testClient.payload("future")
+	futurePayload.IssuedAt = time.Now().Add(time.Minute).Unix()
+	missingIDPayload := testClient.payload("")
+	longIDPayload := testClient.payload(strings.Repeat("j", maxDpopJtiBytes+1))
+
+	for wantCode, payload := range map[string]dpopPayload{
+		"dpop_iat_too_old":   stalePayload,
+		"dpop_iat_in_future": futurePayload,
+		"missing_dpop_jti":   missingIDPayload,
+		"dpop_jti_too_long":  longIDPayload,
+	} {
+		_, proofErr := verifyDpopProof(testClient.request(t, payload), serverConfig{})
+		if proofErr == nil || proofErr.Error() != wantCode {
+			t.Fatalf("expected %s, got %v", wantCode, proofErr)
+		}
+	}
+
+	verifiedProof, proofErr := verifyDpopProof(testClient.request(t, testClient.payload("fresh")), serverConfig{})
+	if proofErr != nil || verifiedProof.Jwk != testClient.jwk || verifiedProof.Payload.JwtID != "fresh" {
+		t.Fatalf("expected a fresh proof to verify, got %+v %v", verifiedProof, proofErr)
+	}
+}
+
+func TestLoadIssueAllowUnprovenJwk_ParsesBoolean(t *testing.T) {
+	t.Setenv(envKeyIssueAllowUnprovenJwk, "")
+	if allowUnproven, loadErr := loadIssueAllowUnprovenJwk(); loadErr != nil || allowUnproven {
+		t.Fatalf("expected proofs to be required by default, got %v %v", allowUnproven, loadErr)
+	}
+	t.Setenv(envKeyIssueAllowUnprovenJwk, "1")
+	if allowUnproven, loadErr := loadIssueAllowUnprovenJwk(); loadErr != nil || !allowUnproven {
+		t.Fatalf("expected the compatibility mode, got %v %v", allowUnproven, loadErr)
+	}
+	t.Setenv(envKeyIssueAllowUnprovenJwk, "legacy")
+	if _, loadErr := loadIssueAllowUnprovenJwk(); loadErr == nil {
+		t.Fatalf("expected a non-boolean value to be rejected")
+	}
+}
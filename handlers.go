@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"time"
@@ -13,8 +15,9 @@ import (
 )
 
 const (
-	dpopReplayWindow     = 5 * time.Minute
-	dpopAllowedClockSkew = 5 * time.Second
+	defaultDpopReplayWindow = 5 * time.Minute
+	dpopAllowedClockSkew    = 5 * time.Second
+	maxDpopJtiBytes         = 256
 )
 
 type tokenIssueRequest struct {
@@ -26,18 +29,21 @@ type tokenIssueResponse struct {
 	ExpiresIn   int    `json:"expiresIn"`
 }
 
-func handleTokenIssue(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, gatewayConfig serverConfig) {
-	if !checkOrigin(httpResponseWriter, httpRequest, gatewayConfig.AllowedOrigins) {
-		return
-	}
-	if httpRequest.Method == http.MethodOptions {
-		httpResponseWriter.WriteHeader(http.StatusNoContent)
+func handleTokenIssue(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, gatewayConfig serverConfig, issueGuard issuanceGuard) {
+	if !handleCors(httpResponseWriter, httpRequest, gatewayConfig, issueAllowMethodsValue) {
 		return
 	}
 	if httpRequest.Method != http.MethodPost {
 		httpErrorJSON(httpResponseWriter, http.StatusMethodNotAllowed, "method_not_allowed")
 		return
 	}
+	requesterIP := resolveClientIP(httpRequest, gatewayConfig.TrustedProxies)
+	issueDecision := issueGuard.rateLimits.decide(rateLimitSubject{Origin: httpRequest.Header.Get("Origin"), ClientIP: requesterIP}, false)
+	writeRateLimitHeaders(httpResponseWriter, issueDecision)
+	if !issueDecision.Allowed {
+		httpErrorJSON(httpResponseWriter, http.StatusTooManyRequests, "rate_limited")
+		return
+	}
 
 	requestBodyBytes, readBodyError := io.ReadAll(httpRequest.Body)
 	if readBodyError != nil {
@@ -52,7 +58,7 @@ func handleTokenIssue(httpResponseWriter http.ResponseWriter, httpRequest *http.
 		return
 	}
 
-	if tokenRequest.DpopPublicJwk.KeyType != "EC" || tokenRequest.DpopPublicJwk.Curve != "P-256" {
+	if _, keyError := publicKeyFromJwk(tokenRequest.DpopPublicJwk); keyError != nil || !gatewayConfig.dpopKeyAllowed(tokenRequest.DpopPublicJwk) {
 		httpErrorJSON(httpResponseWriter, http.StatusBadRequest, "unsupported_jwk")
 		return
 	}
@@ -61,11 +67,23 @@ func handleTokenIssue(httpResponseWriter http.ResponseWriter, httpRequest *http.
 		httpErrorJSON(httpResponseWriter, http.StatusBadRequest, "bad_jwk_thumbprint")
 		return
 	}
+	// A proof shows the caller holds the private key. Proofs are not replay-tracked here: a
+	// replayed one only mints another token for a key the replayer cannot sign with.
+	if httpRequest.Header.Get(headerDpop) != "" || !gatewayConfig.IssueAllowUnprovenJwk {
+		issueProof, proofError := verifyDpopProof(httpRequest, gatewayConfig)
+		if proofError != nil {
+			httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, proofError.Error())
+			return
+		}
+		if issueProof.Thumbprint != jwkThumbprintValue {
+			httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "dpop_jwk_mismatch")
+			return
+		}
+	}
 
-	currentTime := time.Now()
+	currentTime := timeNow()
 	tokenExpiration := currentTime.Add(gatewayConfig.TokenLifetime)
 	tokenID := fmt.Sprintf("%d-%d", currentTime.UnixNano(), os.Getpid())
-
 	accessTokenClaims := accessClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			Audience:  jwt.ClaimStrings{audienceApi},
@@ -77,32 +95,51 @@ func handleTokenIssue(httpResponseWriter http.ResponseWriter, httpRequest *http.
 		Confirmation: confirmation{JwkThumbprint: jwkThumbprintValue},
 	}
 
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessTokenClaims)
-	signedToken, signError := jwtToken.SignedString(gatewayConfig.JwtHmacKey)
+	signedToken, signError := gatewayConfig.accessTokenKeyring().signClaims(accessTokenClaims)
 	if signError != nil {
 		httpErrorJSON(httpResponseWriter, http.StatusInternalServerError, "sign_error")
 		return
 	}
+	// Reserve only once a token exists, so a signing failure never holds a slot.
+	if issueGuard.activeTokens != nil && !issueGuard.activeTokens.reserve(requesterIP, tokenExpiration) {
+		httpErrorJSON(httpResponseWriter, http.StatusTooManyRequests, "too_many_active_tokens")
+		return
+	}
 
 	tokenResponse := tokenIssueResponse{AccessToken: signedToken, ExpiresIn: int(gatewayConfig.TokenLifetime.Seconds())}
+	if gatewayConfig.DpopNonces != nil {
+		httpResponseWriter.Header().Set(headerDpopNonce, gatewayConfig.DpopNonces.current())
+	}
 	httpResponseWriter.Header().Set(headerContentType, contentTypeJSON)
 	_ = json.NewEncoder(httpResponseWriter).Encode(tokenResponse)
 }
 
-func handleProtectedProxy(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, gatewayConfig serverConfig, replayCache *replayStore, rateLimiter *windowLimiter, upstreamProxy http.Handler) {
-	if !checkOrigin(httpResponseWriter, httpRequest, gatewayConfig.AllowedOrigins) {
-		return
-	}
-	if httpRequest.Method == http.MethodOptions {
-		httpResponseWriter.WriteHeader(http.StatusNoContent)
+func handleProtectedProxy(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, gatewayConfig serverConfig, route upstreamRoute, replayCache proofReplayCache, rateLimits rateLimitPolicy, upstreamProxy http.Handler) {
+	if !handleCors(httpResponseWriter, httpRequest, gatewayConfig, route.allowMethodsValue()) {
 		return
 	}
-	if httpRequest.Method != http.MethodPost && httpRequest.Method != http.MethodGet {
+	if !route.allowsMethod(httpRequest.Method) {
+		httpResponseWriter.Header().Set(headerAllow, route.allowMethodsValue())
 		httpErrorJSON(httpResponseWriter, http.StatusMethodNotAllowed, "method_not_allowed")
 		return
 	}
+	isUpgrade := isWebSocketUpgrade(httpRequest)
+	if isUpgrade {
+		if !route.WebSocket {
+			httpErrorJSON(httpResponseWriter, http.StatusBadRequest, "websocket_not_allowed")
+			return
+		}
+		httpRequest = promoteWebSocketCredentials(httpRequest)
+	}
 
-	if !rateLimiter.allow(rateKey(httpRequest.RemoteAddr, httpRequest.Header.Get("Origin"))) {
+	rateSubject := rateLimitSubject{
+		Origin:   httpRequest.Header.Get("Origin"),
+		ClientIP: resolveClientIP(httpRequest, gatewayConfig.TrustedProxies),
+		Route:    route.PathPrefix,
+	}
+	admissionDecision := rateLimits.decide(rateSubject, false)
+	writeRateLimitHeaders(httpResponseWriter, admissionDecision)
+	if !admissionDecision.Allowed {
 		httpErrorJSON(httpResponseWriter, http.StatusTooManyRequests, "rate_limited")
 		return
 	}
@@ -114,12 +151,7 @@ func handleProtectedProxy(httpResponseWriter http.ResponseWriter, httpRequest *h
 	}
 
 	var parsedClaims accessClaims
-	parsedJWT, parseTokenError := jwt.ParseWithClaims(bearerAccessToken, &parsedClaims, func(token *jwt.Token) (interface{}, error) {
-		if token.Method == nil || token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-			return nil, fmt.Errorf("unexpected_jwt_alg")
-		}
-		return gatewayConfig.JwtHmacKey, nil
-	})
+	parsedJWT, parseTokenError := jwt.ParseWithClaims(bearerAccessToken, &parsedClaims, gatewayConfig.accessTokenKeyring().verificationKeyFor)
 	if parseTokenError != nil || !parsedJWT.Valid {
 		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "invalid_token")
 		return
@@ -140,83 +172,96 @@ func handleProtectedProxy(httpResponseWriter http.ResponseWriter, httpRequest *h
 
 	tokenExpirationTime := parsedClaims.ExpiresAt.Time
 
-	rawDpopHeader := stringsTrimSpace(httpRequest.Header.Get(headerDpop))
-	if rawDpopHeader == "" {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "missing_dpop")
+	replayWindow := gatewayConfig.proofReplayWindow()
+	dpopProof, dpopError := verifyDpopProof(httpRequest, gatewayConfig)
+	if dpopError != nil {
+		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, dpopError.Error())
 		return
 	}
-
-	dpopHeaderObject, dpopPayloadObject, dpopSigningInput, dpopSignatureBytes, parseDpopError := parseCompactJws(rawDpopHeader)
-	if parseDpopError != nil {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "bad_dpop")
+	if dpopProof.Thumbprint != parsedClaims.Confirmation.JwkThumbprint {
+		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "cnf_mismatch")
 		return
 	}
-	if !stringsEqualFold(dpopHeaderObject.Type, "dpop+jwt") || !stringsEqualFold(dpopHeaderObject.Alg, "ES256") {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "bad_dpop_header")
+
+	if dpopProof.Payload.AccessTokenHash == "" {
+		if gatewayConfig.DpopRequireAth {
+			httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "missing_dpop_ath")
+			return
+		}
+	} else if !athMatches(dpopProof.Payload.AccessTokenHash, bearerAccessToken) {
+		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "ath_mismatch")
 		return
 	}
 
-	publicKeyFromJwk, ecdsaBuildError := ecdsaKeyFromJwk(dpopHeaderObject.Jwk)
-	if ecdsaBuildError != nil {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "bad_dpop_key")
-		return
+	if gatewayConfig.DpopNonces != nil {
+		if !gatewayConfig.DpopNonces.valid(dpopProof.Payload.Nonce) {
+			requireDpopNonce(httpResponseWriter, gatewayConfig.DpopNonces)
+			return
+		}
+		httpResponseWriter.Header().Set(headerDpopNonce, gatewayConfig.DpopNonces.current())
 	}
-	if !verifyEs256(dpopSigningInput, dpopSignatureBytes, publicKeyFromJwk) {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "bad_dpop_sig")
+
+	rateSubject.Jkt = dpopProof.Thumbprint
+	rateSubject.TokenID = parsedClaims.ID
+	verifiedDecision := rateLimits.decide(rateSubject, true)
+	writeRateLimitHeaders(httpResponseWriter, admissionDecision.tighter(verifiedDecision))
+	if !verifiedDecision.Allowed {
+		httpErrorJSON(httpResponseWriter, http.StatusTooManyRequests, "rate_limited")
 		return
 	}
 
-	jwkThumbprintComputed, thumbError := jwkThumbprint(dpopHeaderObject.Jwk)
-	if thumbError != nil || jwkThumbprintComputed != parsedClaims.Confirmation.JwkThumbprint {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "cnf_mismatch")
-		return
+	replayExpiresAt := dpopProof.IssuedAt.Add(replayWindow)
+	if replayExpiresAt.After(tokenExpirationTime) {
+		replayExpiresAt = tokenExpirationTime
 	}
 
-	if dpopPayloadObject.HttpMethod != httpRequest.Method {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "htm_mismatch")
+	firstUse, replayError := replayCache.markOnce(dpopProof.Payload.JwtID, replayExpiresAt)
+	if errors.Is(replayError, errReplayCacheFull) {
+		log.Printf("replay cache full; refusing proof from %s", rateSubject.ClientIP)
+		httpErrorJSON(httpResponseWriter, http.StatusServiceUnavailable, "replay_cache_full")
 		return
 	}
-	if dpopPayloadObject.HttpUri != expectedHtu(httpRequest) {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "htu_mismatch")
+	if replayError != nil {
+		log.Printf("replay store error for %s: %v", rateSubject.ClientIP, replayError)
+		httpErrorJSON(httpResponseWriter, http.StatusServiceUnavailable, "replay_store_unavailable")
 		return
 	}
-
-	if dpopPayloadObject.JwtID == "" {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "missing_dpop_jti")
+	if !firstUse {
+		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "replay")
 		return
 	}
 
-	if dpopPayloadObject.IssuedAt == 0 {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "missing_dpop_iat")
-		return
+	upstreamTimeout := route.UpstreamTimeout
+	if upstreamTimeout <= 0 {
+		upstreamTimeout = gatewayConfig.UpstreamTimeout
 	}
 
-	now := time.Now()
-	issuedAtTime := time.Unix(dpopPayloadObject.IssuedAt, 0)
-	if issuedAtTime.After(now.Add(dpopAllowedClockSkew)) {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "dpop_iat_in_future")
-		return
+	caller := verifiedCaller{
+		TokenID:       parsedClaims.ID,
+		JwkThumbprint: parsedClaims.Confirmation.JwkThumbprint,
+		Origin:        httpRequest.Header.Get("Origin"),
 	}
-	if issuedAtTime.Before(now.Add(-1 * dpopReplayWindow)) {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "dpop_iat_too_old")
-		return
+	if route.IdentityAssertion {
+		signedAssertion, assertionError := signIdentityAssertion(gatewayConfig.accessTokenKeyring(), caller, route, httpRequest)
+		if assertionError != nil {
+			httpErrorJSON(httpResponseWriter, http.StatusInternalServerError, "sign_error")
+			return
+		}
+		caller.Assertion = signedAssertion
 	}
 
-	replayExpiresAt := issuedAtTime.Add(dpopReplayWindow)
-	if replayExpiresAt.After(tokenExpirationTime) {
-		replayExpiresAt = tokenExpirationTime
+	httpRequest = httpRequest.WithContext(withGatewayRateLimitHeaders(withVerifiedCaller(httpRequest.Context(), caller), httpResponseWriter.Header()))
+	if isUpgrade {
+		serveWebSocketUpstream(httpResponseWriter, httpRequest, upstreamTimeout, upstreamProxy)
+		return
 	}
-
-	if !replayCache.mark(dpopPayloadObject.JwtID, replayExpiresAt) {
-		httpErrorJSON(httpResponseWriter, http.StatusUnauthorized, "replay")
+	if route.Streaming {
+		serveStreamingUpstream(httpResponseWriter, httpRequest, route, upstreamTimeout, upstreamProxy)
 		return
 	}
-
-	upstreamContext, cancelUpstream := context.WithTimeout(httpRequest.Context(), gatewayConfig.UpstreamTimeout)
+	upstreamContext, cancelUpstream := context.WithTimeout(httpRequest.Context(), upstreamTimeout)
 	defer cancelUpstream()
-
-	httpRequest = httpRequest.WithContext(upstreamContext)
-	upstreamProxy.ServeHTTP(httpResponseWriter, httpRequest)
+	upstreamProxy.ServeHTTP(httpResponseWriter, httpRequest.WithContext(upstreamContext))
 }
 
 func handleHealth(httpResponseWriter http.ResponseWriter, _ *http.Request) {
@@ -9,22 +9,15 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
 	"testing"
 	"time"
 )
 
 func TestHandleTokenIssue_PostsJwtWithValidDpop(t *testing.T) {
-	upstreamURL, parseErr := url.Parse("http://upstream.example")
-	if parseErr != nil {
-		t.Fatalf("url.Parse: %v", parseErr)
-	}
-
 	gatewayConfig := serverConfig{
 		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
 		TokenLifetime:      5 * time.Minute,
 		JwtHmacKey:         []byte("0123456789abcdef0123456789abcdef"),
-		UpstreamBaseURL:    upstreamURL,
 		RateLimitPerMinute: 100,
 		UpstreamTimeout:    10 * time.Second,
 	}
@@ -37,8 +30,8 @@ func TestHandleTokenIssue_PostsJwtWithValidDpop(t *testing.T) {
 	publicJwk := publicJwk{
 		KeyType: "EC",
 		Curve:   "P-256",
-		X:       base64.RawURLEncoding.EncodeToString(publicKey.X.Bytes()),
-		Y:       base64.RawURLEncoding.EncodeToString(publicKey.Y.Bytes()),
+		X:       base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, 32))),
 	}
 
 	bodyBytes, marshalErr := json.Marshal(tokenIssueRequest{DpopPublicJwk: publicJwk})
@@ -48,9 +41,10 @@ func TestHandleTokenIssue_PostsJwtWithValidDpop(t *testing.T) {
 
 	request := httptest.NewRequest(http.MethodPost, "http://ets.example/tvm/issue", bytes.NewReader(bodyBytes))
 	request.Header.Set("Origin", "https://app.example.com")
+	request.Header.Set(headerDpop, mustCreateDpopProof(t, dpopKey, publicJwk, http.MethodPost, "http://ets.example/tvm/issue", "issue-proof", time.Now()))
 
 	recorder := httptest.NewRecorder()
-	handleTokenIssue(recorder, request, gatewayConfig)
+	handleTokenIssue(recorder, request, gatewayConfig, issuanceGuard{})
 
 	if recorder.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", recorder.Code)
@@ -66,16 +60,10 @@ func TestHandleTokenIssue_PostsJwtWithValidDpop(t *testing.T) {
 }
 
 func TestHandleTokenIssue_RejectsNonPost(t *testing.T) {
-	upstreamURL, parseErr := url.Parse("http://upstream.example")
-	if parseErr != nil {
-		t.Fatalf("url.Parse: %v", parseErr)
-	}
-
 	gatewayConfig := serverConfig{
 		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
 		TokenLifetime:      5 * time.Minute,
 		JwtHmacKey:         []byte("abcdef0123456789abcdef0123456789"),
-		UpstreamBaseURL:    upstreamURL,
 		RateLimitPerMinute: 100,
 		UpstreamTimeout:    10 * time.Second,
 	}
@@ -84,7 +72,7 @@ func TestHandleTokenIssue_RejectsNonPost(t *testing.T) {
 	request.Header.Set("Origin", "https://app.example.com")
 	recorder := httptest.NewRecorder()
 
-	handleTokenIssue(recorder, request, gatewayConfig)
+	handleTokenIssue(recorder, request, gatewayConfig, issuanceGuard{})
 	if recorder.Code != http.StatusMethodNotAllowed {
 		t.Fatalf("expected 405, got %d", recorder.Code)
 	}
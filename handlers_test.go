@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -19,11 +18,6 @@ import (
 )
 
 func TestHandleProtectedProxy_InvalidDpopDoesNotMarkReplayCache(t *testing.T) {
-	upstreamURL, parseErr := url.Parse("http://upstream.example")
-	if parseErr != nil {
-		t.Fatalf("url.Parse: %v", parseErr)
-	}
-
 	tokenSigningKey := []byte("0123456789abcdef0123456789abcdef")
 	tokenID := "test-token-id"
 
@@ -31,12 +25,11 @@ func TestHandleProtectedProxy_InvalidDpopDoesNotMarkReplayCache(t *testing.T) {
 		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
 		TokenLifetime:      5 * time.Minute,
 		JwtHmacKey:         tokenSigningKey,
-		UpstreamBaseURL:    upstreamURL,
 		RateLimitPerMinute: 100,
 		UpstreamTimeout:    10 * time.Second,
 	}
 
-	replayCache := &replayStore{seen: make(map[string]int64)}
+	replayCache := newReplayStore(defaultReplayCacheCapacity)
 	rateLimiter := &windowLimiter{
 		windowEnd:    time.Now().Unix() + 60,
 		counts:       make(map[string]int),
@@ -51,24 +44,19 @@ func TestHandleProtectedProxy_InvalidDpopDoesNotMarkReplayCache(t *testing.T) {
 
 	recorder := httptest.NewRecorder()
 
-	handleProtectedProxy(recorder, request, gatewayConfig, replayCache, rateLimiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handleProtectedProxy(recorder, request, gatewayConfig, testApiRoute, replayCache, defaultRateLimitPolicy(rateLimiter), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t.Fatalf("expected upstream proxy to be skipped for invalid DPoP")
 	}))
 
 	if recorder.Code != http.StatusUnauthorized {
 		t.Fatalf("expected unauthorized for missing DPoP, got %d", recorder.Code)
 	}
-	if _, exists := replayCache.seen[tokenID]; exists {
+	if replayCache.liveCount() != 0 {
 		t.Fatalf("replay cache should not be marked when DPoP validation fails")
 	}
 }
 
 func TestHandleProtectedProxy_AllowsMultipleRequestsWithSameTokenAndDistinctDpop(t *testing.T) {
-	upstreamURL, parseErr := url.Parse("http://upstream.example")
-	if parseErr != nil {
-		t.Fatalf("url.Parse: %v", parseErr)
-	}
-
 	tokenSigningKey := []byte("abcdef0123456789abcdef0123456789")
 	tokenID := "token-multi-use"
 
@@ -76,12 +64,11 @@ func TestHandleProtectedProxy_AllowsMultipleRequestsWithSameTokenAndDistinctDpop
 		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
 		TokenLifetime:      5 * time.Minute,
 		JwtHmacKey:         tokenSigningKey,
-		UpstreamBaseURL:    upstreamURL,
 		RateLimitPerMinute: 100,
 		UpstreamTimeout:    10 * time.Second,
 	}
 
-	replayCache := &replayStore{seen: make(map[string]int64)}
+	replayCache := newReplayStore(defaultReplayCacheCapacity)
 	rateLimiter := &windowLimiter{
 		windowEnd:    time.Now().Unix() + 60,
 		counts:       make(map[string]int),
@@ -96,8 +83,8 @@ func TestHandleProtectedProxy_AllowsMultipleRequestsWithSameTokenAndDistinctDpop
 	publicJwk := publicJwk{
 		KeyType: "EC",
 		Curve:   "P-256",
-		X:       base64.RawURLEncoding.EncodeToString(publicKey.X.Bytes()),
-		Y:       base64.RawURLEncoding.EncodeToString(publicKey.Y.Bytes()),
+		X:       base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, 32))),
 	}
 	thumbprint, thumbErr := jwkThumbprint(publicJwk)
 	if thumbErr != nil {
@@ -126,7 +113,7 @@ func TestHandleProtectedProxy_AllowsMultipleRequestsWithSameTokenAndDistinctDpop
 		}
 		request.Header.Set(headerDpop, dpopProof)
 
-		handleProtectedProxy(recorder, request, gatewayConfig, replayCache, rateLimiter, upstreamProxy)
+		handleProtectedProxy(recorder, request, gatewayConfig, testApiRoute, replayCache, defaultRateLimitPolicy(rateLimiter), upstreamProxy)
 		if recorder.Code != http.StatusNoContent {
 			t.Fatalf("iteration %d expected 204, got %d", requestIndex, recorder.Code)
 		}
@@ -142,7 +129,7 @@ func TestHandleProtectedProxy_AllowsMultipleRequestsWithSameTokenAndDistinctDpop
 	replayRequest.Header.Set("Authorization", "Bearer "+accessToken)
 	replayRequest.Header.Set(headerDpop, firstProof)
 
-	handleProtectedProxy(replayRecorder, replayRequest, gatewayConfig, replayCache, rateLimiter, upstreamProxy)
+	handleProtectedProxy(replayRecorder, replayRequest, gatewayConfig, testApiRoute, replayCache, defaultRateLimitPolicy(rateLimiter), upstreamProxy)
 	if replayRecorder.Code != http.StatusUnauthorized {
 		t.Fatalf("expected reused DPoP proof to be rejected with 401, got %d", replayRecorder.Code)
 	}
@@ -152,11 +139,6 @@ func TestHandleProtectedProxy_AllowsMultipleRequestsWithSameTokenAndDistinctDpop
 }
 
 func TestHandleProtectedProxy_AllowsGetRequests(t *testing.T) {
-	upstreamURL, parseErr := url.Parse("http://upstream.example")
-	if parseErr != nil {
-		t.Fatalf("url.Parse: %v", parseErr)
-	}
-
 	tokenSigningKey := []byte("abcdef0123456789abcdef0123456789")
 	tokenID := "token-get-allowed"
 
@@ -164,12 +146,11 @@ func TestHandleProtectedProxy_AllowsGetRequests(t *testing.T) {
 		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
 		TokenLifetime:      5 * time.Minute,
 		JwtHmacKey:         tokenSigningKey,
-		UpstreamBaseURL:    upstreamURL,
 		RateLimitPerMinute: 100,
 		UpstreamTimeout:    10 * time.Second,
 	}
 
-	replayCache := &replayStore{seen: make(map[string]int64)}
+	replayCache := newReplayStore(defaultReplayCacheCapacity)
 	rateLimiter := &windowLimiter{
 		windowEnd:    time.Now().Unix() + 60,
 		counts:       make(map[string]int),
@@ -184,8 +165,8 @@ func TestHandleProtectedProxy_AllowsGetRequests(t *testing.T) {
 	publicJwk := publicJwk{
 		KeyType: "EC",
 		Curve:   "P-256",
-		X:       base64.RawURLEncoding.EncodeToString(publicKey.X.Bytes()),
-		Y:       base64.RawURLEncoding.EncodeToString(publicKey.Y.Bytes()),
+		X:       base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, 32))),
 	}
 	thumbprint, thumbErr := jwkThumbprint(publicJwk)
 	if thumbErr != nil {
@@ -211,7 +192,7 @@ func TestHandleProtectedProxy_AllowsGetRequests(t *testing.T) {
 	dpopProof := mustCreateDpopProof(t, dpopKey, publicJwk, http.MethodGet, requestURL, "proof-get", time.Now())
 	request.Header.Set(headerDpop, dpopProof)
 
-	handleProtectedProxy(recorder, request, gatewayConfig, replayCache, rateLimiter, upstreamProxy)
+	handleProtectedProxy(recorder, request, gatewayConfig, testApiRoute, replayCache, defaultRateLimitPolicy(rateLimiter), upstreamProxy)
 	if recorder.Code != http.StatusNoContent {
 		t.Fatalf("expected 204, got %d", recorder.Code)
 	}
@@ -220,6 +201,68 @@ func TestHandleProtectedProxy_AllowsGetRequests(t *testing.T) {
 	}
 }
 
+func TestHandleProtectedProxy_EnforcesRouteMethods(t *testing.T) {
+	tokenSigningKey := []byte("abcdef0123456789abcdef0123456789")
+	gatewayConfig := serverConfig{
+		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:      5 * time.Minute,
+		JwtHmacKey:         tokenSigningKey,
+		RateLimitPerMinute: 100,
+		UpstreamTimeout:    10 * time.Second,
+	}
+	restRoute := upstreamRoute{PathPrefix: "/api/items", UpstreamTimeout: 10 * time.Second, Methods: []string{http.MethodGet, http.MethodDelete}}
+	replayCache := newReplayStore(defaultReplayCacheCapacity)
+	rateLimiter := &windowLimiter{windowEnd: time.Now().Unix() + 60, counts: make(map[string]int), perMinuteCap: 100}
+	upstreamMethods := make(chan string, 1)
+	upstreamProxy := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		upstreamMethods <- request.Method
+		writer.WriteHeader(http.StatusNoContent)
+	})
+
+	preflightRecorder := httptest.NewRecorder()
+	preflightRequest := httptest.NewRequest(http.MethodOptions, "http://ets.example/api/items/1", nil)
+	preflightRequest.Header.Set("Origin", "https://app.example.com")
+	handleProtectedProxy(preflightRecorder, preflightRequest, gatewayConfig, restRoute, replayCache, defaultRateLimitPolicy(rateLimiter), upstreamProxy)
+	if got := preflightRecorder.Header().Get(headerAccessControlAllowMethods); got != "GET, DELETE, OPTIONS" {
+		t.Fatalf("expected preflight to advertise the route methods, got %q", got)
+	}
+
+	rejectedRecorder := httptest.NewRecorder()
+	rejectedRequest := httptest.NewRequest(http.MethodPost, "http://ets.example/api/items/1", nil)
+	rejectedRequest.Header.Set("Origin", "https://app.example.com")
+	handleProtectedProxy(rejectedRecorder, rejectedRequest, gatewayConfig, restRoute, replayCache, defaultRateLimitPolicy(rateLimiter), upstreamProxy)
+	if rejectedRecorder.Code != http.StatusMethodNotAllowed || rejectedRecorder.Header().Get(headerAllow) != "GET, DELETE, OPTIONS" {
+		t.Fatalf("expected 405 with Allow header, got %d %q", rejectedRecorder.Code, rejectedRecorder.Header().Get(headerAllow))
+	}
+
+	dpopKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	dpopJwk := publicJwk{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(dpopKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(dpopKey.Y.FillBytes(make([]byte, 32))),
+	}
+	thumbprint, thumbErr := jwkThumbprint(dpopJwk)
+	if thumbErr != nil {
+		t.Fatalf("jwkThumbprint: %v", thumbErr)
+	}
+	accessToken := issueTestAccessTokenWithThumbprint(t, tokenSigningKey, "token-delete", thumbprint)
+
+	requestURL := "http://ets.example/api/items/1"
+	deleteRecorder := httptest.NewRecorder()
+	deleteRequest := httptest.NewRequest(http.MethodDelete, requestURL, nil)
+	deleteRequest.Header.Set("Origin", "https://app.example.com")
+	deleteRequest.Header.Set("Authorization", "Bearer "+accessToken)
+	deleteRequest.Header.Set(headerDpop, mustCreateDpopProof(t, dpopKey, dpopJwk, http.MethodDelete, requestURL, "proof-delete", time.Now()))
+	handleProtectedProxy(deleteRecorder, deleteRequest, gatewayConfig, restRoute, replayCache, defaultRateLimitPolicy(rateLimiter), upstreamProxy)
+	if deleteRecorder.Code != http.StatusNoContent || <-upstreamMethods != http.MethodDelete {
+		t.Fatalf("expected DELETE to be proxied, got %d", deleteRecorder.Code)
+	}
+}
+
 func TestHandleHealth_ReturnsOkWithoutAuth(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	request := httptest.NewRequest(http.MethodGet, "http://ets.example/health", nil)
@@ -233,6 +276,9 @@ func TestHandleHealth_ReturnsOkWithoutAuth(t *testing.T) {
 		t.Fatalf("unexpected body: %s", recorder.Body.String())
 	}
 }
+
+var testApiRoute = upstreamRoute{PathPrefix: "/api", UpstreamTimeout: 10 * time.Second}
+
 func issueTestAccessToken(t *testing.T, signingKey []byte, tokenID string) string {
 	return issueTestAccessTokenWithThumbprint(t, signingKey, tokenID, "test-thumb")
 }
@@ -261,13 +307,17 @@ func issueTestAccessTokenWithThumbprint(t *testing.T, signingKey []byte, tokenID
 
 func mustCreateDpopProof(t *testing.T, privateKey *ecdsa.PrivateKey, jwk publicJwk, method string, requestURL string, jwtID string, issuedAt time.Time) string {
 	t.Helper()
-
-	payload := dpopPayload{
+	return mustSignDpopPayload(t, privateKey, jwk, dpopPayload{
 		HttpMethod: method,
 		HttpUri:    requestURL,
 		JwtID:      jwtID,
 		IssuedAt:   issuedAt.Unix(),
-	}
+	})
+}
+
+func mustSignDpopPayload(t *testing.T, privateKey *ecdsa.PrivateKey, jwk publicJwk, payload dpopPayload) string {
+	t.Helper()
+
 	header := dpopHeader{
 		Type: "dpop+jwt",
 		Alg:  "ES256",
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const headerCookie = "Cookie"
+
+// The upstream never needs the browser's ETS token, DPoP proof, or cookies.
+var clientCredentialHeaders = []string{headerAuthorization, headerDpop, headerCookie}
+
+type headerPolicy struct {
+	Allow map[string]struct{}
+	Deny  map[string]struct{}
+}
+
+type headerPolicyConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+func (policy headerPolicy) apply(headers http.Header) {
+	for headerName := range headers {
+		if _, denied := policy.Deny[headerName]; denied {
+			headers.Del(headerName)
+			continue
+		}
+		if len(policy.Allow) == 0 {
+			continue
+		}
+		if _, allowed := policy.Allow[headerName]; !allowed {
+			headers.Del(headerName)
+		}
+	}
+}
+
+// An empty allow list already allows everything.
+func (policy headerPolicy) allowAlso(headerNames []string) {
+	if len(policy.Allow) == 0 {
+		return
+	}
+	for _, headerName := range headerNames {
+		policy.Allow[http.CanonicalHeaderKey(headerName)] = struct{}{}
+	}
+}
+
+func (policyConfig *headerPolicyConfig) build() (headerPolicy, error) {
+	if policyConfig == nil {
+		return headerPolicy{}, nil
+	}
+	allowedHeaders, allowError := canonicalHeaderSet(policyConfig.Allow)
+	if allowError != nil {
+		return headerPolicy{}, fmt.Errorf("allow: %w", allowError)
+	}
+	deniedHeaders, denyError := canonicalHeaderSet(policyConfig.Deny)
+	if denyError != nil {
+		return headerPolicy{}, fmt.Errorf("deny: %w", denyError)
+	}
+	return headerPolicy{Allow: allowedHeaders, Deny: deniedHeaders}, nil
+}
+
+func canonicalHeaderSet(headerNames []string) (map[string]struct{}, error) {
+	headerSet := make(map[string]struct{}, len(headerNames))
+	for _, headerName := range headerNames {
+		trimmed := strings.TrimSpace(headerName)
+		if trimmed == "" || strings.ContainsAny(trimmed, " :\t") {
+			return nil, fmt.Errorf("invalid header name %q", headerName)
+		}
+		headerSet[http.CanonicalHeaderKey(trimmed)] = struct{}{}
+	}
+	return headerSet, nil
+}
+
+func stripClientCredentials(headers http.Header) {
+	for _, headerName := range clientCredentialHeaders {
+		headers.Del(headerName)
+	}
+}
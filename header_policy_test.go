@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNewReverseProxy_StripsClientCredentialsByDefault(t *testing.T) {
+	receivedHeaders := make(chan http.Header, 1)
+	upstreamURL := startHeaderEchoUpstream(t, receivedHeaders, nil)
+
+	reverseProxy := newReverseProxy(upstreamRoute{PathPrefix: "/api", UpstreamBaseURL: upstreamURL})
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "http://ets.example/api", nil)
+	request.Header.Set("Authorization", "Bearer ets-access-token")
+	request.Header.Set(headerDpop, "dpop-proof")
+	request.Header.Set("Cookie", "session=abc")
+	request.Header.Set("Accept", "application/json")
+	reverseProxy.ServeHTTP(recorder, request)
+
+	upstreamHeaders := <-receivedHeaders
+	for _, headerName := range []string{"Authorization", "Dpop", "Cookie"} {
+		if upstreamHeaders.Get(headerName) != "" {
+			t.Fatalf("expected %s to be stripped, got %q", headerName, upstreamHeaders.Get(headerName))
+		}
+	}
+	if upstreamHeaders.Get("Accept") != "application/json" {
+		t.Fatalf("expected unrelated headers to pass through")
+	}
+}
+
+func TestNewReverseProxy_AppliesRequestAndResponseHeaderPolicies(t *testing.T) {
+	receivedHeaders := make(chan http.Header, 1)
+	upstreamURL := startHeaderEchoUpstream(t, receivedHeaders, http.Header{
+		"X-Internal-Trace": {"trace-1"},
+		"X-Result-Count":   {"3"},
+		"Server":           {"upstream/1.0"},
+	})
+
+	parsedRoutes, parseErr := parseUpstreamRoutes([]byte(`{"routes":[{
+		"pathPrefix":"/api","upstreamBaseUrl":"`+upstreamURL.String()+`",
+		"upstreamAuth":{"mode":"bearer","secret":"service-secret"},
+		"requestHeaders":{"allow":["accept","content-type","x-request-id","x-debug"],"deny":["x-debug"]},
+		"responseHeaders":{"deny":["x-internal-trace","server"]}
+	}]}`), time.Second)
+	if parseErr != nil {
+		t.Fatalf("parseUpstreamRoutes: %v", parseErr)
+	}
+
+	reverseProxy := newReverseProxy(parsedRoutes[0])
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "http://ets.example/api", nil)
+	request.Header.Set("Authorization", "Bearer ets-access-token")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("X-Request-Id", "req-1")
+	request.Header.Set("X-Debug", "1")
+	request.Header.Set("User-Agent", "browser")
+	reverseProxy.ServeHTTP(recorder, request)
+
+	upstreamHeaders := <-receivedHeaders
+	if upstreamHeaders.Get("Authorization") != "Bearer service-secret" {
+		t.Fatalf("expected upstream auth to replace the client token, got %q", upstreamHeaders.Get("Authorization"))
+	}
+	if upstreamHeaders.Get("X-Request-Id") != "req-1" || upstreamHeaders.Get("Accept") != "application/json" {
+		t.Fatalf("expected allow-listed headers to pass, got %v", upstreamHeaders)
+	}
+	if upstreamHeaders.Get("X-Debug") != "" || upstreamHeaders.Get("User-Agent") != "" {
+		t.Fatalf("expected denied and unlisted headers to be dropped, got %v", upstreamHeaders)
+	}
+
+	if recorder.Header().Get("X-Internal-Trace") != "" || recorder.Header().Get("Server") != "" {
+		t.Fatalf("expected denied response headers to be dropped, got %v", recorder.Header())
+	}
+	if recorder.Header().Get("X-Result-Count") != "3" {
+		t.Fatalf("expected other response headers to pass through")
+	}
+}
+
+func TestHeaderPolicyConfig_RejectsInvalidNames(t *testing.T) {
+	if _, buildErr := (&headerPolicyConfig{Allow: []string{"X-Ok", "Bad Header"}}).build(); buildErr == nil {
+		t.Fatalf("expected invalid header name to be rejected")
+	}
+}
+
+func startHeaderEchoUpstream(t *testing.T, receivedHeaders chan<- http.Header, responseHeaders http.Header) *url.URL {
+	t.Helper()
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		receivedHeaders <- request.Header.Clone()
+		for headerName, headerValues := range responseHeaders {
+			writer.Header()[headerName] = headerValues
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(upstreamServer.Close)
+	upstreamURL, parseErr := url.Parse(upstreamServer.URL)
+	if parseErr != nil {
+		t.Fatalf("url.Parse: %v", parseErr)
+	}
+	return upstreamURL
+}
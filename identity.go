@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	headerEtsPrefix    = "X-Ets-"
+	headerEtsJkt       = "X-ETS-Jkt"
+	headerEtsTokenID   = "X-ETS-Token-Id"
+	headerEtsOrigin    = "X-ETS-Origin"
+	headerEtsAssertion = "X-ETS-Assertion"
+
+	identityAssertionIssuer   = "ets"
+	identityAssertionLifetime = 60 * time.Second
+	// The access-token verifier refuses this typ, so an assertion is never a bearer token.
+	identityAssertionTokenType = "ets-assertion+jwt"
+)
+
+type verifiedCaller struct {
+	TokenID       string
+	JwkThumbprint string
+	Origin        string
+	Assertion     string
+}
+
+type identityAssertionClaims struct {
+	jwt.RegisteredClaims
+	TokenID      string       `json:"token_jti"`
+	Origin       string       `json:"origin"`
+	HttpMethod   string       `json:"htm"`
+	RequestPath  string       `json:"path"`
+	Confirmation confirmation `json:"cnf"`
+}
+
+type verifiedCallerContextKey struct{}
+
+func withVerifiedCaller(parentContext context.Context, caller verifiedCaller) context.Context {
+	return context.WithValue(parentContext, verifiedCallerContextKey{}, caller)
+}
+
+func verifiedCallerFrom(requestContext context.Context) (verifiedCaller, bool) {
+	caller, found := requestContext.Value(verifiedCallerContextKey{}).(verifiedCaller)
+	return caller, found
+}
+
+func signIdentityAssertion(keyring tokenKeyring, caller verifiedCaller, route upstreamRoute, httpRequest *http.Request) (string, error) {
+	if !keyring.Current.isAsymmetric() {
+		return "", fmt.Errorf("identity assertions need an asymmetric signing key")
+	}
+	currentTime := timeNow()
+	assertionClaims := identityAssertionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    identityAssertionIssuer,
+			Subject:   caller.JwkThumbprint,
+			IssuedAt:  jwt.NewNumericDate(currentTime),
+			ExpiresAt: jwt.NewNumericDate(currentTime.Add(identityAssertionLifetime)),
+		},
+		TokenID:      caller.TokenID,
+		Origin:       caller.Origin,
+		HttpMethod:   httpRequest.Method,
+		RequestPath:  route.upstreamRequestPath(httpRequest.URL.Path),
+		Confirmation: confirmation{JwkThumbprint: caller.JwkThumbprint},
+	}
+	if route.UpstreamBaseURL != nil {
+		assertionClaims.Audience = jwt.ClaimStrings{route.UpstreamBaseURL.Scheme + "://" + route.UpstreamBaseURL.Host}
+	}
+	return keyring.Current.signTypedClaims(assertionClaims, identityAssertionTokenType)
+}
+
+// Verifying an HS256 assertion would hand upstreams the secret that mints access tokens.
+func checkIdentityAssertionKey(upstreamRoutes []upstreamRoute, keyring tokenKeyring) error {
+	for _, route := range upstreamRoutes {
+		if route.IdentityAssertion && !keyring.Current.isAsymmetric() {
+			return fmt.Errorf("route %s: identityAssertion needs an ES256 or EdDSA key in %s or %s", route.PathPrefix, envKeyJwtSigningKeyFile, envKeyJwtKeyringFile)
+		}
+	}
+	return nil
+}
+
+// Client-supplied X-ETS-* headers are always dropped.
+func applyCallerIdentity(upstreamRequest *http.Request, route upstreamRoute) {
+	for headerName := range upstreamRequest.Header {
+		if strings.HasPrefix(headerName, headerEtsPrefix) {
+			upstreamRequest.Header.Del(headerName)
+		}
+	}
+	if !route.ForwardIdentity {
+		return
+	}
+	caller, found := verifiedCallerFrom(upstreamRequest.Context())
+	if !found {
+		return
+	}
+	upstreamRequest.Header.Set(headerEtsJkt, caller.JwkThumbprint)
+	upstreamRequest.Header.Set(headerEtsTokenID, caller.TokenID)
+	upstreamRequest.Header.Set(headerEtsOrigin, caller.Origin)
+	if caller.Assertion != "" {
+		upstreamRequest.Header.Set(headerEtsAssertion, caller.Assertion)
+	}
+}
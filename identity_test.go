@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestHandleProtectedProxy_ForwardsSignedCallerIdentity(t *testing.T) {
+	privateKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	signingKey, parseErr := parseTokenSigningKey(mustEncodePkcs8Pem(t, privateKey), "")
+	if parseErr != nil {
+		t.Fatalf("parseTokenSigningKey: %v", parseErr)
+	}
+	keyring := tokenKeyring{Current: signingKey}
+
+	receivedHeaders := make(chan http.Header, 1)
+	upstreamURL := startHeaderEchoUpstream(t, receivedHeaders, nil)
+	route := upstreamRoute{PathPrefix: "/api", UpstreamBaseURL: upstreamURL, UpstreamTimeout: 10 * time.Second, ForwardIdentity: true, IdentityAssertion: true}
+
+	recorder, thumbprint := serveVerifiedIdentityRequest(t, keyring, route, "token-identity", nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d (%s)", recorder.Code, recorder.Body.String())
+	}
+
+	upstreamHeaders := <-receivedHeaders
+	if upstreamHeaders.Get(headerEtsJkt) != thumbprint || upstreamHeaders.Get(headerEtsTokenID) != "token-identity" || upstreamHeaders.Get(headerEtsOrigin) != "https://app.example.com" {
+		t.Fatalf("unexpected identity headers: %v", upstreamHeaders)
+	}
+
+	var assertionClaims identityAssertionClaims
+	parsedAssertion, verifyErr := jwt.ParseWithClaims(upstreamHeaders.Get(headerEtsAssertion), &assertionClaims, keyring.Current.verificationKeyFor,
+		jwt.WithAudience(upstreamURL.Scheme+"://"+upstreamURL.Host), jwt.WithIssuer("ets"), jwt.WithExpirationRequired())
+	if verifyErr != nil || !parsedAssertion.Valid {
+		t.Fatalf("expected assertion to verify with the ETS keyring: %v", verifyErr)
+	}
+	if assertionClaims.Subject != thumbprint || assertionClaims.TokenID != "token-identity" || assertionClaims.HttpMethod != http.MethodPost || assertionClaims.RequestPath != "/api" {
+		t.Fatalf("unexpected assertion claims: %+v", assertionClaims)
+	}
+	if parsedAssertion.Header[jwtHeaderType] != identityAssertionTokenType {
+		t.Fatalf("expected typ %s, got %v", identityAssertionTokenType, parsedAssertion.Header[jwtHeaderType])
+	}
+	var bearerClaims accessClaims
+	if _, bearerErr := jwt.ParseWithClaims(upstreamHeaders.Get(headerEtsAssertion), &bearerClaims, keyring.verificationKeyFor); bearerErr == nil {
+		t.Fatalf("expected the access-token verifier to refuse an identity assertion")
+	}
+}
+
+func TestSignIdentityAssertion_SignsThePathTheUpstreamReceives(t *testing.T) {
+	privateKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	signingKey, parseErr := parseTokenSigningKey(mustEncodePkcs8Pem(t, privateKey), "")
+	if parseErr != nil {
+		t.Fatalf("parseTokenSigningKey: %v", parseErr)
+	}
+	keyring := tokenKeyring{Current: signingKey}
+	upstreamURL, urlErr := url.Parse("https://llm.internal/base/")
+	if urlErr != nil {
+		t.Fatalf("url.Parse: %v", urlErr)
+	}
+
+	testCases := map[string]upstreamRoute{
+		"/base/api/llm/chat": {PathPrefix: "/api/llm", UpstreamBaseURL: upstreamURL},
+		"/base/chat":         {PathPrefix: "/api/llm", UpstreamBaseURL: upstreamURL, StripPrefix: true},
+		"/base/v1/chat":      {PathPrefix: "/api/llm", UpstreamBaseURL: upstreamURL, RewritePrefix: "/v1"},
+	}
+	for wantPath, route := range testCases {
+		request := httptest.NewRequest(http.MethodPost, "http://ets.example/api/llm/chat", nil)
+		signedAssertion, signErr := signIdentityAssertion(keyring, verifiedCaller{TokenID: "token-path"}, route, request)
+		if signErr != nil {
+			t.Fatalf("signIdentityAssertion: %v", signErr)
+		}
+		var assertionClaims identityAssertionClaims
+		if _, _, parseErr := jwt.NewParser().ParseUnverified(signedAssertion, &assertionClaims); parseErr != nil {
+			t.Fatalf("ParseUnverified: %v", parseErr)
+		}
+		if assertionClaims.RequestPath != wantPath {
+			t.Fatalf("expected path %q, got %q", wantPath, assertionClaims.RequestPath)
+		}
+	}
+}
+
+func TestCheckIdentityAssertionKey_RequiresAsymmetricKey(t *testing.T) {
+	privateKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	signingKey, parseErr := parseTokenSigningKey(mustEncodePkcs8Pem(t, privateKey), "")
+	if parseErr != nil {
+		t.Fatalf("parseTokenSigningKey: %v", parseErr)
+	}
+	hmacKeyring := tokenKeyring{Current: newHmacTokenKey([]byte("0123456789abcdef0123456789abcdef"))}
+	assertionRoutes := []upstreamRoute{{PathPrefix: "/api"}, {PathPrefix: "/api/audit", ForwardIdentity: true, IdentityAssertion: true}}
+
+	if checkErr := checkIdentityAssertionKey(assertionRoutes, hmacKeyring); checkErr == nil {
+		t.Fatalf("expected an HS256 keyring to be refused for identity assertions")
+	}
+	if checkErr := checkIdentityAssertionKey(assertionRoutes, tokenKeyring{Current: signingKey}); checkErr != nil {
+		t.Fatalf("expected an ES256 keyring to be accepted: %v", checkErr)
+	}
+	if checkErr := checkIdentityAssertionKey(assertionRoutes[:1], hmacKeyring); checkErr != nil {
+		t.Fatalf("expected HS256 to be fine without identity assertions: %v", checkErr)
+	}
+
+	upstreamURL := startHeaderEchoUpstream(t, make(chan http.Header, 1), nil)
+	route := upstreamRoute{PathPrefix: "/api", UpstreamBaseURL: upstreamURL, UpstreamTimeout: 10 * time.Second, ForwardIdentity: true, IdentityAssertion: true}
+	if recorder, _ := serveVerifiedIdentityRequest(t, hmacKeyring, route, "token-hmac", nil); recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("expected no HS256 assertion to be signed, got %d", recorder.Code)
+	}
+}
+
+func TestHandleProtectedProxy_StripsSpoofedIdentityHeaders(t *testing.T) {
+	keyring := tokenKeyring{Current: newHmacTokenKey([]byte("0123456789abcdef0123456789abcdef"))}
+	receivedHeaders := make(chan http.Header, 1)
+	upstreamURL := startHeaderEchoUpstream(t, receivedHeaders, nil)
+	route := upstreamRoute{PathPrefix: "/api", UpstreamBaseURL: upstreamURL, UpstreamTimeout: 10 * time.Second}
+
+	recorder, _ := serveVerifiedIdentityRequest(t, keyring, route, "token-spoof", http.Header{
+		"X-Ets-Jkt":       {"attacker-thumbprint"},
+		"X-Ets-Assertion": {"forged"},
+	})
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", recorder.Code)
+	}
+	upstreamHeaders := <-receivedHeaders
+	if upstreamHeaders.Get(headerEtsJkt) != "" || upstreamHeaders.Get(headerEtsAssertion) != "" {
+		t.Fatalf("expected client-supplied X-ETS headers to be removed, got %v", upstreamHeaders)
+	}
+}
+
+func serveVerifiedIdentityRequest(t *testing.T, keyring tokenKeyring, route upstreamRoute, tokenID string, extraHeaders http.Header) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	gatewayConfig := serverConfig{
+		AllowedOrigins:  map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:   5 * time.Minute,
+		TokenKeyring:    &keyring,
+		UpstreamTimeout: 10 * time.Second,
+	}
+
+	dpopKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	dpopJwk := publicJwk{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(dpopKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(dpopKey.Y.FillBytes(make([]byte, 32))),
+	}
+	thumbprint, thumbErr := jwkThumbprint(dpopJwk)
+	if thumbErr != nil {
+		t.Fatalf("jwkThumbprint: %v", thumbErr)
+	}
+	currentTime := time.Now()
+	accessToken, signErr := keyring.signClaims(accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{audienceApi},
+			IssuedAt:  jwt.NewNumericDate(currentTime),
+			ExpiresAt: jwt.NewNumericDate(currentTime.Add(5 * time.Minute)),
+			ID:        tokenID,
+		},
+		Confirmation: confirmation{JwkThumbprint: thumbprint},
+	})
+	if signErr != nil {
+		t.Fatalf("signClaims: %v", signErr)
+	}
+
+	requestURL := "http://ets.example/api"
+	request := httptest.NewRequest(http.MethodPost, requestURL, nil)
+	for headerName, headerValues := range extraHeaders {
+		request.Header[headerName] = headerValues
+	}
+	request.Header.Set("Origin", "https://app.example.com")
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	request.Header.Set(headerDpop, mustCreateDpopProof(t, dpopKey, dpopJwk, http.MethodPost, requestURL, "proof-"+tokenID, currentTime))
+
+	replayCache := newReplayStore(defaultReplayCacheCapacity)
+	rateLimiter := &windowLimiter{windowEnd: currentTime.Unix() + 60, counts: make(map[string]int), perMinuteCap: 100}
+	recorder := httptest.NewRecorder()
+	handleProtectedProxy(recorder, request, gatewayConfig, route, replayCache, defaultRateLimitPolicy(rateLimiter), newReverseProxy(route))
+	return recorder, thumbprint
+}
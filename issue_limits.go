@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envKeyIssueRateLimitRules       = "ISSUE_RATE_LIMIT_RULES"
+	envKeyIssueMaxActiveTokensPerIP = "ISSUE_MAX_ACTIVE_TOKENS_PER_IP"
+
+	defaultIssueRateLimitRules = "ip=30/m"
+)
+
+// The per-IP token cap keeps fresh keypairs from sidestepping per-key limits.
+type issuanceGuard struct {
+	rateLimits   rateLimitPolicy
+	activeTokens *activeTokenCounter
+}
+
+func newIssuanceGuard(gatewayConfig serverConfig) issuanceGuard {
+	guard := issuanceGuard{rateLimits: buildRateLimitPolicy(gatewayConfig, rateScopeIssue, gatewayConfig.IssueRateLimitRules)}
+	if gatewayConfig.IssueMaxActiveTokensPerIP > 0 {
+		guard.activeTokens = newActiveTokenCounter(gatewayConfig.IssueMaxActiveTokensPerIP)
+	}
+	return guard
+}
+
+type activeTokenCounter struct {
+	mutex     sync.Mutex
+	limit     int
+	expiries  map[string][]time.Time
+	nextSweep time.Time
+}
+
+func newActiveTokenCounter(limit int) *activeTokenCounter {
+	return &activeTokenCounter{limit: limit, expiries: make(map[string][]time.Time)}
+}
+
+func (counter *activeTokenCounter) reserve(clientAddress string, expiresAt time.Time) bool {
+	currentTime := timeNow()
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	if !currentTime.Before(counter.nextSweep) {
+		for sweptAddress, tokenExpiries := range counter.expiries {
+			if len(unexpiredTokens(tokenExpiries, currentTime)) == 0 {
+				delete(counter.expiries, sweptAddress)
+			}
+		}
+		counter.nextSweep = currentTime.Add(rateLimiterSweepInterval)
+	}
+	activeExpiries := unexpiredTokens(counter.expiries[clientAddress], currentTime)
+	if len(activeExpiries) >= counter.limit {
+		counter.expiries[clientAddress] = activeExpiries
+		return false
+	}
+	counter.expiries[clientAddress] = append(activeExpiries, expiresAt)
+	return true
+}
+
+func unexpiredTokens(tokenExpiries []time.Time, currentTime time.Time) []time.Time {
+	activeExpiries := tokenExpiries[:0]
+	for _, expiresAt := range tokenExpiries {
+		if expiresAt.After(currentTime) {
+			activeExpiries = append(activeExpiries, expiresAt)
+		}
+	}
+	return activeExpiries
+}
+
+func loadIssuanceLimits() ([]rateLimitRule, int, error) {
+	rawRules, rulesSet := os.LookupEnv(envKeyIssueRateLimitRules)
+	if !rulesSet {
+		rawRules = defaultIssueRateLimitRules
+	}
+	issueRules, parseError := parseRateLimitRules(rawRules)
+	if parseError != nil {
+		return nil, 0, fmt.Errorf("bad %s: %w", envKeyIssueRateLimitRules, parseError)
+	}
+	for _, rule := range issueRules {
+		for _, dimension := range rule.Dimensions {
+			if dimension != rateDimensionOrigin && dimension != rateDimensionIP {
+				return nil, 0, fmt.Errorf("bad %s: %q is not known at issuance; use origin or ip", envKeyIssueRateLimitRules, dimension)
+			}
+		}
+	}
+
+	maxActiveTokens := 0
+	if rawMaximum := strings.TrimSpace(os.Getenv(envKeyIssueMaxActiveTokensPerIP)); rawMaximum != "" {
+		parsedMaximum, parseError := strconv.Atoi(rawMaximum)
+		if parseError != nil || parsedMaximum < 0 {
+			return nil, 0, fmt.Errorf("bad %s: %q", envKeyIssueMaxActiveTokensPerIP, rawMaximum)
+		}
+		maxActiveTokens = parsedMaximum
+	}
+	return issueRules, maxActiveTokens, nil
+}
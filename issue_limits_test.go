@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestHandleTokenIssue_RateLimitsPerIP(t *testing.T) {
+	issueRules, parseErr := parseRateLimitRules("ip=2/m")
+	if parseErr != nil {
+		t.Fatalf("parseRateLimitRules: %v", parseErr)
+	}
+	gatewayConfig := newIssueTestConfig()
+	gatewayConfig.IssueRateLimitRules = issueRules
+	issueGuard := newIssuanceGuard(gatewayConfig)
+
+	var statusCodes []int
+	for _, remoteAddress := range []string{"198.51.100.1:1000", "198.51.100.1:2000", "198.51.100.1:3000", "198.51.100.2:1000"} {
+		statusCodes = append(statusCodes, issueTokenFrom(t, gatewayConfig, issueGuard, remoteAddress).Code)
+	}
+	if statusCodes[0] != http.StatusOK || statusCodes[1] != http.StatusOK || statusCodes[2] != http.StatusTooManyRequests || statusCodes[3] != http.StatusOK {
+		t.Fatalf("expected the third request from one IP to be limited, got %v", statusCodes)
+	}
+}
+
+func TestHandleTokenIssue_CapsActiveTokensPerIP(t *testing.T) {
+	currentTime := stubRateClock(t)
+	gatewayConfig := newIssueTestConfig()
+	gatewayConfig.IssueMaxActiveTokensPerIP = 2
+	issueGuard := newIssuanceGuard(gatewayConfig)
+
+	issueTokenFrom(t, gatewayConfig, issueGuard, "198.51.100.1:1000")
+	issueTokenFrom(t, gatewayConfig, issueGuard, "198.51.100.1:1000")
+	cappedRecorder := issueTokenFrom(t, gatewayConfig, issueGuard, "198.51.100.1:1000")
+	if cappedRecorder.Code != http.StatusTooManyRequests || !strings.Contains(cappedRecorder.Body.String(), "too_many_active_tokens") {
+		t.Fatalf("expected the third concurrent token to be refused, got %d %s", cappedRecorder.Code, cappedRecorder.Body.String())
+	}
+
+	*currentTime = currentTime.Add(gatewayConfig.TokenLifetime + time.Second)
+	if recorder := issueTokenFrom(t, gatewayConfig, issueGuard, "198.51.100.1:1000"); recorder.Code != http.StatusOK {
+		t.Fatalf("expected expired tokens to free the cap, got %d", recorder.Code)
+	}
+}
+
+func TestHandleTokenIssue_SignFailureDoesNotHoldActiveTokenSlot(t *testing.T) {
+	stubRateClock(t)
+	gatewayConfig := newIssueTestConfig()
+	gatewayConfig.IssueMaxActiveTokensPerIP = 1
+	issueGuard := newIssuanceGuard(gatewayConfig)
+
+	failingConfig := gatewayConfig
+	failingConfig.TokenKeyring = &tokenKeyring{Current: tokenKey{SigningMethod: jwt.SigningMethodES256, SigningKey: []byte("not an ecdsa key")}}
+	if recorder := issueTokenFrom(t, failingConfig, issueGuard, "198.51.100.1:1000"); recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the failing signer to return 500, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := issueTokenFrom(t, gatewayConfig, issueGuard, "198.51.100.1:1000"); recorder.Code != http.StatusOK {
+		t.Fatalf("expected the failed issuance to leave the slot free, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestLoadIssuanceLimits_DefaultsAndValidation(t *testing.T) {
+	t.Setenv(envKeyIssueMaxActiveTokensPerIP, "")
+	issueRules, maxActiveTokens, loadErr := loadIssuanceLimits()
+	if loadErr != nil || len(issueRules) != 1 || issueRules[0].Name != "ip" || maxActiveTokens != 0 {
+		t.Fatalf("expected the ip=30/m default, got %+v %d %v", issueRules, maxActiveTokens, loadErr)
+	}
+
+	t.Setenv(envKeyIssueRateLimitRules, "")
+	t.Setenv(envKeyIssueMaxActiveTokensPerIP, "5")
+	if issueRules, maxActiveTokens, loadErr := loadIssuanceLimits(); loadErr != nil || len(issueRules) != 0 || maxActiveTokens != 5 {
+		t.Fatalf("expected an empty rule list to disable the rate limit, got %+v %d %v", issueRules, maxActiveTokens, loadErr)
+	}
+
+	t.Setenv(envKeyIssueRateLimitRules, "jkt=10/m")
+	if _, _, loadErr := loadIssuanceLimits(); loadErr == nil {
+		t.Fatalf("expected a jkt rule to be rejected at issuance")
+	}
+	t.Setenv(envKeyIssueRateLimitRules, "origin=100/m")
+	t.Setenv(envKeyIssueMaxActiveTokensPerIP, "-1")
+	if _, _, loadErr := loadIssuanceLimits(); loadErr == nil {
+		t.Fatalf("expected a negative cap to be rejected")
+	}
+}
+
+func newIssueTestConfig() serverConfig {
+	return serverConfig{
+		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:      5 * time.Minute,
+		JwtHmacKey:         []byte("0123456789abcdef0123456789abcdef"),
+		RateLimitPerMinute: 100,
+		UpstreamTimeout:    10 * time.Second,
+	}
+}
+
+func issueTokenFrom(t *testing.T, gatewayConfig serverConfig, issueGuard issuanceGuard, remoteAddress string) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handleTokenIssue(recorder, newIssueTokenRequest(t, remoteAddress), gatewayConfig, issueGuard)
+	return recorder
+}
+
+func newIssueTokenRequest(t *testing.T, remoteAddress string) *http.Request {
+	t.Helper()
+	dpopKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	dpopJwk := publicJwk{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(dpopKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(dpopKey.Y.FillBytes(make([]byte, 32))),
+	}
+	bodyBytes, marshalErr := json.Marshal(tokenIssueRequest{DpopPublicJwk: dpopJwk})
+	if marshalErr != nil {
+		t.Fatalf("json.Marshal: %v", marshalErr)
+	}
+	issueURL := "http://ets.example/tvm/issue"
+	request := httptest.NewRequest(http.MethodPost, issueURL, bytes.NewReader(bodyBytes))
+	request.RemoteAddr = remoteAddress
+	request.Header.Set("Origin", "https://app.example.com")
+	request.Header.Set(headerDpop, mustCreateDpopProof(t, dpopKey, dpopJwk, http.MethodPost, issueURL, "issue-proof", timeNow()))
+	return request
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for ES384 and ES512
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+const (
+	envKeyDpopAllowedAlgs = "DPOP_ALLOWED_ALGS"
+
+	jwkKeyTypeRSA         = "RSA"
+	jwkCurveP384          = "P-384"
+	jwkCurveP521          = "P-521"
+	minimumDpopRsaKeyBits = 2048
+)
+
+type publicJwk struct {
+	KeyType           string `json:"kty"`
+	Curve             string `json:"crv,omitempty"`
+	X                 string `json:"x,omitempty"`
+	Y                 string `json:"y,omitempty"`
+	N                 string `json:"n,omitempty"`
+	E                 string `json:"e,omitempty"`
+	hasPrivateMembers bool
+}
+
+var jwkPrivateMembers = []string{"d", "p", "q", "dp", "dq", "qi", "oth", "k"}
+
+// Strict decoding gives each key exactly one encoding and one thumbprint.
+var jwkMemberEncoding = base64.RawURLEncoding.Strict()
+
+func (jwkObject *publicJwk) UnmarshalJSON(jwkBytes []byte) error {
+	type plainJwk publicJwk
+	var jwkMembers map[string]json.RawMessage
+	if unmarshalError := json.Unmarshal(jwkBytes, &jwkMembers); unmarshalError != nil {
+		return unmarshalError
+	}
+	var decodedJwk plainJwk
+	if unmarshalError := json.Unmarshal(jwkBytes, &decodedJwk); unmarshalError != nil {
+		return unmarshalError
+	}
+	*jwkObject = publicJwk(decodedJwk)
+	for _, privateMember := range jwkPrivateMembers {
+		if _, present := jwkMembers[privateMember]; present {
+			jwkObject.hasPrivateMembers = true
+		}
+	}
+	return nil
+}
+
+type dpopAlgorithm struct {
+	keyType string
+	curve   string
+	verify  func(publicKey crypto.PublicKey, signingInput []byte, signature []byte) bool
+}
+
+var dpopAlgorithms = map[string]dpopAlgorithm{
+	"ES256": {keyType: jwkKeyTypeEllipticKey, curve: jwkCurveP256, verify: ecdsaVerifier(crypto.SHA256)},
+	"ES384": {keyType: jwkKeyTypeEllipticKey, curve: jwkCurveP384, verify: ecdsaVerifier(crypto.SHA384)},
+	"ES512": {keyType: jwkKeyTypeEllipticKey, curve: jwkCurveP521, verify: ecdsaVerifier(crypto.SHA512)},
+	"EdDSA": {keyType: jwkKeyTypeOctetKeyPair, curve: jwkCurveEd25519, verify: verifyEd25519},
+	"RS256": {keyType: jwkKeyTypeRSA, verify: verifyRsaPkcs1v15},
+	"PS256": {keyType: jwkKeyTypeRSA, verify: verifyRsaPss},
+}
+
+var jwkEllipticCurves = map[string]elliptic.Curve{
+	jwkCurveP256: elliptic.P256(),
+	jwkCurveP384: elliptic.P384(),
+	jwkCurveP521: elliptic.P521(),
+}
+
+func (algorithm dpopAlgorithm) signs(jwkObject publicJwk) bool {
+	return jwkObject.KeyType == algorithm.keyType && (algorithm.curve == "" || jwkObject.Curve == algorithm.curve)
+}
+
+func publicKeyFromJwk(jwkObject publicJwk) (crypto.PublicKey, error) {
+	if jwkObject.hasPrivateMembers {
+		return nil, fmt.Errorf("public JWK carries private key members")
+	}
+	switch jwkObject.KeyType {
+	case jwkKeyTypeEllipticKey:
+		curve, knownCurve := jwkEllipticCurves[jwkObject.Curve]
+		if !knownCurve {
+			return nil, fmt.Errorf("unsupported EC curve %q", jwkObject.Curve)
+		}
+		coordinateLength := (curve.Params().BitSize + 7) / 8
+		xCoordinateBytes, decodeXError := jwkMemberEncoding.DecodeString(jwkObject.X)
+		if decodeXError != nil {
+			return nil, decodeXError
+		}
+		yCoordinateBytes, decodeYError := jwkMemberEncoding.DecodeString(jwkObject.Y)
+		if decodeYError != nil {
+			return nil, decodeYError
+		}
+		// RFC 7518 section 6.2.1.2: coordinates are always the full curve size, never trimmed.
+		if len(xCoordinateBytes) != coordinateLength || len(yCoordinateBytes) != coordinateLength {
+			return nil, fmt.Errorf("%s coordinates must be %d bytes", jwkObject.Curve, coordinateLength)
+		}
+		uncompressedPoint := append([]byte{4}, xCoordinateBytes...)
+		return ecdsa.ParseUncompressedPublicKey(curve, append(uncompressedPoint, yCoordinateBytes...))
+	case jwkKeyTypeOctetKeyPair:
+		if jwkObject.Curve != jwkCurveEd25519 {
+			return nil, fmt.Errorf("unsupported OKP curve %q", jwkObject.Curve)
+		}
+		publicKeyBytes, decodeError := jwkMemberEncoding.DecodeString(jwkObject.X)
+		if decodeError != nil {
+			return nil, decodeError
+		}
+		if len(publicKeyBytes) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Ed25519 key must be %d bytes", ed25519.PublicKeySize)
+		}
+		return ed25519.PublicKey(publicKeyBytes), nil
+	case jwkKeyTypeRSA:
+		modulusBytes, decodeModulusError := jwkMemberEncoding.DecodeString(jwkObject.N)
+		if decodeModulusError != nil {
+			return nil, decodeModulusError
+		}
+		exponentBytes, decodeExponentError := jwkMemberEncoding.DecodeString(jwkObject.E)
+		if decodeExponentError != nil {
+			return nil, decodeExponentError
+		}
+		// RFC 7518 section 6.3.1: both integers use their shortest big-endian form.
+		if len(modulusBytes) == 0 || modulusBytes[0] == 0 || len(exponentBytes) == 0 || exponentBytes[0] == 0 {
+			return nil, fmt.Errorf("RSA integers must be minimal")
+		}
+		modulus := new(big.Int).SetBytes(modulusBytes)
+		exponent := new(big.Int).SetBytes(exponentBytes)
+		if modulus.BitLen() < minimumDpopRsaKeyBits {
+			return nil, fmt.Errorf("RSA modulus must be at least %d bits", minimumDpopRsaKeyBits)
+		}
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 || exponent.Bit(0) == 0 {
+			return nil, fmt.Errorf("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwkObject.KeyType)
+	}
+}
+
+// jwkThumbprint is the RFC 7638 thumbprint.
+func jwkThumbprint(jwkObject publicJwk) (string, error) {
+	var canonicalMembers interface{}
+	switch jwkObject.KeyType {
+	case jwkKeyTypeEllipticKey:
+		canonicalMembers = struct {
+			Curve   string `json:"crv"`
+			KeyType string `json:"kty"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		}{jwkObject.Curve, jwkObject.KeyType, jwkObject.X, jwkObject.Y}
+	case jwkKeyTypeOctetKeyPair:
+		canonicalMembers = struct {
+			Curve   string `json:"crv"`
+			KeyType string `json:"kty"`
+			X       string `json:"x"`
+		}{jwkObject.Curve, jwkObject.KeyType, jwkObject.X}
+	case jwkKeyTypeRSA:
+		canonicalMembers = struct {
+			E       string `json:"e"`
+			KeyType string `json:"kty"`
+			N       string `json:"n"`
+		}{jwkObject.E, jwkObject.KeyType, jwkObject.N}
+	default:
+		return "", fmt.Errorf("unsupported key type %q", jwkObject.KeyType)
+	}
+	var canonicalBuffer bytes.Buffer
+	canonicalEncoder := json.NewEncoder(&canonicalBuffer)
+	canonicalEncoder.SetEscapeHTML(false)
+	if encodeError := canonicalEncoder.Encode(canonicalMembers); encodeError != nil {
+		return "", encodeError
+	}
+	sha256Digest := sha256.Sum256(bytes.TrimSuffix(canonicalBuffer.Bytes(), []byte("\n")))
+	return base64.RawURLEncoding.EncodeToString(sha256Digest[:]), nil
+}
+
+// JOSE ECDSA signatures are r||s, each half as long as the curve's coordinates.
+func ecdsaVerifier(hash crypto.Hash) func(crypto.PublicKey, []byte, []byte) bool {
+	return func(publicKey crypto.PublicKey, signingInput []byte, joseSignature []byte) bool {
+		ecdsaKey, isEcdsa := publicKey.(*ecdsa.PublicKey)
+		if !isEcdsa {
+			return false
+		}
+		componentLength := (ecdsaKey.Curve.Params().BitSize + 7) / 8
+		if len(joseSignature) != 2*componentLength {
+			return false
+		}
+		rComponent := new(big.Int).SetBytes(joseSignature[:componentLength])
+		sComponent := new(big.Int).SetBytes(joseSignature[componentLength:])
+		digest := hash.New()
+		digest.Write(signingInput)
+		return ecdsa.Verify(ecdsaKey, digest.Sum(nil), rComponent, sComponent)
+	}
+}
+
+func verifyEd25519(publicKey crypto.PublicKey, signingInput []byte, signature []byte) bool {
+	ed25519Key, isEd25519 := publicKey.(ed25519.PublicKey)
+	return isEd25519 && ed25519.Verify(ed25519Key, signingInput, signature)
+}
+
+func verifyRsaPkcs1v15(publicKey crypto.PublicKey, signingInput []byte, signature []byte) bool {
+	rsaKey, isRsa := publicKey.(*rsa.PublicKey)
+	if !isRsa {
+		return false
+	}
+	digest := sha256.Sum256(signingInput)
+	return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+}
+
+// RFC 7518 section 3.5 fixes the salt length at the hash size.
+func verifyRsaPss(publicKey crypto.PublicKey, signingInput []byte, signature []byte) bool {
+	rsaKey, isRsa := publicKey.(*rsa.PublicKey)
+	if !isRsa {
+		return false
+	}
+	digest := sha256.Sum256(signingInput)
+	return rsa.VerifyPSS(rsaKey, crypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+}
+
+// A nil allowlist permits every algorithm ETS supports.
+func (gatewayConfig serverConfig) dpopAlgorithmAllowed(alg string) bool {
+	if _, supported := dpopAlgorithms[alg]; !supported {
+		return false
+	}
+	if gatewayConfig.DpopAllowedAlgs == nil {
+		return true
+	}
+	_, allowed := gatewayConfig.DpopAllowedAlgs[alg]
+	return allowed
+}
+
+func (gatewayConfig serverConfig) dpopKeyAllowed(jwkObject publicJwk) bool {
+	for alg, algorithm := range dpopAlgorithms {
+		if algorithm.signs(jwkObject) && gatewayConfig.dpopAlgorithmAllowed(alg) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadDpopAllowedAlgs() (map[string]struct{}, error) {
+	rawAlgs := strings.TrimSpace(os.Getenv(envKeyDpopAllowedAlgs))
+	if rawAlgs == "" {
+		return nil, nil
+	}
+	allowedAlgs := make(map[string]struct{})
+	for _, rawAlg := range strings.Split(rawAlgs, ",") {
+		alg := strings.TrimSpace(rawAlg)
+		if alg == "" {
+			continue
+		}
+		if _, supported := dpopAlgorithms[alg]; !supported {
+			return nil, fmt.Errorf("bad %s: unsupported algorithm %q", envKeyDpopAllowedAlgs, alg)
+		}
+		allowedAlgs[alg] = struct{}{}
+	}
+	if len(allowedAlgs) == 0 {
+		return nil, fmt.Errorf("bad %s: no algorithms listed", envKeyDpopAllowedAlgs)
+	}
+	return allowedAlgs, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublicKeyFromJwk_RoundTripsEcKeys(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		privateKey, keyErr := ecdsa.GenerateKey(curve, rand.Reader)
+		if keyErr != nil {
+			t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+		}
+		parsedKey, parseErr := publicKeyFromJwk(testJwkFor(t, privateKey.Public()))
+		if parseErr != nil {
+			t.Fatalf("publicKeyFromJwk %s: %v", curve.Params().Name, parseErr)
+		}
+		if !privateKey.PublicKey.Equal(parsedKey) {
+			t.Fatalf("parsed %s key does not match original", curve.Params().Name)
+		}
+	}
+}
+
+func TestPublicKeyFromJwk_RejectsInvalidKeys(t *testing.T) {
+	smallRsaKey, keyErr := rsa.GenerateKey(rand.Reader, 1024)
+	if keyErr != nil {
+		t.Fatalf("rsa.GenerateKey: %v", keyErr)
+	}
+	offCurvePoint := base64.RawURLEncoding.EncodeToString(big.NewInt(7).FillBytes(make([]byte, 32)))
+	for name, invalidJwk := range map[string]publicJwk{
+		"unknown type":      {KeyType: "oct"},
+		"unknown curve":     {KeyType: "EC", Curve: "secp256k1", X: offCurvePoint, Y: offCurvePoint},
+		"point off curve":   {KeyType: "EC", Curve: "P-256", X: offCurvePoint, Y: offCurvePoint},
+		"short Ed25519":     {KeyType: "OKP", Curve: "Ed25519", X: "AAAA"},
+		"X25519 curve":      {KeyType: "OKP", Curve: "X25519", X: offCurvePoint},
+		"1024-bit RSA":      testJwkFor(t, smallRsaKey.Public()),
+		"even RSA exponent": {KeyType: "RSA", N: testJwkFor(t, mustGenerateRsaKey(t).Public()).N, E: "Ag"},
+	} {
+		if _, parseErr := publicKeyFromJwk(invalidJwk); parseErr == nil {
+			t.Fatalf("expected %s to be rejected", name)
+		}
+	}
+}
+
+func TestJwkThumbprint_MatchesRFC7638Example(t *testing.T) {
+	// RSA key from RFC 7638 section 3.1.
+	exampleJwk := publicJwk{
+		KeyType: "RSA",
+		N:       "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:       "AQAB",
+	}
+	if thumbprint, thumbErr := jwkThumbprint(exampleJwk); thumbErr != nil || thumbprint != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Fatalf("unexpected thumbprint %s %v", thumbprint, thumbErr)
+	}
+}
+
+// jwkConformanceCorpus is testdata/jwk_conformance.json: public keys with their expected RFC 7638
+// thumbprint (absent when the key must be refused), and DPoP header members with the error a
+// proof carrying them must fail with (absent when the proof must verify).
+type jwkConformanceCorpus struct {
+	Keys []struct {
+		Name       string          `json:"name"`
+		Jwk        json.RawMessage `json:"jwk"`
+		Thumbprint string          `json:"thumbprint"`
+	} `json:"keys"`
+	Headers []struct {
+		Name    string                     `json:"name"`
+		Members map[string]json.RawMessage `json:"members"`
+		Error   string                     `json:"error"`
+	} `json:"headers"`
+}
+
+func TestJwkConformanceCorpus(t *testing.T) {
+	corpusBytes, readErr := os.ReadFile("testdata/jwk_conformance.json")
+	if readErr != nil {
+		t.Fatalf("read corpus: %v", readErr)
+	}
+	var corpus jwkConformanceCorpus
+	if unmarshalErr := json.Unmarshal(corpusBytes, &corpus); unmarshalErr != nil {
+		t.Fatalf("decode corpus: %v", unmarshalErr)
+	}
+
+	for _, keyCase := range corpus.Keys {
+		t.Run(keyCase.Name, func(t *testing.T) {
+			var corpusJwk publicJwk
+			if unmarshalErr := json.Unmarshal(keyCase.Jwk, &corpusJwk); unmarshalErr != nil {
+				t.Fatalf("decode jwk: %v", unmarshalErr)
+			}
+			_, parseErr := publicKeyFromJwk(corpusJwk)
+			if keyCase.Thumbprint == "" {
+				if parseErr == nil {
+					t.Fatalf("expected the key to be rejected")
+				}
+				return
+			}
+			if parseErr != nil {
+				t.Fatalf("publicKeyFromJwk: %v", parseErr)
+			}
+			if thumbprint, thumbErr := jwkThumbprint(corpusJwk); thumbErr != nil || thumbprint != keyCase.Thumbprint {
+				t.Fatalf("expected thumbprint %s, got %s %v", keyCase.Thumbprint, thumbprint, thumbErr)
+			}
+		})
+	}
+
+	privateKey := mustGenerateEcKey(t, elliptic.P256())
+	clientJwk, marshalErr := json.Marshal(testJwkFor(t, privateKey.Public()))
+	if marshalErr != nil {
+		t.Fatalf("json.Marshal jwk: %v", marshalErr)
+	}
+	payloadJSON, marshalErr := json.Marshal(dpopPayload{HttpMethod: http.MethodPost, HttpUri: "http://ets.example/api", JwtID: "corpus-proof", IssuedAt: time.Now().Unix()})
+	if marshalErr != nil {
+		t.Fatalf("json.Marshal payload: %v", marshalErr)
+	}
+	for _, headerCase := range corpus.Headers {
+		t.Run(headerCase.Name, func(t *testing.T) {
+			headerMembers := map[string]json.RawMessage{"typ": json.RawMessage(`"dpop+jwt"`), "alg": json.RawMessage(`"ES256"`), "jwk": clientJwk}
+			for memberName, memberValue := range headerCase.Members {
+				headerMembers[memberName] = memberValue
+			}
+			headerJSON, marshalErr := json.Marshal(headerMembers)
+			if marshalErr != nil {
+				t.Fatalf("json.Marshal header: %v", marshalErr)
+			}
+			signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(payloadJSON)
+			request := httptest.NewRequest(http.MethodPost, "http://ets.example/api", nil)
+			request.Header.Set(headerDpop, signingInput+"."+base64.RawURLEncoding.EncodeToString(mustSignJws(t, "ES256", privateKey, []byte(signingInput))))
+
+			_, verifyErr := verifyDpopProof(request, serverConfig{})
+			if headerCase.Error == "" && verifyErr != nil {
+				t.Fatalf("expected the proof to verify, got %v", verifyErr)
+			}
+			if headerCase.Error != "" && (verifyErr == nil || verifyErr.Error() != headerCase.Error) {
+				t.Fatalf("expected %s, got %v", headerCase.Error, verifyErr)
+			}
+		})
+	}
+}
+
+func TestSigningAlgorithms_VerifyValidAndTamperedSignatures(t *testing.T) {
+	signingInput := []byte("sample input for signature")
+	for alg, privateKey := range map[string]crypto.Signer{
+		"ES256": mustGenerateEcKey(t, elliptic.P256()),
+		"ES384": mustGenerateEcKey(t, elliptic.P384()),
+		"ES512": mustGenerateEcKey(t, elliptic.P521()),
+		"EdDSA": mustGenerateEd25519Key(t),
+		"RS256": mustGenerateRsaKey(t),
+		"PS256": mustGenerateRsaKey(t),
+	} {
+		signature := mustSignJws(t, alg, privateKey, signingInput)
+		signingAlgorithm := dpopAlgorithms[alg]
+		if !signingAlgorithm.signs(testJwkFor(t, privateKey.Public())) {
+			t.Fatalf("%s: expected the key type to match the algorithm", alg)
+		}
+		if !signingAlgorithm.verify(privateKey.Public(), signingInput, signature) {
+			t.Fatalf("%s: expected a valid signature to verify", alg)
+		}
+		signature[0] ^= 0x01
+		if signingAlgorithm.verify(privateKey.Public(), signingInput, signature) {
+			t.Fatalf("%s: expected a tampered signature to be rejected", alg)
+		}
+	}
+}
+
+func TestHandleProtectedProxy_AcceptsEveryAllowedKeyType(t *testing.T) {
+	tokenSigningKey := []byte("0123456789abcdef0123456789abcdef")
+	requestURL := "http://ets.example/api"
+	for alg, privateKey := range map[string]crypto.Signer{
+		"ES384": mustGenerateEcKey(t, elliptic.P384()),
+		"EdDSA": mustGenerateEd25519Key(t),
+		"PS256": mustGenerateRsaKey(t),
+	} {
+		clientJwk := testJwkFor(t, privateKey.Public())
+		thumbprint, thumbErr := jwkThumbprint(clientJwk)
+		if thumbErr != nil {
+			t.Fatalf("jwkThumbprint: %v", thumbErr)
+		}
+		proof := mustCreateJws(t, alg, privateKey, dpopHeader{Type: "dpop+jwt", Alg: alg, Jwk: clientJwk}, dpopPayload{
+			HttpMethod: http.MethodPost,
+			HttpUri:    requestURL,
+			JwtID:      "proof-" + alg,
+			IssuedAt:   time.Now().Unix(),
+		})
+
+		for _, allowedAlgs := range []map[string]struct{}{nil, {"ES256": {}}} {
+			gatewayConfig := serverConfig{
+				AllowedOrigins:  map[string]struct{}{"https://app.example.com": {}},
+				TokenLifetime:   5 * time.Minute,
+				JwtHmacKey:      tokenSigningKey,
+				UpstreamTimeout: 10 * time.Second,
+				DpopAllowedAlgs: allowedAlgs,
+			}
+			request := httptest.NewRequest(http.MethodPost, requestURL, strings.NewReader(`{}`))
+			request.Header.Set("Origin", "https://app.example.com")
+			request.Header.Set(headerAuthorization, "Bearer "+issueTestAccessTokenWithThumbprint(t, tokenSigningKey, "token-"+alg, thumbprint))
+			request.Header.Set(headerDpop, proof)
+
+			recorder := httptest.NewRecorder()
+			handleProtectedProxy(recorder, request, gatewayConfig, testApiRoute, newReplayStore(defaultReplayCacheCapacity), nil, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				writer.WriteHeader(http.StatusNoContent)
+			}))
+			if allowedAlgs == nil && recorder.Code != http.StatusNoContent {
+				t.Fatalf("%s: expected the proof to verify, got %d %s", alg, recorder.Code, recorder.Body.String())
+			}
+			if allowedAlgs != nil && !strings.Contains(recorder.Body.String(), "bad_dpop_header") {
+				t.Fatalf("%s: expected the allowlist to refuse the algorithm, got %d %s", alg, recorder.Code, recorder.Body.String())
+			}
+		}
+	}
+}
+
+func TestHandleTokenIssue_BindsEd25519Keys(t *testing.T) {
+	issueURL := "http://ets.example/tvm/issue"
+	privateKey := mustGenerateEd25519Key(t)
+	clientJwk := testJwkFor(t, privateKey.Public())
+	bodyBytes, marshalErr := json.Marshal(tokenIssueRequest{DpopPublicJwk: clientJwk})
+	if marshalErr != nil {
+		t.Fatalf("json.Marshal: %v", marshalErr)
+	}
+
+	for _, allowedAlgs := range []map[string]struct{}{nil, {"ES256": {}}} {
+		gatewayConfig := newIssueTestConfig()
+		gatewayConfig.DpopAllowedAlgs = allowedAlgs
+		request := httptest.NewRequest(http.MethodPost, issueURL, strings.NewReader(string(bodyBytes)))
+		request.Header.Set("Origin", "https://app.example.com")
+		request.Header.Set(headerDpop, mustCreateJws(t, "EdDSA", privateKey, dpopHeader{Type: "dpop+jwt", Alg: "EdDSA", Jwk: clientJwk}, dpopPayload{
+			HttpMethod: http.MethodPost,
+			HttpUri:    issueURL,
+			JwtID:      "issue-eddsa",
+			IssuedAt:   time.Now().Unix(),
+		}))
+
+		recorder := httptest.NewRecorder()
+		handleTokenIssue(recorder, request, gatewayConfig, issuanceGuard{})
+		if allowedAlgs == nil && recorder.Code != http.StatusOK {
+			t.Fatalf("expected an Ed25519 token, got %d %s", recorder.Code, recorder.Body.String())
+		}
+		if allowedAlgs != nil && !strings.Contains(recorder.Body.String(), "unsupported_jwk") {
+			t.Fatalf("expected an ES256-only allowlist to refuse Ed25519 keys, got %d %s", recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestLoadDpopAllowedAlgs_ValidatesNames(t *testing.T) {
+	t.Setenv(envKeyDpopAllowedAlgs, "")
+	if allowedAlgs, loadErr := loadDpopAllowedAlgs(); loadErr != nil || allowedAlgs != nil {
+		t.Fatalf("expected every algorithm by default, got %v %v", allowedAlgs, loadErr)
+	}
+	t.Setenv(envKeyDpopAllowedAlgs, "ES256, EdDSA")
+	allowedAlgs, loadErr := loadDpopAllowedAlgs()
+	if loadErr != nil || len(allowedAlgs) != 2 {
+		t.Fatalf("expected two algorithms, got %v %v", allowedAlgs, loadErr)
+	}
+	gatewayConfig := serverConfig{DpopAllowedAlgs: allowedAlgs}
+	if !gatewayConfig.dpopAlgorithmAllowed("EdDSA") || gatewayConfig.dpopAlgorithmAllowed("RS256") {
+		t.Fatalf("expected only the listed algorithms to be allowed")
+	}
+	for _, badValue := range []string{"HS256", "none", " , "} {
+		t.Setenv(envKeyDpopAllowedAlgs, badValue)
+		if _, loadErr := loadDpopAllowedAlgs(); loadErr == nil {
+			t.Fatalf("expected %q to be rejected", badValue)
+		}
+	}
+}
+
+func mustGenerateEcKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	privateKey, keyErr := ecdsa.GenerateKey(curve, rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	return privateKey
+}
+
+func mustGenerateEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, privateKey, keyErr := ed25519.GenerateKey(rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", keyErr)
+	}
+	return privateKey
+}
+
+func mustGenerateRsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	privateKey, keyErr := rsa.GenerateKey(rand.Reader, 2048)
+	if keyErr != nil {
+		t.Fatalf("rsa.GenerateKey: %v", keyErr)
+	}
+	return privateKey
+}
+
+// testJwkFor encodes a public key the way a client would send it.
+func testJwkFor(t *testing.T, publicKey crypto.PublicKey) publicJwk {
+	t.Helper()
+	switch typedKey := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		coordinateLength := (typedKey.Curve.Params().BitSize + 7) / 8
+		return publicJwk{
+			KeyType: "EC",
+			Curve:   typedKey.Curve.Params().Name,
+			X:       base64.RawURLEncoding.EncodeToString(typedKey.X.FillBytes(make([]byte, coordinateLength))),
+			Y:       base64.RawURLEncoding.EncodeToString(typedKey.Y.FillBytes(make([]byte, coordinateLength))),
+		}
+	case ed25519.PublicKey:
+		return publicJwk{KeyType: "OKP", Curve: "Ed25519", X: base64.RawURLEncoding.EncodeToString(typedKey)}
+	case *rsa.PublicKey:
+		return publicJwk{
+			KeyType: "RSA",
+			N:       base64.RawURLEncoding.EncodeToString(typedKey.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(typedKey.E)).Bytes()),
+		}
+	default:
+		t.Fatalf("unsupported key %T", publicKey)
+		return publicJwk{}
+	}
+}
+
+// mustSignJws produces the JOSE signature alg defines over signingInput.
+func mustSignJws(t *testing.T, alg string, privateKey crypto.Signer, signingInput []byte) []byte {
+	t.Helper()
+	switch alg {
+	case "EdDSA":
+		return ed25519.Sign(privateKey.(ed25519.PrivateKey), signingInput)
+	case "RS256", "PS256":
+		digest := sha256.Sum256(signingInput)
+		var signature []byte
+		var signErr error
+		if alg == "RS256" {
+			signature, signErr = rsa.SignPKCS1v15(rand.Reader, privateKey.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		} else {
+			signature, signErr = rsa.SignPSS(rand.Reader, privateKey.(*rsa.PrivateKey), crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if signErr != nil {
+			t.Fatalf("rsa sign: %v", signErr)
+		}
+		return signature
+	default:
+		ecdsaKey := privateKey.(*ecdsa.PrivateKey)
+		hash := map[string]crypto.Hash{"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512}[alg]
+		digest := hash.New()
+		digest.Write(signingInput)
+		rValue, sValue, signErr := ecdsa.Sign(rand.Reader, ecdsaKey, digest.Sum(nil))
+		if signErr != nil {
+			t.Fatalf("ecdsa.Sign: %v", signErr)
+		}
+		componentLength := (ecdsaKey.Curve.Params().BitSize + 7) / 8
+		return append(rValue.FillBytes(make([]byte, componentLength)), sValue.FillBytes(make([]byte, componentLength))...)
+	}
+}
+
+func mustCreateJws(t *testing.T, alg string, privateKey crypto.Signer, header dpopHeader, payload dpopPayload) string {
+	t.Helper()
+	headerJSON, headerErr := json.Marshal(header)
+	if headerErr != nil {
+		t.Fatalf("json.Marshal header: %v", headerErr)
+	}
+	payloadJSON, payloadErr := json.Marshal(payload)
+	if payloadErr != nil {
+		t.Fatalf("json.Marshal payload: %v", payloadErr)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(payloadJSON)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mustSignJws(t, alg, privateKey, []byte(signingInput)))
+}
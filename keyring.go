@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	pemBlockPublicKey = "PUBLIC KEY"
+
+	minimumHmacSecretLength = 16
+	defaultKeyringRetain    = 2
+)
+
+// Next is published and verified but never signs, so cached JWKS learn it before promotion.
+type tokenKeyring struct {
+	Current  tokenKey
+	Next     *tokenKey
+	Previous []tokenKey
+}
+
+type keyringFile struct {
+	Current      keyringEntry   `json:"current"`
+	Next         *keyringEntry  `json:"next,omitempty"`
+	NextStagedAt int64          `json:"nextStagedAt,omitempty"`
+	Previous     []keyringEntry `json:"previous,omitempty"`
+}
+
+type keyringEntry struct {
+	KeyID         string `json:"kid,omitempty"`
+	Algorithm     string `json:"alg"`
+	Secret        string `json:"secret,omitempty"`
+	PrivateKeyPem string `json:"privateKeyPem,omitempty"`
+	PublicKeyPem  string `json:"publicKeyPem,omitempty"`
+}
+
+func (keyring tokenKeyring) signClaims(claims jwt.Claims) (string, error) {
+	return keyring.Current.signClaims(claims)
+}
+
+// Tokens without a kid only match a legacy HS256 entry that has none.
+func (keyring tokenKeyring) verificationKeyFor(token *jwt.Token) (interface{}, error) {
+	if tokenType, _ := token.Header[jwtHeaderType].(string); tokenType == identityAssertionTokenType {
+		return nil, fmt.Errorf("unexpected_jwt_typ")
+	}
+	tokenKeyID, _ := token.Header[jwtHeaderKeyID].(string)
+	for _, candidateKey := range keyring.verificationKeys() {
+		if candidateKey.KeyID == tokenKeyID {
+			return candidateKey.verificationKeyFor(token)
+		}
+	}
+	return nil, fmt.Errorf("unknown_jwt_kid")
+}
+
+func (keyring tokenKeyring) verificationKeys() []tokenKey {
+	verificationKeys := []tokenKey{keyring.Current}
+	if keyring.Next != nil {
+		verificationKeys = append(verificationKeys, *keyring.Next)
+	}
+	return append(verificationKeys, keyring.Previous...)
+}
+
+func (keyring tokenKeyring) publicJwks() []publishedJwk {
+	publicKeys := []publishedJwk{}
+	for _, candidateKey := range keyring.verificationKeys() {
+		if publicKey, isPublic := candidateKey.publicJwk(); isPublic {
+			publicKeys = append(publicKeys, publicKey)
+		}
+	}
+	return publicKeys
+}
+
+func (gatewayConfig serverConfig) accessTokenKeyring() tokenKeyring {
+	if gatewayConfig.TokenKeyring != nil {
+		return *gatewayConfig.TokenKeyring
+	}
+	return tokenKeyring{Current: newHmacTokenKey(gatewayConfig.JwtHmacKey)}
+}
+
+func parseKeyringFile(keyringBytes []byte) (tokenKeyring, error) {
+	var storedKeyring keyringFile
+	if unmarshalError := json.Unmarshal(keyringBytes, &storedKeyring); unmarshalError != nil {
+		return tokenKeyring{}, fmt.Errorf("decode keyring: %w", unmarshalError)
+	}
+	currentKey, currentKeyError := storedKeyring.Current.signingKey()
+	if currentKeyError != nil {
+		return tokenKeyring{}, fmt.Errorf("current key: %w", currentKeyError)
+	}
+
+	keyring := tokenKeyring{Current: currentKey}
+	seenKeyIDs := map[string]struct{}{currentKey.KeyID: {}}
+	if storedKeyring.Next != nil {
+		nextKey, nextKeyError := storedKeyring.Next.signingKey()
+		if nextKeyError != nil {
+			return tokenKeyring{}, fmt.Errorf("next key: %w", nextKeyError)
+		}
+		if _, duplicate := seenKeyIDs[nextKey.KeyID]; duplicate {
+			return tokenKeyring{}, fmt.Errorf("duplicate kid %q", nextKey.KeyID)
+		}
+		seenKeyIDs[nextKey.KeyID] = struct{}{}
+		keyring.Next = &nextKey
+	}
+	for entryIndex, previousEntry := range storedKeyring.Previous {
+		previousKey, previousKeyError := previousEntry.verificationKey()
+		if previousKeyError != nil {
+			return tokenKeyring{}, fmt.Errorf("previous key %d: %w", entryIndex, previousKeyError)
+		}
+		if _, duplicate := seenKeyIDs[previousKey.KeyID]; duplicate {
+			return tokenKeyring{}, fmt.Errorf("duplicate kid %q", previousKey.KeyID)
+		}
+		seenKeyIDs[previousKey.KeyID] = struct{}{}
+		keyring.Previous = append(keyring.Previous, previousKey)
+	}
+	return keyring, nil
+}
+
+func (entry keyringEntry) signingKey() (tokenKey, error) {
+	if entry.Algorithm == jwt.SigningMethodHS256.Alg() {
+		return entry.hmacKey()
+	}
+	if entry.PrivateKeyPem == "" {
+		return tokenKey{}, fmt.Errorf("missing privateKeyPem")
+	}
+	parsedKey, parseError := parseTokenSigningKey([]byte(entry.PrivateKeyPem), entry.KeyID)
+	if parseError != nil {
+		return tokenKey{}, parseError
+	}
+	return parsedKey, entry.checkAlgorithm(parsedKey)
+}
+
+func (entry keyringEntry) verificationKey() (tokenKey, error) {
+	if entry.Algorithm == jwt.SigningMethodHS256.Alg() || entry.PrivateKeyPem != "" {
+		return entry.signingKey()
+	}
+	if entry.PublicKeyPem == "" {
+		return tokenKey{}, fmt.Errorf("missing publicKeyPem")
+	}
+	parsedKey, parseError := parseTokenVerificationKey([]byte(entry.PublicKeyPem), entry.KeyID)
+	if parseError != nil {
+		return tokenKey{}, parseError
+	}
+	return parsedKey, entry.checkAlgorithm(parsedKey)
+}
+
+func (entry keyringEntry) hmacKey() (tokenKey, error) {
+	if len(entry.Secret) < minimumHmacSecretLength {
+		return tokenKey{}, fmt.Errorf("weak or missing secret")
+	}
+	hmacKey := newHmacTokenKey([]byte(entry.Secret))
+	hmacKey.KeyID = entry.KeyID
+	return hmacKey, nil
+}
+
+func (entry keyringEntry) checkAlgorithm(parsedKey tokenKey) error {
+	if entry.Algorithm != parsedKey.SigningMethod.Alg() {
+		return fmt.Errorf("alg %q does not match %s key", entry.Algorithm, parsedKey.SigningMethod.Alg())
+	}
+	return nil
+}
+
+func parseTokenVerificationKey(pemBytes []byte, keyID string) (tokenKey, error) {
+	pemBlock, _ := pem.Decode(pemBytes)
+	if pemBlock == nil || pemBlock.Type != pemBlockPublicKey {
+		return tokenKey{}, fmt.Errorf("no %s PEM block found", pemBlockPublicKey)
+	}
+	parsedPublicKey, parseError := x509.ParsePKIXPublicKey(pemBlock.Bytes)
+	if parseError != nil {
+		return tokenKey{}, fmt.Errorf("parse public key: %w", parseError)
+	}
+
+	var verificationKey tokenKey
+	switch typedKey := parsedPublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if typedKey.Curve != elliptic.P256() {
+			return tokenKey{}, fmt.Errorf("unsupported EC curve %s", typedKey.Curve.Params().Name)
+		}
+		verificationKey = tokenKey{SigningMethod: jwt.SigningMethodES256, VerificationKey: typedKey}
+	case ed25519.PublicKey:
+		verificationKey = tokenKey{SigningMethod: jwt.SigningMethodEdDSA, VerificationKey: typedKey}
+	default:
+		return tokenKey{}, fmt.Errorf("unsupported public key type %T", parsedPublicKey)
+	}
+
+	return verificationKey.withKeyID(keyID)
+}
+
+// The new key signs at once, so verifiers with a cached JWKS reject its tokens until their
+// cache expires; stageKeyring and promoteKeyring avoid that.
+func rotateKeyring(existingKeyring keyringFile, algorithm string, keyID string, retainCount int) (keyringFile, error) {
+	nextCurrent, generateError := generateKeyringEntry(algorithm, keyID)
+	if generateError != nil {
+		return keyringFile{}, generateError
+	}
+	return existingKeyring.withCurrent(nextCurrent, retainCount)
+}
+
+func stageKeyring(existingKeyring keyringFile, algorithm string, keyID string) (keyringFile, error) {
+	if existingKeyring.Current.Algorithm == "" {
+		return keyringFile{}, fmt.Errorf("no current key to stage after")
+	}
+	if existingKeyring.Next != nil {
+		return keyringFile{}, fmt.Errorf("kid %q is already staged", existingKeyring.Next.KeyID)
+	}
+	nextEntry, generateError := generateKeyringEntry(algorithm, keyID)
+	if generateError != nil {
+		return keyringFile{}, generateError
+	}
+	stagedKeyring := existingKeyring
+	stagedKeyring.Next = &nextEntry
+	stagedKeyring.NextStagedAt = timeNow().Unix()
+	return stagedKeyring.validated()
+}
+
+func promoteKeyring(existingKeyring keyringFile, retainCount int) (keyringFile, error) {
+	if existingKeyring.Next == nil {
+		return keyringFile{}, fmt.Errorf("no staged key to promote")
+	}
+	if publishedFor := timeNow().Sub(time.Unix(existingKeyring.NextStagedAt, 0)); publishedFor < jwksCacheMaxAge {
+		return keyringFile{}, fmt.Errorf("kid %q staged %s ago; promote after %s so cached JWKS include it", existingKeyring.Next.KeyID, publishedFor.Truncate(time.Second), jwksCacheMaxAge)
+	}
+	nextCurrent := *existingKeyring.Next
+	existingKeyring.Next, existingKeyring.NextStagedAt = nil, 0
+	return existingKeyring.withCurrent(nextCurrent, retainCount)
+}
+
+func (existingKeyring keyringFile) withCurrent(nextCurrent keyringEntry, retainCount int) (keyringFile, error) {
+	nextPrevious := []keyringEntry{}
+	if existingKeyring.Current.Algorithm != "" {
+		demotedEntry, demoteError := existingKeyring.Current.demote()
+		if demoteError != nil {
+			return keyringFile{}, fmt.Errorf("demote current key: %w", demoteError)
+		}
+		nextPrevious = append(nextPrevious, demotedEntry)
+	}
+	nextPrevious = append(nextPrevious, existingKeyring.Previous...)
+	if len(nextPrevious) > retainCount {
+		nextPrevious = nextPrevious[:retainCount]
+	}
+
+	nextKeyring := keyringFile{Current: nextCurrent, Next: existingKeyring.Next, NextStagedAt: existingKeyring.NextStagedAt, Previous: nextPrevious}
+	return nextKeyring.validated()
+}
+
+func (keyring keyringFile) validated() (keyringFile, error) {
+	keyringBytes, marshalError := keyring.marshal()
+	if marshalError != nil {
+		return keyringFile{}, marshalError
+	}
+	if _, validateError := parseKeyringFile(keyringBytes); validateError != nil {
+		return keyringFile{}, fmt.Errorf("validate rotated keyring: %w", validateError)
+	}
+	return keyring, nil
+}
+
+// HS256 secrets are kept because verification needs them.
+func (entry keyringEntry) demote() (keyringEntry, error) {
+	if entry.Algorithm == jwt.SigningMethodHS256.Alg() || entry.PrivateKeyPem == "" {
+		return entry, nil
+	}
+	signingKey, parseError := entry.signingKey()
+	if parseError != nil {
+		return keyringEntry{}, parseError
+	}
+	publicKeyDer, marshalError := x509.MarshalPKIXPublicKey(signingKey.VerificationKey)
+	if marshalError != nil {
+		return keyringEntry{}, marshalError
+	}
+	return keyringEntry{
+		KeyID:        signingKey.KeyID,
+		Algorithm:    entry.Algorithm,
+		PublicKeyPem: string(pem.EncodeToMemory(&pem.Block{Type: pemBlockPublicKey, Bytes: publicKeyDer})),
+	}, nil
+}
+
+func generateKeyringEntry(algorithm string, keyID string) (keyringEntry, error) {
+	var generatedPrivateKey interface{}
+	switch algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		generatedSecret, secretError := generateRandomHex(secretByteLength)
+		if secretError != nil {
+			return keyringEntry{}, secretError
+		}
+		if keyID == "" {
+			generatedKeyID, keyIDError := generateRandomHex(8)
+			if keyIDError != nil {
+				return keyringEntry{}, keyIDError
+			}
+			keyID = generatedKeyID
+		}
+		return keyringEntry{KeyID: keyID, Algorithm: algorithm, Secret: generatedSecret}, nil
+	case jwt.SigningMethodES256.Alg():
+		ecdsaKey, generateError := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if generateError != nil {
+			return keyringEntry{}, fmt.Errorf("generate EC key: %w", generateError)
+		}
+		generatedPrivateKey = ecdsaKey
+	case jwt.SigningMethodEdDSA.Alg():
+		_, ed25519Key, generateError := ed25519.GenerateKey(rand.Reader)
+		if generateError != nil {
+			return keyringEntry{}, fmt.Errorf("generate Ed25519 key: %w", generateError)
+		}
+		generatedPrivateKey = ed25519Key
+	default:
+		return keyringEntry{}, fmt.Errorf("unsupported alg %q", algorithm)
+	}
+
+	privateKeyDer, marshalError := x509.MarshalPKCS8PrivateKey(generatedPrivateKey)
+	if marshalError != nil {
+		return keyringEntry{}, fmt.Errorf("marshal private key: %w", marshalError)
+	}
+	privateKeyPem := string(pem.EncodeToMemory(&pem.Block{Type: pemBlockPrivateKey, Bytes: privateKeyDer}))
+	parsedKey, parseError := parseTokenSigningKey([]byte(privateKeyPem), keyID)
+	if parseError != nil {
+		return keyringEntry{}, parseError
+	}
+	return keyringEntry{KeyID: parsedKey.KeyID, Algorithm: algorithm, PrivateKeyPem: privateKeyPem}, nil
+}
+
+func (keyring keyringFile) marshal() ([]byte, error) {
+	keyringBytes, marshalError := json.MarshalIndent(keyring, "", "  ")
+	if marshalError != nil {
+		return nil, fmt.Errorf("encode keyring: %w", marshalError)
+	}
+	return append(keyringBytes, '\n'), nil
+}
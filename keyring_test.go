@@ -0,0 +1,181 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestRotateKeyring_PreviousKeysStillVerifyLiveTokens(t *testing.T) {
+	firstState, firstErr := rotateKeyring(keyringFile{}, "ES256", "", defaultKeyringRetain)
+	if firstErr != nil {
+		t.Fatalf("rotateKeyring: %v", firstErr)
+	}
+	firstKeyring := mustParseKeyring(t, firstState)
+	liveToken, signErr := firstKeyring.signClaims(jwt.RegisteredClaims{ID: "live-before-rotation"})
+	if signErr != nil {
+		t.Fatalf("signClaims: %v", signErr)
+	}
+
+	secondState, secondErr := rotateKeyring(firstState, "EdDSA", "", defaultKeyringRetain)
+	if secondErr != nil {
+		t.Fatalf("rotateKeyring: %v", secondErr)
+	}
+	if len(secondState.Previous) != 1 || secondState.Previous[0].KeyID != firstState.Current.KeyID {
+		t.Fatalf("expected old current key to be demoted, got %+v", secondState.Previous)
+	}
+	if secondState.Previous[0].PrivateKeyPem != "" || secondState.Previous[0].PublicKeyPem == "" {
+		t.Fatalf("expected demoted key to keep only public material")
+	}
+
+	secondKeyring := mustParseKeyring(t, secondState)
+	if _, verifyErr := jwt.ParseWithClaims(liveToken, &jwt.RegisteredClaims{}, secondKeyring.verificationKeyFor); verifyErr != nil {
+		t.Fatalf("expected token signed before rotation to verify: %v", verifyErr)
+	}
+	rotatedToken, signErr := secondKeyring.signClaims(jwt.RegisteredClaims{ID: "after-rotation"})
+	if signErr != nil {
+		t.Fatalf("signClaims: %v", signErr)
+	}
+	parsedToken, _, parseErr := jwt.NewParser().ParseUnverified(rotatedToken, &jwt.RegisteredClaims{})
+	if parseErr != nil {
+		t.Fatalf("ParseUnverified: %v", parseErr)
+	}
+	if parsedToken.Header["kid"] != secondState.Current.KeyID || parsedToken.Method.Alg() != "EdDSA" {
+		t.Fatalf("expected new tokens to use the new current key, got %v", parsedToken.Header)
+	}
+	if publicKeys := secondKeyring.publicJwks(); len(publicKeys) != 2 {
+		t.Fatalf("expected current and previous keys in JWKS, got %d", len(publicKeys))
+	}
+}
+
+func TestRotateKeyring_DropsKeysBeyondRetention(t *testing.T) {
+	keyringState := keyringFile{}
+	var issuedKeyIDs []string
+	for rotationIndex := 0; rotationIndex < 4; rotationIndex++ {
+		nextState, rotateErr := rotateKeyring(keyringState, "HS256", "", 1)
+		if rotateErr != nil {
+			t.Fatalf("rotateKeyring: %v", rotateErr)
+		}
+		keyringState = nextState
+		issuedKeyIDs = append(issuedKeyIDs, keyringState.Current.KeyID)
+	}
+	if len(keyringState.Previous) != 1 || keyringState.Previous[0].KeyID != issuedKeyIDs[2] {
+		t.Fatalf("expected only the most recent previous key, got %+v", keyringState.Previous)
+	}
+	if keyringState.Previous[0].Secret == "" {
+		t.Fatalf("expected demoted HS256 key to keep its secret for verification")
+	}
+
+	retiredKey, _ := keyringEntry{KeyID: issuedKeyIDs[0], Algorithm: "HS256", Secret: strings.Repeat("r", 32)}.signingKey()
+	retiredToken, signErr := retiredKey.signClaims(jwt.RegisteredClaims{})
+	if signErr != nil {
+		t.Fatalf("signClaims: %v", signErr)
+	}
+	if _, verifyErr := jwt.ParseWithClaims(retiredToken, &jwt.RegisteredClaims{}, mustParseKeyring(t, keyringState).verificationKeyFor); verifyErr == nil {
+		t.Fatalf("expected token from a retired kid to be rejected")
+	}
+}
+
+func TestStageKeyring_PublishesNextKeyWithoutSigning(t *testing.T) {
+	currentTime := stubRateClock(t)
+	firstState, firstErr := rotateKeyring(keyringFile{}, "ES256", "2025-01", defaultKeyringRetain)
+	if firstErr != nil {
+		t.Fatalf("rotateKeyring: %v", firstErr)
+	}
+	stagedState, stageErr := stageKeyring(firstState, "EdDSA", "2025-02")
+	if stageErr != nil {
+		t.Fatalf("stageKeyring: %v", stageErr)
+	}
+	if _, restageErr := stageKeyring(stagedState, "EdDSA", "2025-03"); restageErr == nil {
+		t.Fatalf("expected a second staged key to be refused")
+	}
+
+	stagedKeyring := mustParseKeyring(t, stagedState)
+	publishedKeyIDs := map[string]bool{}
+	for _, publishedKey := range stagedKeyring.publicJwks() {
+		publishedKeyIDs[publishedKey.KeyID] = true
+	}
+	if !publishedKeyIDs["2025-01"] || !publishedKeyIDs["2025-02"] {
+		t.Fatalf("expected current and staged keys in JWKS, got %v", publishedKeyIDs)
+	}
+	stagedToken, signErr := stagedKeyring.signClaims(jwt.RegisteredClaims{ID: "while-staged"})
+	if signErr != nil {
+		t.Fatalf("signClaims: %v", signErr)
+	}
+	parsedToken, _, parseErr := jwt.NewParser().ParseUnverified(stagedToken, &jwt.RegisteredClaims{})
+	if parseErr != nil || parsedToken.Header["kid"] != "2025-01" {
+		t.Fatalf("expected the current key to keep signing, got %v %v", parsedToken.Header, parseErr)
+	}
+
+	if _, earlyErr := promoteKeyring(stagedState, defaultKeyringRetain); earlyErr == nil {
+		t.Fatalf("expected promotion before the JWKS max-age to be refused")
+	}
+	*currentTime = currentTime.Add(jwksCacheMaxAge)
+	promotedState, promoteErr := promoteKeyring(stagedState, defaultKeyringRetain)
+	if promoteErr != nil {
+		t.Fatalf("promoteKeyring: %v", promoteErr)
+	}
+	if promotedState.Current.KeyID != "2025-02" || promotedState.Next != nil || len(promotedState.Previous) != 1 || promotedState.Previous[0].KeyID != "2025-01" {
+		t.Fatalf("unexpected promoted keyring %+v", promotedState)
+	}
+	if _, verifyErr := jwt.ParseWithClaims(stagedToken, &jwt.RegisteredClaims{}, mustParseKeyring(t, promotedState).verificationKeyFor); verifyErr != nil {
+		t.Fatalf("expected tokens signed before promotion to verify: %v", verifyErr)
+	}
+}
+
+func TestParseKeyringFile_AcceptsLegacyKidlessHmacToken(t *testing.T) {
+	legacySecret := "0123456789abcdef0123456789abcdef"
+	legacyToken, signErr := newHmacTokenKey([]byte(legacySecret)).signClaims(jwt.RegisteredClaims{})
+	if signErr != nil {
+		t.Fatalf("signClaims: %v", signErr)
+	}
+
+	nextState, rotateErr := rotateKeyring(keyringFile{Current: keyringEntry{Algorithm: "HS256", Secret: legacySecret}}, "ES256", "", defaultKeyringRetain)
+	if rotateErr != nil {
+		t.Fatalf("rotateKeyring: %v", rotateErr)
+	}
+	if _, verifyErr := jwt.ParseWithClaims(legacyToken, &jwt.RegisteredClaims{}, mustParseKeyring(t, nextState).verificationKeyFor); verifyErr != nil {
+		t.Fatalf("expected kid-less legacy token to verify: %v", verifyErr)
+	}
+}
+
+func TestParseKeyringFile_RejectsInvalidState(t *testing.T) {
+	testCases := map[string]string{
+		"malformed json":      `{"current":`,
+		"missing current key": `{"current":{"alg":"ES256"}}`,
+		"weak hmac secret":    `{"current":{"alg":"HS256","secret":"short"}}`,
+		"duplicate kid":       `{"current":{"kid":"a","alg":"HS256","secret":"0123456789abcdef"},"previous":[{"kid":"a","alg":"HS256","secret":"fedcba9876543210"}]}`,
+	}
+	for testName, keyringJSON := range testCases {
+		if _, parseErr := parseKeyringFile([]byte(keyringJSON)); parseErr == nil {
+			t.Fatalf("%s: expected keyring to be rejected", testName)
+		}
+	}
+
+	esState, rotateErr := rotateKeyring(keyringFile{}, "ES256", "", 0)
+	if rotateErr != nil {
+		t.Fatalf("rotateKeyring: %v", rotateErr)
+	}
+	esState.Current.Algorithm = "EdDSA"
+	keyringBytes, marshalErr := esState.marshal()
+	if marshalErr != nil {
+		t.Fatalf("marshal: %v", marshalErr)
+	}
+	if _, parseErr := parseKeyringFile(keyringBytes); parseErr == nil {
+		t.Fatalf("expected alg/key type mismatch to be rejected")
+	}
+}
+
+func mustParseKeyring(t *testing.T, keyringState keyringFile) tokenKeyring {
+	t.Helper()
+	keyringBytes, marshalErr := keyringState.marshal()
+	if marshalErr != nil {
+		t.Fatalf("marshal: %v", marshalErr)
+	}
+	parsedKeyring, parseErr := parseKeyringFile(keyringBytes)
+	if parseErr != nil {
+		t.Fatalf("parseKeyringFile: %v", parseErr)
+	}
+	return parsedKeyring
+}
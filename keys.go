@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	jwtHeaderKeyID      = "kid"
+	jwtHeaderType       = "typ"
+	jwtDefaultTokenType = "JWT"
+
+	headerCacheControl     = "Cache-Control"
+	pemBlockPrivateKey     = "PRIVATE KEY"
+	pemBlockEcPrivateKey   = "EC PRIVATE KEY"
+	jwkKeyTypeEllipticKey  = "EC"
+	jwkKeyTypeOctetKeyPair = "OKP"
+	jwkCurveP256           = "P-256"
+	jwkCurveEd25519        = "Ed25519"
+	jwkUseSignature        = "sig"
+)
+
+// A staged key must be published for jwksCacheMaxAge before it may sign.
+const jwksCacheMaxAge = 5 * time.Minute
+
+type tokenKey struct {
+	KeyID           string
+	SigningMethod   jwt.SigningMethod
+	SigningKey      interface{}
+	VerificationKey interface{}
+}
+
+type publishedJwk struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+}
+
+type jwkSet struct {
+	Keys []publishedJwk `json:"keys"`
+}
+
+func newHmacTokenKey(secret []byte) tokenKey {
+	return tokenKey{SigningMethod: jwt.SigningMethodHS256, SigningKey: secret, VerificationKey: secret}
+}
+
+// An empty keyID defaults to the RFC 7638 thumbprint of the public key.
+func parseTokenSigningKey(pemBytes []byte, keyID string) (tokenKey, error) {
+	pemBlock, _ := pem.Decode(pemBytes)
+	if pemBlock == nil {
+		return tokenKey{}, fmt.Errorf("no PEM block found")
+	}
+
+	var parsedPrivateKey interface{}
+	switch pemBlock.Type {
+	case pemBlockPrivateKey:
+		pkcs8Key, parsePkcs8Error := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+		if parsePkcs8Error != nil {
+			return tokenKey{}, fmt.Errorf("parse PKCS#8 key: %w", parsePkcs8Error)
+		}
+		parsedPrivateKey = pkcs8Key
+	case pemBlockEcPrivateKey:
+		ecKey, parseEcError := x509.ParseECPrivateKey(pemBlock.Bytes)
+		if parseEcError != nil {
+			return tokenKey{}, fmt.Errorf("parse EC key: %w", parseEcError)
+		}
+		parsedPrivateKey = ecKey
+	default:
+		return tokenKey{}, fmt.Errorf("unsupported PEM block %q", pemBlock.Type)
+	}
+
+	var signingKey tokenKey
+	switch typedKey := parsedPrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		if typedKey.Curve != elliptic.P256() {
+			return tokenKey{}, fmt.Errorf("unsupported EC curve %s", typedKey.Curve.Params().Name)
+		}
+		signingKey = tokenKey{SigningMethod: jwt.SigningMethodES256, SigningKey: typedKey, VerificationKey: &typedKey.PublicKey}
+	case ed25519.PrivateKey:
+		signingKey = tokenKey{SigningMethod: jwt.SigningMethodEdDSA, SigningKey: typedKey, VerificationKey: typedKey.Public()}
+	default:
+		return tokenKey{}, fmt.Errorf("unsupported private key type %T", parsedPrivateKey)
+	}
+
+	return signingKey.withKeyID(keyID)
+}
+
+func (signingKey tokenKey) withKeyID(keyID string) (tokenKey, error) {
+	signingKey.KeyID = keyID
+	if signingKey.KeyID == "" {
+		derivedKeyID, thumbprintError := signingKey.thumbprint()
+		if thumbprintError != nil {
+			return tokenKey{}, thumbprintError
+		}
+		signingKey.KeyID = derivedKeyID
+	}
+	return signingKey, nil
+}
+
+func (signingKey tokenKey) signClaims(claims jwt.Claims) (string, error) {
+	return signingKey.signTypedClaims(claims, jwtDefaultTokenType)
+}
+
+func (signingKey tokenKey) signTypedClaims(claims jwt.Claims, tokenType string) (string, error) {
+	jwtToken := jwt.NewWithClaims(signingKey.SigningMethod, claims)
+	jwtToken.Header[jwtHeaderType] = tokenType
+	if signingKey.KeyID != "" {
+		jwtToken.Header[jwtHeaderKeyID] = signingKey.KeyID
+	}
+	return jwtToken.SignedString(signingKey.SigningKey)
+}
+
+func (signingKey tokenKey) verificationKeyFor(token *jwt.Token) (interface{}, error) {
+	if token.Method == nil || token.Method.Alg() != signingKey.SigningMethod.Alg() {
+		return nil, fmt.Errorf("unexpected_jwt_alg")
+	}
+	tokenKeyID, _ := token.Header[jwtHeaderKeyID].(string)
+	if tokenKeyID != signingKey.KeyID {
+		return nil, fmt.Errorf("unknown_jwt_kid")
+	}
+	return signingKey.VerificationKey, nil
+}
+
+func (signingKey tokenKey) isAsymmetric() bool {
+	_, isPublic := signingKey.publicJwk()
+	return isPublic
+}
+
+// Symmetric keys are never published.
+func (signingKey tokenKey) publicJwk() (publishedJwk, bool) {
+	switch publicKey := signingKey.VerificationKey.(type) {
+	case *ecdsa.PublicKey:
+		return publishedJwk{
+			KeyType:   jwkKeyTypeEllipticKey,
+			Curve:     jwkCurveP256,
+			X:         base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, 32))),
+			Y:         base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, 32))),
+			KeyID:     signingKey.KeyID,
+			Use:       jwkUseSignature,
+			Algorithm: signingKey.SigningMethod.Alg(),
+		}, true
+	case ed25519.PublicKey:
+		return publishedJwk{
+			KeyType:   jwkKeyTypeOctetKeyPair,
+			Curve:     jwkCurveEd25519,
+			X:         base64.RawURLEncoding.EncodeToString(publicKey),
+			KeyID:     signingKey.KeyID,
+			Use:       jwkUseSignature,
+			Algorithm: signingKey.SigningMethod.Alg(),
+		}, true
+	default:
+		return publishedJwk{}, false
+	}
+}
+
+func (signingKey tokenKey) thumbprint() (string, error) {
+	jwkObject, isPublic := signingKey.publicJwk()
+	if !isPublic {
+		return "", fmt.Errorf("thumbprint requires an asymmetric key")
+	}
+	return jwkThumbprint(publicJwk{KeyType: jwkObject.KeyType, Curve: jwkObject.Curve, X: jwkObject.X, Y: jwkObject.Y})
+}
+
+func handleJwks(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, gatewayConfig serverConfig) {
+	if httpRequest.Method != http.MethodGet && httpRequest.Method != http.MethodHead {
+		httpErrorJSON(httpResponseWriter, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	publishedKeys := jwkSet{Keys: gatewayConfig.accessTokenKeyring().publicJwks()}
+	httpResponseWriter.Header().Set(headerContentType, contentTypeJSON)
+	httpResponseWriter.Header().Set(headerCacheControl, "public, max-age="+strconv.Itoa(int(jwksCacheMaxAge.Seconds())))
+	_ = json.NewEncoder(httpResponseWriter).Encode(publishedKeys)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestParseTokenSigningKey_EcdsaPkcs8DerivesThumbprintKeyID(t *testing.T) {
+	privateKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	signingKey, parseErr := parseTokenSigningKey(mustEncodePkcs8Pem(t, privateKey), "")
+	if parseErr != nil {
+		t.Fatalf("parseTokenSigningKey: %v", parseErr)
+	}
+	if signingKey.SigningMethod.Alg() != "ES256" {
+		t.Fatalf("expected ES256, got %s", signingKey.SigningMethod.Alg())
+	}
+
+	expectedThumbprint, thumbErr := jwkThumbprint(publicJwk{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(privateKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(privateKey.Y.FillBytes(make([]byte, 32))),
+	})
+	if thumbErr != nil {
+		t.Fatalf("jwkThumbprint: %v", thumbErr)
+	}
+	if signingKey.KeyID != expectedThumbprint {
+		t.Fatalf("expected kid %s, got %s", expectedThumbprint, signingKey.KeyID)
+	}
+}
+
+func TestParseTokenSigningKey_Sec1AndExplicitKeyID(t *testing.T) {
+	privateKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	sec1Bytes, marshalErr := x509.MarshalECPrivateKey(privateKey)
+	if marshalErr != nil {
+		t.Fatalf("x509.MarshalECPrivateKey: %v", marshalErr)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1Bytes})
+
+	signingKey, parseErr := parseTokenSigningKey(pemBytes, "2025-01")
+	if parseErr != nil {
+		t.Fatalf("parseTokenSigningKey: %v", parseErr)
+	}
+	if signingKey.KeyID != "2025-01" {
+		t.Fatalf("expected explicit kid, got %s", signingKey.KeyID)
+	}
+}
+
+func TestParseTokenSigningKey_RejectsUnsupportedKeys(t *testing.T) {
+	p384Key, keyErr := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	if _, parseErr := parseTokenSigningKey(mustEncodePkcs8Pem(t, p384Key), ""); parseErr == nil {
+		t.Fatalf("expected P-384 signing key to be rejected")
+	}
+	if _, parseErr := parseTokenSigningKey([]byte("not a pem"), ""); parseErr == nil {
+		t.Fatalf("expected garbage input to be rejected")
+	}
+}
+
+func TestTokenKey_EdDsaSignAndVerifyRequiresMatchingKid(t *testing.T) {
+	_, privateKey, keyErr := ed25519.GenerateKey(rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", keyErr)
+	}
+	signingKey, parseErr := parseTokenSigningKey(mustEncodePkcs8Pem(t, privateKey), "")
+	if parseErr != nil {
+		t.Fatalf("parseTokenSigningKey: %v", parseErr)
+	}
+
+	signedToken, signErr := signingKey.signClaims(jwt.RegisteredClaims{ID: "token-eddsa"})
+	if signErr != nil {
+		t.Fatalf("signClaims: %v", signErr)
+	}
+	var parsedClaims jwt.RegisteredClaims
+	if _, verifyErr := jwt.ParseWithClaims(signedToken, &parsedClaims, signingKey.verificationKeyFor); verifyErr != nil {
+		t.Fatalf("expected token to verify: %v", verifyErr)
+	}
+
+	otherKey := signingKey
+	otherKey.KeyID = "other"
+	if _, verifyErr := jwt.ParseWithClaims(signedToken, &jwt.RegisteredClaims{}, otherKey.verificationKeyFor); verifyErr == nil {
+		t.Fatalf("expected kid mismatch to be rejected")
+	}
+
+	hmacToken, hmacErr := newHmacTokenKey([]byte("0123456789abcdef0123456789abcdef")).signClaims(jwt.RegisteredClaims{})
+	if hmacErr != nil {
+		t.Fatalf("signClaims: %v", hmacErr)
+	}
+	if _, verifyErr := jwt.ParseWithClaims(hmacToken, &jwt.RegisteredClaims{}, signingKey.verificationKeyFor); verifyErr == nil {
+		t.Fatalf("expected HS256 token to be rejected by EdDSA key")
+	}
+}
+
+func TestHandleJwks_PublishesAsymmetricKeyUsableForVerification(t *testing.T) {
+	privateKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	signingKey, parseErr := parseTokenSigningKey(mustEncodePkcs8Pem(t, privateKey), "")
+	if parseErr != nil {
+		t.Fatalf("parseTokenSigningKey: %v", parseErr)
+	}
+	gatewayConfig := serverConfig{
+		AllowedOrigins: map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:  5 * time.Minute,
+		TokenKeyring:   &tokenKeyring{Current: signingKey},
+	}
+
+	issueRecorder := httptest.NewRecorder()
+	handleTokenIssue(issueRecorder, newIssueTokenRequest(t, "192.0.2.1:1234"), gatewayConfig, issuanceGuard{})
+	if issueRecorder.Code != http.StatusOK {
+		t.Fatalf("expected 200 from issuance, got %d", issueRecorder.Code)
+	}
+	var issued tokenIssueResponse
+	if decodeErr := json.NewDecoder(issueRecorder.Body).Decode(&issued); decodeErr != nil {
+		t.Fatalf("Decode issuance: %v", decodeErr)
+	}
+
+	jwksRecorder := httptest.NewRecorder()
+	handleJwks(jwksRecorder, httptest.NewRequest(http.MethodGet, "http://ets.example/.well-known/jwks.json", nil), gatewayConfig)
+	if jwksRecorder.Code != http.StatusOK {
+		t.Fatalf("expected 200 from JWKS, got %d", jwksRecorder.Code)
+	}
+	var publishedKeys jwkSet
+	if decodeErr := json.NewDecoder(jwksRecorder.Body).Decode(&publishedKeys); decodeErr != nil {
+		t.Fatalf("Decode JWKS: %v", decodeErr)
+	}
+	if len(publishedKeys.Keys) != 1 {
+		t.Fatalf("expected one published key, got %d", len(publishedKeys.Keys))
+	}
+	publishedKey := publishedKeys.Keys[0]
+	if publishedKey.KeyID != signingKey.KeyID || publishedKey.Algorithm != "ES256" || publishedKey.Use != "sig" {
+		t.Fatalf("unexpected published key: %+v", publishedKey)
+	}
+
+	// Verify the issued token the way an upstream would: using only the JWKS entry.
+	xBytes, _ := base64.RawURLEncoding.DecodeString(publishedKey.X)
+	yBytes, _ := base64.RawURLEncoding.DecodeString(publishedKey.Y)
+	upstreamKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}
+	parsedToken, verifyErr := jwt.ParseWithClaims(issued.AccessToken, &accessClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["kid"] != publishedKey.KeyID {
+			t.Fatalf("expected kid header %s, got %v", publishedKey.KeyID, token.Header["kid"])
+		}
+		return upstreamKey, nil
+	}, jwt.WithValidMethods([]string{"ES256"}))
+	if verifyErr != nil || !parsedToken.Valid {
+		t.Fatalf("expected issued token to verify against JWKS key: %v", verifyErr)
+	}
+}
+
+func TestHandleJwks_OmitsSymmetricKeys(t *testing.T) {
+	gatewayConfig := serverConfig{JwtHmacKey: []byte("0123456789abcdef0123456789abcdef")}
+	recorder := httptest.NewRecorder()
+	handleJwks(recorder, httptest.NewRequest(http.MethodGet, "http://ets.example/.well-known/jwks.json", nil), gatewayConfig)
+
+	var publishedKeys jwkSet
+	if decodeErr := json.NewDecoder(recorder.Body).Decode(&publishedKeys); decodeErr != nil {
+		t.Fatalf("Decode JWKS: %v", decodeErr)
+	}
+	if len(publishedKeys.Keys) != 0 {
+		t.Fatalf("expected HS256 secret to stay private, got %+v", publishedKeys.Keys)
+	}
+}
+
+func mustEncodePkcs8Pem(t *testing.T, privateKey interface{}) []byte {
+	t.Helper()
+	pkcs8Bytes, marshalErr := x509.MarshalPKCS8PrivateKey(privateKey)
+	if marshalErr != nil {
+		t.Fatalf("x509.MarshalPKCS8PrivateKey: %v", marshalErr)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Bytes})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	originRegexPrefix     = "~"
+	originWildcardLabel   = "*."
+	originPortRangeMarker = "-"
+)
+
+// originPattern is a *.subdomain wildcard, a port range, or a "~" regular expression.
+type originPattern struct {
+	Scheme         string
+	Host           string
+	WildcardSuffix string
+	PortLow        int
+	PortHigh       int
+	Expression     *regexp.Regexp
+}
+
+func parseOriginAllowlist(originEntries []string) (map[string]struct{}, []originPattern, error) {
+	exactOrigins := make(map[string]struct{})
+	var originPatterns []originPattern
+	for _, originEntry := range originEntries {
+		trimmed := strings.TrimSpace(originEntry)
+		if trimmed == "" {
+			continue
+		}
+		if !strings.HasPrefix(trimmed, originRegexPrefix) && !strings.Contains(trimmed, "*") && !hasPortRange(trimmed) {
+			exactOrigins[trimmed] = struct{}{}
+			continue
+		}
+		parsedPattern, patternError := parseOriginPattern(trimmed)
+		if patternError != nil {
+			return nil, nil, fmt.Errorf("origin %q: %w", trimmed, patternError)
+		}
+		originPatterns = append(originPatterns, parsedPattern)
+	}
+	return exactOrigins, originPatterns, nil
+}
+
+func hasPortRange(originEntry string) bool {
+	lastColon := strings.LastIndex(originEntry, ":")
+	return lastColon > len("https:") && strings.Contains(originEntry[lastColon:], originPortRangeMarker)
+}
+
+func parseOriginPattern(originEntry string) (originPattern, error) {
+	if strings.HasPrefix(originEntry, originRegexPrefix) {
+		expression, compileError := regexp.Compile("^(?:" + strings.TrimPrefix(originEntry, originRegexPrefix) + ")$")
+		if compileError != nil {
+			return originPattern{}, fmt.Errorf("bad regex: %w", compileError)
+		}
+		return originPattern{Expression: expression}, nil
+	}
+
+	scheme, hostAndPort, hasScheme := strings.Cut(originEntry, "://")
+	if !hasScheme || (scheme != "http" && scheme != "https") || strings.Contains(hostAndPort, "/") {
+		return originPattern{}, fmt.Errorf("must look like scheme://host[:port]")
+	}
+	parsedPattern := originPattern{Scheme: scheme}
+	hostPart, portPart, hasPort, hostError := splitOriginHostPort(hostAndPort)
+	if hostError != nil {
+		return originPattern{}, hostError
+	}
+	if hasPort {
+		portLow, portHigh, portError := parsePortRange(portPart)
+		if portError != nil {
+			return originPattern{}, portError
+		}
+		parsedPattern.PortLow, parsedPattern.PortHigh = portLow, portHigh
+	}
+	hostPart = strings.ToLower(hostPart)
+	if strings.HasPrefix(hostPart, originWildcardLabel) {
+		parsedPattern.WildcardSuffix = strings.TrimPrefix(hostPart, "*")
+		hostPart = strings.TrimPrefix(parsedPattern.WildcardSuffix, ".")
+	} else {
+		parsedPattern.Host = hostPart
+	}
+	if hostPart == "" || strings.Contains(hostPart, "*") {
+		return originPattern{}, fmt.Errorf("wildcards are only allowed as the leftmost label")
+	}
+	// a wildcard directly under a public suffix would admit arbitrary sites
+	if parsedPattern.WildcardSuffix != "" && !strings.Contains(hostPart, ".") {
+		return originPattern{}, fmt.Errorf("wildcard needs at least two labels after it")
+	}
+	return parsedPattern, nil
+}
+
+// IPv6 hosts come back without brackets, as url.URL.Hostname reports them.
+func splitOriginHostPort(hostAndPort string) (string, string, bool, error) {
+	if bracketedHost, hasBracket := strings.CutPrefix(hostAndPort, "["); hasBracket {
+		ipv6Host, afterHost, closed := strings.Cut(bracketedHost, "]")
+		hostAddress, addressError := netip.ParseAddr(ipv6Host)
+		if !closed || addressError != nil || !hostAddress.Is6() {
+			return "", "", false, fmt.Errorf("bad IPv6 host %q", hostAndPort)
+		}
+		if afterHost == "" {
+			return ipv6Host, "", false, nil
+		}
+		portPart, hasPort := strings.CutPrefix(afterHost, ":")
+		if !hasPort {
+			return "", "", false, fmt.Errorf("bad IPv6 host %q", hostAndPort)
+		}
+		return ipv6Host, portPart, true, nil
+	}
+	hostPart, portPart, hasPort := strings.Cut(hostAndPort, ":")
+	if strings.Contains(portPart, ":") {
+		return "", "", false, fmt.Errorf("IPv6 hosts must be bracketed, e.g. http://[::1]:3000")
+	}
+	return hostPart, portPart, hasPort, nil
+}
+
+func parsePortRange(portPart string) (int, int, error) {
+	lowText, highText, isRange := strings.Cut(portPart, originPortRangeMarker)
+	if !isRange {
+		highText = lowText
+	}
+	portLow, lowError := strconv.Atoi(lowText)
+	portHigh, highError := strconv.Atoi(highText)
+	if lowError != nil || highError != nil || portLow < 1 || portHigh > 65535 || portLow > portHigh {
+		return 0, 0, fmt.Errorf("bad port or port range %q", portPart)
+	}
+	return portLow, portHigh, nil
+}
+
+func (pattern originPattern) matches(origin string) bool {
+	if pattern.Expression != nil {
+		return pattern.Expression.MatchString(origin)
+	}
+	parsedOrigin, parseError := url.Parse(origin)
+	if parseError != nil || parsedOrigin.Scheme != pattern.Scheme || parsedOrigin.Path != "" || parsedOrigin.RawQuery != "" || parsedOrigin.User != nil {
+		return false
+	}
+	if !pattern.portMatches(parsedOrigin.Port()) {
+		return false
+	}
+	originHost := strings.ToLower(parsedOrigin.Hostname())
+	if pattern.WildcardSuffix == "" {
+		return originHost == pattern.Host
+	}
+	subdomainLabel, hasSuffix := strings.CutSuffix(originHost, pattern.WildcardSuffix)
+	return hasSuffix && subdomainLabel != "" && !strings.Contains(subdomainLabel, ".")
+}
+
+func (pattern originPattern) portMatches(originPort string) bool {
+	if pattern.PortLow == 0 {
+		return originPort == ""
+	}
+	portNumber, portError := strconv.Atoi(originPort)
+	return portError == nil && portNumber >= pattern.PortLow && portNumber <= pattern.PortHigh
+}
+
+func originAllowed(origin string, allowedOrigins map[string]struct{}, originPatterns []originPattern) bool {
+	if _, isAllowed := allowedOrigins[origin]; isAllowed {
+		return true
+	}
+	if origin == "" {
+		return false
+	}
+	for _, pattern := range originPatterns {
+		if pattern.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseOriginAllowlist_MatchesPatterns(t *testing.T) {
+	exactOrigins, originPatterns, parseErr := parseOriginAllowlist([]string{
+		"https://app.example.com",
+		" https://*.preview.example.com ",
+		"http://localhost:3000-3999",
+		`~https://pr-[0-9]+\.review\.example\.org`,
+	})
+	if parseErr != nil {
+		t.Fatalf("parseOriginAllowlist: %v", parseErr)
+	}
+	if len(exactOrigins) != 1 || len(originPatterns) != 3 {
+		t.Fatalf("expected one exact origin and three patterns, got %v / %d", exactOrigins, len(originPatterns))
+	}
+
+	testCases := map[string]bool{
+		"https://app.example.com":               true,
+		"https://pr-123.preview.example.com":    true,
+		"https://PR-9.Preview.Example.com":      true,
+		"https://preview.example.com":           false,
+		"https://a.b.preview.example.com":       false,
+		"http://pr-123.preview.example.com":     false,
+		"https://pr-1.preview.example.com:8443": false,
+		"https://evilpreview.example.com":       false,
+		"http://localhost:3000":                 true,
+		"http://localhost:3999":                 true,
+		"http://localhost:4000":                 false,
+		"http://localhost":                      false,
+		"https://pr-42.review.example.org":      true,
+		"https://pr-42.review.example.org.evil": false,
+		"":                                      false,
+	}
+	for origin, wantAllowed := range testCases {
+		if gotAllowed := originAllowed(origin, exactOrigins, originPatterns); gotAllowed != wantAllowed {
+			t.Fatalf("%q: expected allowed=%v, got %v", origin, wantAllowed, gotAllowed)
+		}
+	}
+}
+
+func TestParseOriginAllowlist_MatchesIPv6PortRange(t *testing.T) {
+	exactOrigins, originPatterns, parseErr := parseOriginAllowlist([]string{"http://[::1]:3000-3999", "http://[::1]:8080"})
+	if parseErr != nil {
+		t.Fatalf("parseOriginAllowlist: %v", parseErr)
+	}
+	if len(originPatterns) != 1 || originPatterns[0].Host != "::1" || originPatterns[0].PortLow != 3000 || originPatterns[0].PortHigh != 3999 {
+		t.Fatalf("unexpected IPv6 pattern %+v", originPatterns)
+	}
+	testCases := map[string]bool{
+		"http://[::1]:3000":  true,
+		"http://[::1]:3999":  true,
+		"http://[::1]:8080":  true,
+		"http://[::1]:4000":  false,
+		"http://[::2]:3000":  false,
+		"https://[::1]:3000": false,
+		"http://[::1]":       false,
+	}
+	for origin, wantAllowed := range testCases {
+		if gotAllowed := originAllowed(origin, exactOrigins, originPatterns); gotAllowed != wantAllowed {
+			t.Fatalf("%q: expected allowed=%v, got %v", origin, wantAllowed, gotAllowed)
+		}
+	}
+	for _, originEntry := range []string{"http://[::1:3000-3999", "http://[localhost]:3000-3999", "http://[::1]3000-3999", "http://::1:3000-3999"} {
+		if _, _, parseErr := parseOriginAllowlist([]string{originEntry}); parseErr == nil {
+			t.Fatalf("expected %q to be rejected", originEntry)
+		}
+	}
+}
+
+func TestParseOriginAllowlist_RejectsUnsafePatterns(t *testing.T) {
+	for _, originEntry := range []string{
+		"*",
+		"https://*.com",
+		"https://app.*.example.com",
+		"https://*.example.com/path",
+		"http://localhost:4000-3000",
+		"http://localhost:0-80",
+		"~https://(unclosed",
+	} {
+		if _, _, parseErr := parseOriginAllowlist([]string{originEntry}); parseErr == nil {
+			t.Fatalf("expected %q to be rejected", originEntry)
+		}
+	}
+}
+
+func TestCheckOrigin_AcceptsPatternMatchAndEchoesOrigin(t *testing.T) {
+	exactOrigins, originPatterns, parseErr := parseOriginAllowlist([]string{"https://*.preview.example.com"})
+	if parseErr != nil {
+		t.Fatalf("parseOriginAllowlist: %v", parseErr)
+	}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "http://ets.example/tvm/issue", nil)
+	request.Header.Set("Origin", "https://pr-7.preview.example.com")
+	if !checkOrigin(recorder, request, exactOrigins, originPatterns...) {
+		t.Fatalf("expected the preview origin to be allowed")
+	}
+	if recorder.Header().Get(headerAccessControlAllowOrigin) != "https://pr-7.preview.example.com" {
+		t.Fatalf("expected the concrete origin to be echoed, got %q", recorder.Header().Get(headerAccessControlAllowOrigin))
+	}
+}
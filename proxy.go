@@ -4,11 +4,20 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 )
 
-func expectedHtu(httpRequest *http.Request) string {
+// expectedHtu rebuilds the URL the client addressed. Once TRUSTED_PROXIES is set, the forwarded
+// scheme is believed only from a peer inside it.
+func expectedHtu(httpRequest *http.Request, trustedProxies ...netip.Prefix) string {
 	protoHeaderValue := strings.ToLower(strings.TrimSpace(httpRequest.Header.Get(forwardedProtoHeader)))
+	if len(trustedProxies) > 0 {
+		protoHeaderValue = ""
+		if peerTrusted(httpRequest, trustedProxies) {
+			protoHeaderValue = forwardedProto(httpRequest.Header)
+		}
+	}
 	scheme := "http"
 	if protoHeaderValue == "https" || httpRequest.TLS != nil {
 		scheme = "https"
@@ -34,9 +43,9 @@ func httpErrorJSON(httpResponseWriter http.ResponseWriter, statusCode int, error
 	_, _ = httpResponseWriter.Write([]byte(fmt.Sprintf("{\"error\":\"%s\"}", errorCode)))
 }
 
-func checkOrigin(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, allowedOrigins map[string]struct{}) bool {
+func checkOrigin(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, allowedOrigins map[string]struct{}, originPatterns ...originPattern) bool {
 	originHeader := httpRequest.Header.Get("Origin")
-	if _, isAllowed := allowedOrigins[originHeader]; !isAllowed {
+	if !originAllowed(originHeader, allowedOrigins, originPatterns) {
 		httpErrorJSON(httpResponseWriter, http.StatusForbidden, "origin_not_allowed")
 		return false
 	}
@@ -47,10 +56,10 @@ func checkOrigin(httpResponseWriter http.ResponseWriter, httpRequest *http.Reque
 	return true
 }
 
-func rateKey(remoteAddress string, originHeader string) string {
+func clientIP(remoteAddress string) string {
 	hostPart, _, splitError := net.SplitHostPort(remoteAddress)
 	if splitError != nil {
 		hostPart = remoteAddress
 	}
-	return originHeader + "|" + hostPart
+	return hostPart
 }
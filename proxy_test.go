@@ -16,6 +16,35 @@ func TestExpectedHtu_UsesXForwardedProto(t *testing.T) {
 	}
 }
 
+func TestExpectedHtu_HonoursForwardedProtoFromTrustedProxy(t *testing.T) {
+	trustedProxies, parseErr := parseTrustedProxies("10.0.0.0/8")
+	if parseErr != nil {
+		t.Fatalf("parseTrustedProxies: %v", parseErr)
+	}
+	for headerName, headerValue := range map[string]string{forwardedProtoHeader: "https", headerForwarded: "for=203.0.113.7;proto=HTTPS"} {
+		request := httptest.NewRequest("POST", "http://api.example.com/api", nil)
+		request.RemoteAddr = "10.0.0.5:4000"
+		request.Header.Set(headerName, headerValue)
+		if got := expectedHtu(request, trustedProxies...); got != "https://api.example.com/api" {
+			t.Fatalf("%s: expected the trusted proxy's scheme, got %s", headerName, got)
+		}
+	}
+}
+
+func TestExpectedHtu_IgnoresForwardedProtoFromUntrustedPeer(t *testing.T) {
+	trustedProxies, parseErr := parseTrustedProxies("10.0.0.0/8")
+	if parseErr != nil {
+		t.Fatalf("parseTrustedProxies: %v", parseErr)
+	}
+	request := httptest.NewRequest("POST", "http://api.example.com/api", nil)
+	request.RemoteAddr = "203.0.113.7:4000"
+	request.Header.Set(forwardedProtoHeader, "https")
+	request.Header.Set(headerForwarded, "proto=https")
+	if got := expectedHtu(request, trustedProxies...); got != "http://api.example.com/api" {
+		t.Fatalf("expected an untrusted peer's scheme to be ignored, got %s", got)
+	}
+}
+
 func TestCheckOrigin_AllowsExactOriginAndSetsCors(t *testing.T) {
 	allowed := map[string]struct{}{"https://app.example.com": {}}
 	rec := httptest.NewRecorder()
@@ -1,49 +1,348 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
-type replayStore struct {
-	mutex sync.Mutex
-	seen  map[string]int64
+const (
+	envKeyRateLimitAlgorithm = "RATE_LIMIT_ALGORITHM"
+	envKeyRateLimitRate      = "RATE_LIMIT_RATE"
+	envKeyRateLimitBurst     = "RATE_LIMIT_BURST"
+
+	rateAlgorithmFixedWindow   = "fixed_window"
+	rateAlgorithmTokenBucket   = "token_bucket"
+	rateAlgorithmSlidingWindow = "sliding_window"
+	rateAlgorithmGcra          = "gcra"
+
+	rateLimitWindow          = time.Minute
+	rateLimiterSweepInterval = time.Minute
+)
+
+type rateLimiter interface {
+	decide(bucketKey string) rateDecision
 }
 
-func (store *replayStore) mark(proofID string, expirationTime time.Time) bool {
-	store.mutex.Lock()
-	defer store.mutex.Unlock()
-	currentUnix := time.Now().Unix()
-	for cachedID, cachedExp := range store.seen {
-		if cachedExp <= currentUnix {
-			delete(store.seen, cachedID)
+// Reset is how long until the quota is fully available again.
+type rateDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+	Window     time.Duration
+}
+
+// tighter keeps the decision that leaves the client less room.
+func (decision rateDecision) tighter(other rateDecision) rateDecision {
+	switch {
+	case other.Limit == 0:
+		return decision
+	case decision.Limit == 0:
+		return other
+	case decision.Allowed != other.Allowed:
+		if !other.Allowed {
+			return other
 		}
+		return decision
+	case other.Remaining < decision.Remaining:
+		return other
 	}
-	if _, exists := store.seen[proofID]; exists {
-		return false
-	}
-	store.seen[proofID] = expirationTime.Unix()
-	return true
+	return decision
+}
+
+// Zero RatePerMinute falls back to RATE_LIMIT_PER_MINUTE; a zero Window is one minute.
+type rateLimitSettings struct {
+	Algorithm     string
+	RatePerMinute float64
+	Window        time.Duration
+	Burst         int
+	Backend       string
+	FailureMode   string
+	Redis         *redisClient
 }
 
 type windowLimiter struct {
-	mutex        sync.Mutex
-	windowEnd    int64
-	counts       map[string]int
-	perMinuteCap int
+	mutex         sync.Mutex
+	windowEnd     int64
+	windowSeconds int64
+	counts        map[string]int
+	perMinuteCap  int
 }
 
 func (limiter *windowLimiter) allow(bucketKey string) bool {
+	return limiter.decide(bucketKey).Allowed
+}
+
+func (limiter *windowLimiter) decide(bucketKey string) rateDecision {
 	limiter.mutex.Lock()
 	defer limiter.mutex.Unlock()
-	currentUnix := time.Now().Unix()
+	currentUnix := timeNow().Unix()
+	windowSeconds := limiter.windowSeconds
+	if windowSeconds <= 0 {
+		windowSeconds = int64(rateLimitWindow.Seconds())
+	}
 	if currentUnix >= limiter.windowEnd {
-		limiter.windowEnd = currentUnix + 60
+		limiter.windowEnd = currentUnix + windowSeconds
 		limiter.counts = make(map[string]int)
 	}
+	decision := rateDecision{
+		Limit:  limiter.perMinuteCap,
+		Reset:  time.Duration(limiter.windowEnd-currentUnix) * time.Second,
+		Window: time.Duration(windowSeconds) * time.Second,
+	}
 	if limiter.counts[bucketKey] >= limiter.perMinuteCap {
-		return false
+		decision.RetryAfter = decision.Reset
+		return decision
 	}
 	limiter.counts[bucketKey] = limiter.counts[bucketKey] + 1
-	return true
+	decision.Allowed = true
+	decision.Remaining = limiter.perMinuteCap - limiter.counts[bucketKey]
+	return decision
+}
+
+// A missing key is an idle client, so each algorithm's zero State must behave that way.
+type keyedLimiter[State any] struct {
+	mutex     sync.Mutex
+	states    map[string]*State
+	nextSweep time.Time
+	admit     func(state *State, currentTime time.Time) rateDecision
+	expired   func(state *State, currentTime time.Time) bool
+}
+
+func newKeyedLimiter[State any](admit func(*State, time.Time) rateDecision, expired func(*State, time.Time) bool) *keyedLimiter[State] {
+	return &keyedLimiter[State]{states: make(map[string]*State), admit: admit, expired: expired}
+}
+
+func (limiter *keyedLimiter[State]) allow(bucketKey string) bool {
+	return limiter.decide(bucketKey).Allowed
+}
+
+func (limiter *keyedLimiter[State]) decide(bucketKey string) rateDecision {
+	currentTime := timeNow()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if !currentTime.Before(limiter.nextSweep) {
+		for stateKey, state := range limiter.states {
+			if limiter.expired(state, currentTime) {
+				delete(limiter.states, stateKey)
+			}
+		}
+		limiter.nextSweep = currentTime.Add(rateLimiterSweepInterval)
+	}
+	state, exists := limiter.states[bucketKey]
+	if !exists {
+		state = new(State)
+		limiter.states[bucketKey] = state
+	}
+	return limiter.admit(state, currentTime)
+}
+
+func (limiter *keyedLimiter[State]) trackedKeys() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return len(limiter.states)
+}
+
+// Tokens spent rather than left, so the zero value is a full bucket.
+type tokenBucketState struct {
+	spent     float64
+	updatedAt time.Time
+}
+
+func newTokenBucketLimiter(ratePerMinute float64, burst int) *keyedLimiter[tokenBucketState] {
+	refillPerSecond := ratePerMinute / rateLimitWindow.Seconds()
+	capacity := float64(burst)
+	secondsFor := func(tokens float64) time.Duration {
+		return time.Duration(tokens / refillPerSecond * float64(time.Second))
+	}
+	refill := func(state *tokenBucketState, currentTime time.Time) {
+		if !state.updatedAt.IsZero() {
+			state.spent = math.Max(0, state.spent-currentTime.Sub(state.updatedAt).Seconds()*refillPerSecond)
+		}
+		state.updatedAt = currentTime
+	}
+	return newKeyedLimiter(
+		func(state *tokenBucketState, currentTime time.Time) rateDecision {
+			refill(state, currentTime)
+			decision := rateDecision{Limit: burst, Window: secondsFor(capacity)}
+			if state.spent+1 > capacity {
+				decision.RetryAfter = secondsFor(state.spent + 1 - capacity)
+			} else {
+				state.spent++
+				decision.Allowed = true
+			}
+			decision.Remaining = int(math.Floor(capacity - state.spent))
+			decision.Reset = secondsFor(state.spent)
+			return decision
+		},
+		func(state *tokenBucketState, currentTime time.Time) bool {
+			refill(state, currentTime)
+			return state.spent == 0
+		},
+	)
+}
+
+type slidingWindowState struct {
+	windowStart   time.Time
+	currentCount  float64
+	previousCount float64
+}
+
+// The previous window's count is weighted by how much of it still overlaps the trailing window.
+func newSlidingWindowLimiter(windowLimit float64, window time.Duration) *keyedLimiter[slidingWindowState] {
+	advance := func(state *slidingWindowState, currentTime time.Time) {
+		elapsedWindows := currentTime.Sub(state.windowStart) / window
+		switch {
+		case state.windowStart.IsZero() || elapsedWindows >= 2:
+			state.previousCount, state.currentCount = 0, 0
+			state.windowStart = currentTime.Truncate(window)
+		case elapsedWindows == 1:
+			state.previousCount, state.currentCount = state.currentCount, 0
+			state.windowStart = state.windowStart.Add(window)
+		}
+	}
+	return newKeyedLimiter(
+		func(state *slidingWindowState, currentTime time.Time) rateDecision {
+			advance(state, currentTime)
+			elapsed := currentTime.Sub(state.windowStart)
+			overlap := 1 - float64(elapsed)/float64(window)
+			// Requests in the current window keep counting, at a falling weight, through the next one.
+			decision := rateDecision{
+				Limit:  int(windowLimit),
+				Reset:  2*window - elapsed,
+				Window: window,
+			}
+			if state.previousCount*overlap+state.currentCount+1 > windowLimit {
+				// The weighted previous count shrinks linearly; if the current window alone is
+				// already full, the earliest chance is the next window.
+				decision.RetryAfter = window - elapsed
+				if headroom := windowLimit - state.currentCount - 1; headroom >= 0 && state.previousCount > 0 {
+					decision.RetryAfter = time.Duration((1-headroom/state.previousCount)*float64(window)) - elapsed
+				}
+				decision.RetryAfter = max(decision.RetryAfter, time.Second)
+				return decision
+			}
+			state.currentCount++
+			decision.Allowed = true
+			decision.Remaining = int(math.Max(0, math.Floor(windowLimit-state.previousCount*overlap-state.currentCount)))
+			return decision
+		},
+		func(state *slidingWindowState, currentTime time.Time) bool {
+			return currentTime.Sub(state.windowStart) >= 2*window
+		},
+	)
+}
+
+type gcraState struct {
+	theoreticalArrival time.Time
+}
+
+func newGcraLimiter(ratePerMinute float64, burst int) *keyedLimiter[gcraState] {
+	emissionInterval := time.Duration(float64(rateLimitWindow) / ratePerMinute)
+	burstTolerance := time.Duration(burst-1) * emissionInterval
+	return newKeyedLimiter(
+		func(state *gcraState, currentTime time.Time) rateDecision {
+			theoreticalArrival := state.theoreticalArrival
+			if theoreticalArrival.Before(currentTime) {
+				theoreticalArrival = currentTime
+			}
+			decision := rateDecision{Limit: burst, Window: time.Duration(burst) * emissionInterval}
+			if allowedAt := theoreticalArrival.Add(-burstTolerance); currentTime.Before(allowedAt) {
+				decision.RetryAfter = allowedAt.Sub(currentTime)
+				decision.Reset = theoreticalArrival.Sub(currentTime)
+				return decision
+			}
+			state.theoreticalArrival = theoreticalArrival.Add(emissionInterval)
+			decision.Allowed = true
+			decision.Remaining = int((currentTime.Add(burstTolerance).Sub(state.theoreticalArrival))/emissionInterval) + 1
+			decision.Remaining = max(decision.Remaining, 0)
+			decision.Reset = state.theoreticalArrival.Sub(currentTime)
+			return decision
+		},
+		func(state *gcraState, currentTime time.Time) bool {
+			return !state.theoreticalArrival.After(currentTime)
+		},
+	)
+}
+
+// With the redis backend the in-process limiter becomes the fallback.
+func newRateLimiter(gatewayConfig serverConfig, scope string) rateLimiter {
+	ratePerMinute := gatewayConfig.RateLimit.RatePerMinute
+	if ratePerMinute <= 0 {
+		ratePerMinute = float64(gatewayConfig.RateLimitPerMinute)
+	}
+	window := gatewayConfig.RateLimit.Window
+	if window <= 0 {
+		window = rateLimitWindow
+	}
+	// windowLimit is what one window admits: 1000/h allows 1000 per hour, not 16 per minute.
+	windowLimit := math.Max(1, math.Round(ratePerMinute*window.Minutes()))
+	burst := gatewayConfig.RateLimit.Burst
+	if burst <= 0 {
+		burst = int(windowLimit)
+	}
+	var localLimiter rateLimiter
+	switch gatewayConfig.RateLimit.Algorithm {
+	case rateAlgorithmTokenBucket:
+		localLimiter = newTokenBucketLimiter(ratePerMinute, burst)
+	case rateAlgorithmSlidingWindow:
+		localLimiter = newSlidingWindowLimiter(windowLimit, window)
+	case rateAlgorithmGcra:
+		localLimiter = newGcraLimiter(ratePerMinute, burst)
+	default:
+		localLimiter = &windowLimiter{
+			windowEnd:     timeNow().Unix() + int64(window.Seconds()),
+			windowSeconds: int64(window.Seconds()),
+			counts:        make(map[string]int),
+			perMinuteCap:  int(windowLimit),
+		}
+	}
+	if gatewayConfig.RateLimit.Backend != rateBackendRedis {
+		return localLimiter
+	}
+	return &redisRateLimiter{
+		client:      gatewayConfig.RateLimit.Redis,
+		keyPrefix:   redisRateKeyPrefix + scope + ":",
+		sliding:     gatewayConfig.RateLimit.Algorithm == rateAlgorithmSlidingWindow,
+		windowLimit: windowLimit,
+		window:      window,
+		failureMode: gatewayConfig.RateLimit.FailureMode,
+		fallback:    localLimiter,
+	}
+}
+
+func loadRateLimitSettings() (rateLimitSettings, error) {
+	settings := rateLimitSettings{Algorithm: rateAlgorithmFixedWindow, Backend: rateBackendMemory, FailureMode: rateFailureLocal}
+	if rawAlgorithm := strings.ToLower(strings.TrimSpace(os.Getenv(envKeyRateLimitAlgorithm))); rawAlgorithm != "" {
+		switch rawAlgorithm {
+		case rateAlgorithmFixedWindow, rateAlgorithmTokenBucket, rateAlgorithmSlidingWindow, rateAlgorithmGcra:
+			settings.Algorithm = rawAlgorithm
+		default:
+			return rateLimitSettings{}, fmt.Errorf("unknown %s %q", envKeyRateLimitAlgorithm, rawAlgorithm)
+		}
+	}
+	if rawRate := strings.TrimSpace(os.Getenv(envKeyRateLimitRate)); rawRate != "" {
+		ratePerMinute, parseError := strconv.ParseFloat(rawRate, 64)
+		if parseError != nil || ratePerMinute <= 0 || math.IsNaN(ratePerMinute) || math.IsInf(ratePerMinute, 0) {
+			return rateLimitSettings{}, fmt.Errorf("bad %s: %q", envKeyRateLimitRate, rawRate)
+		}
+		settings.RatePerMinute = ratePerMinute
+	}
+	if rawBurst := strings.TrimSpace(os.Getenv(envKeyRateLimitBurst)); rawBurst != "" {
+		burst, parseError := strconv.Atoi(rawBurst)
+		if parseError != nil || burst <= 0 {
+			return rateLimitSettings{}, fmt.Errorf("bad %s: %q", envKeyRateLimitBurst, rawBurst)
+		}
+		settings.Burst = burst
+	}
+	if backendError := loadRateLimitBackend(&settings); backendError != nil {
+		return rateLimitSettings{}, backendError
+	}
+	return settings, nil
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	envKeyRateLimitBackend     = "RATE_LIMIT_BACKEND"
+	envKeyRateLimitFailureMode = "RATE_LIMIT_FAILURE_MODE"
+
+	rateBackendMemory = "memory"
+	rateBackendRedis  = "redis"
+
+	// rateFailureLocal falls back to the in-process limiter while the store is unreachable.
+	rateFailureLocal  = "local"
+	rateFailureOpen   = "open"
+	rateFailureClosed = "closed"
+
+	redisRateKeyPrefix = "ets:rate:"
+	// One dial timeout per cooldown during an outage, rather than one per request.
+	redisRateFailureCooldown = 5 * time.Second
+)
+
+// redisRateScript counts only admitted requests; the first count sets the key's expiry.
+// Replies {admitted, current, previous}.
+const redisRateScript = `local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local previous = tonumber(redis.call('GET', KEYS[2]) or '0')
+if previous * tonumber(ARGV[2]) + current + 1 > tonumber(ARGV[1]) then
+  return {0, current, previous}
+end
+current = redis.call('INCR', KEYS[1])
+if current == 1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return {1, current, previous}`
+
+// redisRateLimiter shares the window counters between replicas.
+type redisRateLimiter struct {
+	client       *redisClient
+	keyPrefix    string
+	sliding      bool
+	windowLimit  float64
+	window       time.Duration
+	failureMode  string
+	fallback     rateLimiter
+	unavailable  atomic.Bool
+	retryStoreAt atomic.Int64
+}
+
+func (limiter *redisRateLimiter) decide(bucketKey string) rateDecision {
+	currentTime := timeNow()
+	if currentTime.UnixNano() < limiter.retryStoreAt.Load() {
+		return limiter.decideWithoutStore(bucketKey)
+	}
+	decision, storeError := limiter.decideShared(bucketKey)
+	if storeError == nil {
+		if limiter.unavailable.Swap(false) {
+			log.Printf("rate limit store recovered")
+		}
+		return decision
+	}
+	limiter.retryStoreAt.Store(currentTime.Add(redisRateFailureCooldown).UnixNano())
+	if !limiter.unavailable.Swap(true) {
+		log.Printf("rate limit store unavailable, failing %s: %v", limiter.failureMode, storeError)
+	}
+	return limiter.decideWithoutStore(bucketKey)
+}
+
+func (limiter *redisRateLimiter) decideWithoutStore(bucketKey string) rateDecision {
+	switch limiter.failureMode {
+	case rateFailureOpen:
+		return rateDecision{Allowed: true}
+	case rateFailureClosed:
+		return rateDecision{Limit: int(limiter.windowLimit), RetryAfter: time.Second, Window: limiter.window}
+	default:
+		return limiter.fallback.decide(bucketKey)
+	}
+}
+
+func (limiter *redisRateLimiter) decideShared(bucketKey string) (rateDecision, error) {
+	currentTime := timeNow()
+	windowIndex := currentTime.UnixMilli() / limiter.window.Milliseconds()
+	windowEnd := time.UnixMilli((windowIndex + 1) * limiter.window.Milliseconds())
+	currentKey := limiter.keyPrefix + strconv.FormatInt(windowIndex, 10) + ":" + bucketKey
+	previousKey := limiter.keyPrefix + strconv.FormatInt(windowIndex-1, 10) + ":" + bucketKey
+	reset := windowEnd.Sub(currentTime)
+	previousWeight := 0.0
+	if limiter.sliding {
+		previousWeight = float64(reset) / float64(limiter.window)
+		reset += limiter.window
+	}
+
+	reply, scriptError := limiter.client.do("EVAL", redisRateScript, "2", currentKey, previousKey,
+		strconv.FormatFloat(limiter.windowLimit, 'f', -1, 64),
+		strconv.FormatFloat(previousWeight, 'f', -1, 64),
+		strconv.FormatInt(2*limiter.window.Milliseconds(), 10))
+	if scriptError != nil {
+		return rateDecision{}, scriptError
+	}
+	counts, isArray := reply.([]interface{})
+	if !isArray || len(counts) != 3 {
+		return rateDecision{}, fmt.Errorf("redis: unexpected rate script reply %v", reply)
+	}
+	admitted, _ := counts[0].(int64)
+	currentCount, _ := counts[1].(int64)
+	previousCount, _ := counts[2].(int64)
+
+	decision := rateDecision{
+		Allowed: admitted == 1,
+		Limit:   int(limiter.windowLimit),
+		Reset:   reset,
+		Window:  limiter.window,
+	}
+	if !decision.Allowed {
+		decision.RetryAfter = windowEnd.Sub(currentTime)
+		return decision, nil
+	}
+	decision.Remaining = int(math.Max(0, math.Floor(limiter.windowLimit-float64(previousCount)*previousWeight-float64(currentCount))))
+	return decision, nil
+}
+
+// The redis backend shares REDIS_URL with the replay store.
+func loadRateLimitBackend(settings *rateLimitSettings) error {
+	if rawMode := strings.ToLower(strings.TrimSpace(os.Getenv(envKeyRateLimitFailureMode))); rawMode != "" {
+		switch rawMode {
+		case rateFailureLocal, rateFailureOpen, rateFailureClosed:
+			settings.FailureMode = rawMode
+		default:
+			return fmt.Errorf("unknown %s %q", envKeyRateLimitFailureMode, rawMode)
+		}
+	}
+	switch backend := strings.ToLower(strings.TrimSpace(os.Getenv(envKeyRateLimitBackend))); backend {
+	case "", rateBackendMemory:
+		return nil
+	case rateBackendRedis:
+		if settings.Algorithm != rateAlgorithmFixedWindow && settings.Algorithm != rateAlgorithmSlidingWindow {
+			return fmt.Errorf("%s=redis supports %s and %s only", envKeyRateLimitBackend, rateAlgorithmFixedWindow, rateAlgorithmSlidingWindow)
+		}
+		redisURL := strings.TrimSpace(os.Getenv(envKeyRedisURL))
+		if redisURL == "" {
+			return fmt.Errorf("%s=redis requires %s", envKeyRateLimitBackend, envKeyRedisURL)
+		}
+		client, clientError := newRedisClient(redisURL)
+		if clientError != nil {
+			return fmt.Errorf("bad %s: %w", envKeyRedisURL, clientError)
+		}
+		settings.Backend = rateBackendRedis
+		settings.Redis = client
+		return nil
+	default:
+		return fmt.Errorf("unknown %s %q", envKeyRateLimitBackend, backend)
+	}
+}
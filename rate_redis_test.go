@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRedisRateLimiter_SharesLimitAcrossReplicas(t *testing.T) {
+	fakeServer := startFakeRedis(t, "")
+	gatewayConfig := redisRateLimitConfig(t, "redis://"+fakeServer.address, rateAlgorithmFixedWindow, rateFailureLocal)
+	firstReplica := newRateLimiter(gatewayConfig, "api:origin+ip")
+	secondReplica := newRateLimiter(gatewayConfig, "api:origin+ip")
+	key := "https://app.example.com|198.51.100.7"
+
+	if !firstReplica.decide(key).Allowed {
+		t.Fatalf("expected the first request to pass")
+	}
+	if decision := secondReplica.decide(key); !decision.Allowed || decision.Remaining != 0 {
+		t.Fatalf("expected the second replica to see the first request, got %+v", decision)
+	}
+	if decision := firstReplica.decide(key); decision.Allowed || decision.RetryAfter <= 0 {
+		t.Fatalf("expected the shared limit to be exhausted, got %+v", decision)
+	}
+	if !newRateLimiter(gatewayConfig, "issue:ip").decide(key).Allowed {
+		t.Fatalf("expected another scope to keep separate counters")
+	}
+}
+
+func TestRedisRateLimiter_SlidingWindowWeightsPreviousWindow(t *testing.T) {
+	currentTime := stubRateClock(t)
+	*currentTime = currentTime.Truncate(rateLimitWindow).Add(50 * time.Second)
+	fakeServer := startFakeRedis(t, "")
+	gatewayConfig := redisRateLimitConfig(t, "redis://"+fakeServer.address, rateAlgorithmSlidingWindow, rateFailureLocal)
+	gatewayConfig.RateLimit.RatePerMinute = 4
+	limiter := newRateLimiter(gatewayConfig, "api:origin")
+
+	for requestIndex := 0; requestIndex < 4; requestIndex++ {
+		limiter.decide("origin")
+	}
+	*currentTime = currentTime.Add(40 * time.Second)
+	admitted := 0
+	for requestIndex := 0; requestIndex < 4; requestIndex++ {
+		if limiter.decide("origin").Allowed {
+			admitted++
+		}
+	}
+	if admitted != 2 {
+		t.Fatalf("expected half of the previous window to still count, admitted %d", admitted)
+	}
+}
+
+func TestRedisRateLimiter_RefusedRequestsDoNotCount(t *testing.T) {
+	currentTime := stubRateClock(t)
+	*currentTime = currentTime.Truncate(rateLimitWindow)
+	fakeServer := startFakeRedis(t, "")
+	gatewayConfig := redisRateLimitConfig(t, "redis://"+fakeServer.address, rateAlgorithmSlidingWindow, rateFailureLocal)
+	gatewayConfig.RateLimit.RatePerMinute = 2
+	limiter := newRateLimiter(gatewayConfig, "api:origin")
+
+	for requestIndex := 0; requestIndex < 6; requestIndex++ {
+		limiter.decide("origin")
+	}
+	*currentTime = currentTime.Add(rateLimitWindow + rateLimitWindow/2)
+	if decision := limiter.decide("origin"); !decision.Allowed {
+		t.Fatalf("expected refusals not to weigh on the next window, got %+v", decision)
+	}
+}
+
+func TestRedisRateLimiter_AppliesFailureMode(t *testing.T) {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("net.Listen: %v", listenErr)
+	}
+	closedURL := "redis://" + listener.Addr().String()
+	_ = listener.Close()
+
+	localLimiter := newRateLimiter(redisRateLimitConfig(t, closedURL, rateAlgorithmFixedWindow, rateFailureLocal), "api:ip")
+	if !localLimiter.decide("ip").Allowed || !localLimiter.decide("ip").Allowed || localLimiter.decide("ip").Allowed {
+		t.Fatalf("expected the in-process limiter to enforce the limit while the store is down")
+	}
+	if decision := newRateLimiter(redisRateLimitConfig(t, closedURL, rateAlgorithmFixedWindow, rateFailureOpen), "api:ip").decide("ip"); !decision.Allowed || decision.Limit != 0 {
+		t.Fatalf("expected fail-open to admit without a limit, got %+v", decision)
+	}
+	if decision := newRateLimiter(redisRateLimitConfig(t, closedURL, rateAlgorithmFixedWindow, rateFailureClosed), "api:ip").decide("ip"); decision.Allowed || decision.RetryAfter == 0 {
+		t.Fatalf("expected fail-closed to refuse, got %+v", decision)
+	}
+}
+
+func TestRedisRateLimiter_SkipsStoreDuringFailureCooldown(t *testing.T) {
+	currentTime := stubRateClock(t)
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("net.Listen: %v", listenErr)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	var connectionAttempts atomic.Int32
+	go func() {
+		for {
+			connection, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			connectionAttempts.Add(1)
+			_ = connection.Close()
+		}
+	}()
+	limiter := newRateLimiter(redisRateLimitConfig(t, "redis://"+listener.Addr().String(), rateAlgorithmFixedWindow, rateFailureOpen), "api:ip")
+
+	for requestIndex := 0; requestIndex < 5; requestIndex++ {
+		if !limiter.decide("ip").Allowed {
+			t.Fatalf("expected fail-open to admit request %d", requestIndex)
+		}
+	}
+	if attempts := connectionAttempts.Load(); attempts != 1 {
+		t.Fatalf("expected one store attempt during the cooldown, got %d", attempts)
+	}
+	*currentTime = currentTime.Add(redisRateFailureCooldown)
+	limiter.decide("ip")
+	if attempts := connectionAttempts.Load(); attempts != 2 {
+		t.Fatalf("expected the store to be retried after the cooldown, got %d attempts", attempts)
+	}
+}
+
+func TestLoadRateLimitBackend_ValidatesRedisSettings(t *testing.T) {
+	t.Setenv(envKeyRateLimitFailureMode, "")
+	t.Setenv(envKeyRateLimitBackend, "redis")
+	t.Setenv(envKeyRedisURL, "redis://cache.internal:6379")
+	settings := rateLimitSettings{Algorithm: rateAlgorithmFixedWindow, FailureMode: rateFailureLocal}
+	if loadErr := loadRateLimitBackend(&settings); loadErr != nil || settings.Backend != rateBackendRedis || settings.Redis == nil {
+		t.Fatalf("expected the redis backend, got %+v %v", settings, loadErr)
+	}
+
+	tokenBucketSettings := rateLimitSettings{Algorithm: rateAlgorithmTokenBucket}
+	if loadErr := loadRateLimitBackend(&tokenBucketSettings); loadErr == nil {
+		t.Fatalf("expected token_bucket to be rejected with the redis backend")
+	}
+	t.Setenv(envKeyRedisURL, "")
+	if loadErr := loadRateLimitBackend(&rateLimitSettings{Algorithm: rateAlgorithmFixedWindow}); loadErr == nil {
+		t.Fatalf("expected redis without %s to be rejected", envKeyRedisURL)
+	}
+	t.Setenv(envKeyRateLimitBackend, "")
+	t.Setenv(envKeyRateLimitFailureMode, "sometimes")
+	if loadErr := loadRateLimitBackend(&rateLimitSettings{}); loadErr == nil {
+		t.Fatalf("expected an unknown failure mode to be rejected")
+	}
+}
+
+func redisRateLimitConfig(t *testing.T, redisURL string, algorithm string, failureMode string) serverConfig {
+	t.Helper()
+	client, clientErr := newRedisClient(redisURL)
+	if clientErr != nil {
+		t.Fatalf("newRedisClient: %v", clientErr)
+	}
+	return serverConfig{
+		RateLimitPerMinute: 2,
+		RateLimit: rateLimitSettings{
+			Algorithm:   algorithm,
+			Backend:     rateBackendRedis,
+			FailureMode: failureMode,
+			Redis:       client,
+		},
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envKeyRateLimitRules = "RATE_LIMIT_RULES"
+
+	// Scopes keep proxy and issuance rules with the same dimensions from sharing counters.
+	rateScopeProxy = "api:"
+	rateScopeIssue = "issue:"
+
+	headerRateLimitLimit     = "RateLimit-Limit"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+	headerRateLimitPolicy    = "RateLimit-Policy"
+	headerRetryAfter         = "Retry-After"
+
+	rateDimensionOrigin  = "origin"
+	rateDimensionIP      = "ip"
+	rateDimensionRoute   = "route"
+	rateDimensionJkt     = "jkt"
+	rateDimensionTokenID = "jti"
+)
+
+// rateLimitDimensions maps each dimension to whether it needs a verified caller.
+var rateLimitDimensions = map[string]bool{
+	rateDimensionOrigin:  false,
+	rateDimensionIP:      false,
+	rateDimensionRoute:   false,
+	rateDimensionJkt:     true,
+	rateDimensionTokenID: true,
+}
+
+var rateLimitUnits = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+type rateLimitSubject struct {
+	Origin   string
+	ClientIP string
+	Route    string
+	Jkt      string
+	TokenID  string
+}
+
+type rateLimitRule struct {
+	Name          string
+	Dimensions    []string
+	RatePerMinute float64
+	Window        time.Duration
+	Burst         int
+	limiter       rateLimiter
+}
+
+func (rule rateLimitRule) afterVerification() bool {
+	for _, dimension := range rule.Dimensions {
+		if rateLimitDimensions[dimension] {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule rateLimitRule) key(subject rateLimitSubject) string {
+	keyParts := make([]string, 0, len(rule.Dimensions))
+	for _, dimension := range rule.Dimensions {
+		switch dimension {
+		case rateDimensionOrigin:
+			keyParts = append(keyParts, subject.Origin)
+		case rateDimensionIP:
+			keyParts = append(keyParts, subject.ClientIP)
+		case rateDimensionRoute:
+			keyParts = append(keyParts, subject.Route)
+		case rateDimensionJkt:
+			keyParts = append(keyParts, subject.Jkt)
+		case rateDimensionTokenID:
+			keyParts = append(keyParts, subject.TokenID)
+		}
+	}
+	return strings.Join(keyParts, "|")
+}
+
+// rateLimitPolicy checks its rules in order; the first refusal wins.
+type rateLimitPolicy []rateLimitRule
+
+// decide checks only the rules of one phase, before or after verification.
+func (policy rateLimitPolicy) decide(subject rateLimitSubject, verified bool) rateDecision {
+	combined := rateDecision{Allowed: true}
+	for _, rule := range policy {
+		if rule.afterVerification() != verified {
+			continue
+		}
+		decision := rule.limiter.decide(rule.key(subject))
+		combined = combined.tighter(decision)
+		if !decision.Allowed {
+			return decision
+		}
+	}
+	return combined
+}
+
+func writeRateLimitHeaders(httpResponseWriter http.ResponseWriter, decision rateDecision) {
+	if decision.Limit == 0 {
+		return
+	}
+	responseHeaders := httpResponseWriter.Header()
+	responseHeaders.Set(headerRateLimitLimit, strconv.Itoa(decision.Limit))
+	responseHeaders.Set(headerRateLimitRemaining, strconv.Itoa(decision.Remaining))
+	responseHeaders.Set(headerRateLimitReset, strconv.Itoa(ceilSeconds(decision.Reset)))
+	responseHeaders.Set(headerRateLimitPolicy, strconv.Itoa(decision.Limit)+";w="+strconv.Itoa(max(ceilSeconds(decision.Window), 1)))
+	if !decision.Allowed {
+		responseHeaders.Set(headerRetryAfter, strconv.Itoa(max(ceilSeconds(decision.RetryAfter), 1)))
+	}
+}
+
+type gatewayRateLimitHeadersContextKey struct{}
+
+func withGatewayRateLimitHeaders(parentContext context.Context, responseHeaders http.Header) context.Context {
+	if responseHeaders.Get(headerRateLimitLimit) == "" {
+		return parentContext
+	}
+	return context.WithValue(parentContext, gatewayRateLimitHeadersContextKey{}, true)
+}
+
+// The proxy adds upstream headers to the gateway's rather than replacing them.
+func dropUpstreamRateLimitHeaders(upstreamResponse *http.Response) {
+	if upstreamResponse.Request == nil || upstreamResponse.Request.Context().Value(gatewayRateLimitHeadersContextKey{}) == nil {
+		return
+	}
+	for _, headerName := range []string{headerRateLimitLimit, headerRateLimitRemaining, headerRateLimitReset, headerRateLimitPolicy} {
+		upstreamResponse.Header.Del(headerName)
+	}
+}
+
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
+
+func defaultRateLimitPolicy(limiter rateLimiter) rateLimitPolicy {
+	return rateLimitPolicy{{
+		Name:       rateDimensionOrigin + "+" + rateDimensionIP,
+		Dimensions: []string{rateDimensionOrigin, rateDimensionIP},
+		limiter:    limiter,
+	}}
+}
+
+func newRateLimitPolicy(gatewayConfig serverConfig) rateLimitPolicy {
+	if len(gatewayConfig.RateLimitRules) == 0 {
+		return defaultRateLimitPolicy(newRateLimiter(gatewayConfig, rateScopeProxy+rateDimensionOrigin+"+"+rateDimensionIP))
+	}
+	return buildRateLimitPolicy(gatewayConfig, rateScopeProxy, gatewayConfig.RateLimitRules)
+}
+
+func buildRateLimitPolicy(gatewayConfig serverConfig, scopePrefix string, rules []rateLimitRule) rateLimitPolicy {
+	policy := make(rateLimitPolicy, 0, len(rules))
+	for _, rule := range rules {
+		ruleConfig := gatewayConfig
+		ruleConfig.RateLimit.RatePerMinute = rule.RatePerMinute
+		ruleConfig.RateLimit.Window = rule.Window
+		ruleConfig.RateLimit.Burst = rule.Burst
+		rule.limiter = newRateLimiter(ruleConfig, scopePrefix+rule.Name)
+		policy = append(policy, rule)
+	}
+	return policy
+}
+
+// parseRateLimitRules reads entries like "jkt=60/m, origin+ip=20/s:40".
+func parseRateLimitRules(rawRules string) ([]rateLimitRule, error) {
+	var rules []rateLimitRule
+	for _, rawRule := range strings.Split(rawRules, ",") {
+		rawRule = strings.TrimSpace(rawRule)
+		if rawRule == "" {
+			continue
+		}
+		rawDimensions, rawLimit, found := strings.Cut(rawRule, "=")
+		if !found {
+			return nil, fmt.Errorf("rate limit rule %q needs dimensions=count/unit", rawRule)
+		}
+		rule := rateLimitRule{Name: strings.ToLower(strings.TrimSpace(rawDimensions))}
+		seenDimensions := make(map[string]struct{})
+		for _, dimension := range strings.Split(rule.Name, "+") {
+			if _, known := rateLimitDimensions[dimension]; !known {
+				return nil, fmt.Errorf("rate limit rule %q: unknown dimension %q", rawRule, dimension)
+			}
+			if _, duplicate := seenDimensions[dimension]; duplicate {
+				return nil, fmt.Errorf("rate limit rule %q repeats %q", rawRule, dimension)
+			}
+			seenDimensions[dimension] = struct{}{}
+			rule.Dimensions = append(rule.Dimensions, dimension)
+		}
+
+		rawRate, rawBurst, hasBurst := strings.Cut(strings.TrimSpace(rawLimit), ":")
+		rawCount, rawUnit, hasUnit := strings.Cut(rawRate, "/")
+		count, countError := strconv.ParseFloat(strings.TrimSpace(rawCount), 64)
+		unit, knownUnit := rateLimitUnits[strings.TrimSpace(rawUnit)]
+		if !hasUnit || countError != nil || count <= 0 || math.IsNaN(count) || math.IsInf(count, 0) || !knownUnit {
+			return nil, fmt.Errorf("rate limit rule %q: limit must look like 60/m", rawRule)
+		}
+		rule.RatePerMinute = count * float64(time.Minute) / float64(unit)
+		rule.Window = unit
+		if hasBurst {
+			burst, burstError := strconv.Atoi(strings.TrimSpace(rawBurst))
+			if burstError != nil || burst <= 0 {
+				return nil, fmt.Errorf("rate limit rule %q: bad burst %q", rawRule, rawBurst)
+			}
+			rule.Burst = burst
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func loadRateLimitRules() ([]rateLimitRule, error) {
+	rules, parseError := parseRateLimitRules(os.Getenv(envKeyRateLimitRules))
+	if parseError != nil {
+		return nil, fmt.Errorf("bad %s: %w", envKeyRateLimitRules, parseError)
+	}
+	return rules, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitRules_ReadsDimensionsRatesAndBursts(t *testing.T) {
+	rules, parseErr := parseRateLimitRules(" jkt=60/m, origin=1000/m ,Origin+IP=2/s:10,route+jti=30/h")
+	if parseErr != nil {
+		t.Fatalf("parseRateLimitRules: %v", parseErr)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("expected four rules, got %d", len(rules))
+	}
+	if rules[0].RatePerMinute != 60 || !rules[0].afterVerification() || rules[1].afterVerification() {
+		t.Fatalf("unexpected jkt/origin rules %+v %+v", rules[0], rules[1])
+	}
+	if rules[2].RatePerMinute != 120 || rules[2].Burst != 10 || rules[2].Name != "origin+ip" {
+		t.Fatalf("unexpected origin+ip rule %+v", rules[2])
+	}
+	if rules[3].RatePerMinute != 0.5 || !rules[3].afterVerification() {
+		t.Fatalf("unexpected route+jti rule %+v", rules[3])
+	}
+	if subjectKey := rules[2].key(rateLimitSubject{Origin: "https://app.example.com", ClientIP: "198.51.100.7", Jkt: "ignored"}); subjectKey != "https://app.example.com|198.51.100.7" {
+		t.Fatalf("unexpected key %q", subjectKey)
+	}
+
+	for _, badRules := range []string{"jkt", "user=60/m", "jkt+jkt=60/m", "jkt=60", "jkt=60/d", "jkt=-1/m", "jkt=60/m:0", "ip=NaN/m", "ip=Inf/m", "ip=-Inf/m", "ip=1e309/m"} {
+		if _, parseErr := parseRateLimitRules(badRules); parseErr == nil {
+			t.Fatalf("expected %q to be rejected", badRules)
+		}
+	}
+}
+
+func TestRateLimitRules_AdmitTheConfiguredCountPerUnit(t *testing.T) {
+	testCases := []struct {
+		rawRule     string
+		algorithm   string
+		wantAllowed int
+		advance     time.Duration
+		wantAfter   int
+	}{
+		// 1000/h used to become 16/min; 1/h used to become 1/min (60 per hour).
+		{"ip=1000/h", rateAlgorithmFixedWindow, 1000, 10 * time.Minute, 0},
+		{"ip=1/h", rateAlgorithmFixedWindow, 1, 10 * time.Minute, 0},
+		{"ip=1000/h", rateAlgorithmSlidingWindow, 1000, 10 * time.Minute, 0},
+		// 20/s used to become a 1200-request burst inside one minute.
+		{"ip=20/s", rateAlgorithmFixedWindow, 20, time.Second, 20},
+		{"ip=20/s", rateAlgorithmSlidingWindow, 20, 2 * time.Second, 20},
+		{"ip=20/s", rateAlgorithmTokenBucket, 20, time.Second, 20},
+		{"ip=20/s", rateAlgorithmGcra, 20, time.Second, 20},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.rawRule+" "+testCase.algorithm, func(t *testing.T) {
+			currentTime := stubRateClock(t)
+			rules, parseErr := parseRateLimitRules(testCase.rawRule)
+			if parseErr != nil {
+				t.Fatalf("parseRateLimitRules: %v", parseErr)
+			}
+			policy := buildRateLimitPolicy(serverConfig{RateLimit: rateLimitSettings{Algorithm: testCase.algorithm}}, rateScopeProxy, rules)
+			countAllowed := func() int {
+				allowed := 0
+				for requestIndex := 0; requestIndex < 2*testCase.wantAllowed+10; requestIndex++ {
+					if policy.decide(rateLimitSubject{ClientIP: "198.51.100.7"}, false).Allowed {
+						allowed++
+					}
+				}
+				return allowed
+			}
+			if allowed := countAllowed(); allowed != testCase.wantAllowed {
+				t.Fatalf("expected %d requests admitted, got %d", testCase.wantAllowed, allowed)
+			}
+			*currentTime = currentTime.Add(testCase.advance)
+			if allowed := countAllowed(); allowed != testCase.wantAfter {
+				t.Fatalf("expected %d requests admitted after %v, got %d", testCase.wantAfter, testCase.advance, allowed)
+			}
+		})
+	}
+}
+
+func TestHandleProtectedProxy_LimitsByThumbprintAcrossClientIPs(t *testing.T) {
+	tokenSigningKey := []byte("abcdef0123456789abcdef0123456789")
+	rules, parseErr := parseRateLimitRules("origin=100/m, jkt=2/m")
+	if parseErr != nil {
+		t.Fatalf("parseRateLimitRules: %v", parseErr)
+	}
+	gatewayConfig := serverConfig{
+		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:      5 * time.Minute,
+		JwtHmacKey:         tokenSigningKey,
+		RateLimitPerMinute: 100,
+		RateLimit:          rateLimitSettings{Algorithm: rateAlgorithmTokenBucket},
+		RateLimitRules:     rules,
+		UpstreamTimeout:    10 * time.Second,
+	}
+	rateLimits := newRateLimitPolicy(gatewayConfig)
+	replayCache := newReplayStore(defaultReplayCacheCapacity)
+	upstreamProxy := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	})
+
+	sendAs := func(dpopKey *ecdsa.PrivateKey, remoteAddress string, requestIndex int) int {
+		dpopJwk := publicJwk{
+			KeyType: "EC",
+			Curve:   "P-256",
+			X:       base64.RawURLEncoding.EncodeToString(dpopKey.X.FillBytes(make([]byte, 32))),
+			Y:       base64.RawURLEncoding.EncodeToString(dpopKey.Y.FillBytes(make([]byte, 32))),
+		}
+		thumbprint, thumbErr := jwkThumbprint(dpopJwk)
+		if thumbErr != nil {
+			t.Fatalf("jwkThumbprint: %v", thumbErr)
+		}
+		requestURL := "http://ets.example/api"
+		request := httptest.NewRequest(http.MethodPost, requestURL, nil)
+		request.RemoteAddr = remoteAddress
+		request.Header.Set("Origin", "https://app.example.com")
+		request.Header.Set("Authorization", "Bearer "+issueTestAccessTokenWithThumbprint(t, tokenSigningKey, "token-"+strconv.Itoa(requestIndex), thumbprint))
+		request.Header.Set(headerDpop, mustCreateDpopProof(t, dpopKey, dpopJwk, http.MethodPost, requestURL, "proof-"+strconv.Itoa(requestIndex), time.Now()))
+		recorder := httptest.NewRecorder()
+		handleProtectedProxy(recorder, request, gatewayConfig, testApiRoute, replayCache, rateLimits, upstreamProxy)
+		return recorder.Code
+	}
+
+	rotatingKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	otherKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	if sendAs(rotatingKey, "198.51.100.1:1000", 1) != http.StatusOK || sendAs(rotatingKey, "198.51.100.2:1000", 2) != http.StatusOK {
+		t.Fatalf("expected the first two requests for the key to pass")
+	}
+	if statusCode := sendAs(rotatingKey, "198.51.100.3:1000", 3); statusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected rotating IPs not to evade the jkt limit, got %d", statusCode)
+	}
+	if statusCode := sendAs(otherKey, "198.51.100.3:1000", 4); statusCode != http.StatusOK {
+		t.Fatalf("expected a different key behind the same IP to pass, got %d", statusCode)
+	}
+}
+
+func TestHandleProtectedProxy_AppliesOriginRuleBeforeVerification(t *testing.T) {
+	rules, parseErr := parseRateLimitRules("origin=1/m")
+	if parseErr != nil {
+		t.Fatalf("parseRateLimitRules: %v", parseErr)
+	}
+	gatewayConfig := serverConfig{
+		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
+		JwtHmacKey:         []byte("abcdef0123456789abcdef0123456789"),
+		RateLimitPerMinute: 100,
+		RateLimitRules:     rules,
+		UpstreamTimeout:    10 * time.Second,
+	}
+	rateLimits := newRateLimitPolicy(gatewayConfig)
+	upstreamProxy := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
+
+	var statusCodes []int
+	for requestIndex := 0; requestIndex < 2; requestIndex++ {
+		request := httptest.NewRequest(http.MethodPost, "http://ets.example/api", nil)
+		request.Header.Set("Origin", "https://app.example.com")
+		recorder := httptest.NewRecorder()
+		handleProtectedProxy(recorder, request, gatewayConfig, testApiRoute, newReplayStore(defaultReplayCacheCapacity), rateLimits, upstreamProxy)
+		statusCodes = append(statusCodes, recorder.Code)
+	}
+	if statusCodes[0] != http.StatusUnauthorized || statusCodes[1] != http.StatusTooManyRequests {
+		t.Fatalf("expected unauthenticated traffic to count against the origin limit, got %v", statusCodes)
+	}
+}
+
+func TestHandleProtectedProxy_WritesRateLimitHeadersAndRetryAfter(t *testing.T) {
+	rules, parseErr := parseRateLimitRules("origin=1/m")
+	if parseErr != nil {
+		t.Fatalf("parseRateLimitRules: %v", parseErr)
+	}
+	gatewayConfig := serverConfig{
+		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
+		JwtHmacKey:         []byte("abcdef0123456789abcdef0123456789"),
+		RateLimitPerMinute: 100,
+		RateLimit:          rateLimitSettings{Algorithm: rateAlgorithmTokenBucket},
+		RateLimitRules:     rules,
+		UpstreamTimeout:    10 * time.Second,
+	}
+	rateLimits := newRateLimitPolicy(gatewayConfig)
+	upstreamProxy := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
+
+	var recorders []*httptest.ResponseRecorder
+	for requestIndex := 0; requestIndex < 2; requestIndex++ {
+		request := httptest.NewRequest(http.MethodPost, "http://ets.example/api", nil)
+		request.Header.Set("Origin", "https://app.example.com")
+		recorder := httptest.NewRecorder()
+		handleProtectedProxy(recorder, request, gatewayConfig, testApiRoute, newReplayStore(defaultReplayCacheCapacity), rateLimits, upstreamProxy)
+		recorders = append(recorders, recorder)
+	}
+
+	admittedHeaders := recorders[0].Header()
+	if admittedHeaders.Get(headerRateLimitLimit) != "1" || admittedHeaders.Get(headerRateLimitRemaining) != "0" ||
+		admittedHeaders.Get(headerRateLimitReset) != "60" || admittedHeaders.Get(headerRateLimitPolicy) != "1;w=60" {
+		t.Fatalf("unexpected rate limit headers %v", admittedHeaders)
+	}
+	if admittedHeaders.Get(headerRetryAfter) != "" {
+		t.Fatalf("expected no Retry-After on an admitted request")
+	}
+	if recorders[1].Code != http.StatusTooManyRequests || recorders[1].Header().Get(headerRetryAfter) == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %v", recorders[1].Code, recorders[1].Header())
+	}
+}
+
+func TestHandleProtectedProxy_ReplacesUpstreamRateLimitHeaders(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set(headerRateLimitLimit, "999")
+		writer.Header().Set(headerRateLimitPolicy, "999;w=3600")
+		writer.WriteHeader(http.StatusOK)
+	}))
+	defer upstreamServer.Close()
+	upstreamURL, parseErr := url.Parse(upstreamServer.URL)
+	if parseErr != nil {
+		t.Fatalf("url.Parse: %v", parseErr)
+	}
+	route := testApiRoute
+	route.UpstreamBaseURL = upstreamURL
+
+	tokenSigningKey := []byte("abcdef0123456789abcdef0123456789")
+	gatewayConfig := serverConfig{
+		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:      5 * time.Minute,
+		JwtHmacKey:         tokenSigningKey,
+		RateLimitPerMinute: 100,
+		UpstreamTimeout:    10 * time.Second,
+	}
+	dpopKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	dpopJwk := publicJwk{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(dpopKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(dpopKey.Y.FillBytes(make([]byte, 32))),
+	}
+	thumbprint, thumbErr := jwkThumbprint(dpopJwk)
+	if thumbErr != nil {
+		t.Fatalf("jwkThumbprint: %v", thumbErr)
+	}
+	requestURL := "http://ets.example/api"
+	request := httptest.NewRequest(http.MethodGet, requestURL, nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	request.Header.Set("Authorization", "Bearer "+issueTestAccessTokenWithThumbprint(t, tokenSigningKey, "token-1", thumbprint))
+	request.Header.Set(headerDpop, mustCreateDpopProof(t, dpopKey, dpopJwk, http.MethodGet, requestURL, "proof-1", time.Now()))
+	recorder := httptest.NewRecorder()
+	handleProtectedProxy(recorder, request, gatewayConfig, route, newReplayStore(defaultReplayCacheCapacity), newRateLimitPolicy(gatewayConfig), newReverseProxy(route))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected the proxied request to pass, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if limitValues := recorder.Header().Values(headerRateLimitLimit); len(limitValues) != 1 || limitValues[0] != "100" {
+		t.Fatalf("expected only the gateway RateLimit-Limit, got %v", limitValues)
+	}
+	if policyValues := recorder.Header().Values(headerRateLimitPolicy); len(policyValues) != 1 || policyValues[0] != "100;w=60" {
+		t.Fatalf("expected only the gateway RateLimit-Policy, got %v", policyValues)
+	}
+}
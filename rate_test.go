@@ -28,17 +28,209 @@ func TestWindowLimiter_AllowsThenBlocksThenResets(t *testing.T) {
 }
 
 func TestReplayStore_MarkAndRejectDuplicate(t *testing.T) {
-	store := &replayStore{seen: make(map[string]int64)}
+	store := newReplayStore(defaultReplayCacheCapacity)
 	now := timeNow()
-	if !store.mark("abc", now.Add(5*time.Minute)) {
+	if firstUse, _ := store.markOnce("abc", now.Add(5*time.Minute)); !firstUse {
 		t.Fatalf("first mark should pass")
 	}
-	if store.mark("abc", now.Add(5*time.Minute)) {
+	if firstUse, _ := store.markOnce("abc", now.Add(5*time.Minute)); firstUse {
 		t.Fatalf("duplicate should fail")
 	}
 	// expire
-	store.seen["old"] = now.Add(-1 * time.Minute).Unix()
-	if !store.mark("new", now.Add(5*time.Minute)) {
+	if firstUse, _ := store.markOnce("old", now.Add(-1*time.Minute)); !firstUse {
+		t.Fatalf("old id should pass")
+	}
+	if firstUse, _ := store.markOnce("old", now.Add(5*time.Minute)); !firstUse {
+		t.Fatalf("expired id should pass again")
+	}
+	if firstUse, _ := store.markOnce("new", now.Add(5*time.Minute)); !firstUse {
 		t.Fatalf("new id should pass")
 	}
 }
+
+func TestTokenBucketLimiter_AllowsBurstThenRefillsAtRate(t *testing.T) {
+	currentTime := stubRateClock(t)
+	limiter := newTokenBucketLimiter(60, 3)
+	key := "http://example|127.0.0.1"
+
+	for requestIndex := 0; requestIndex < 3; requestIndex++ {
+		if !limiter.allow(key) {
+			t.Fatalf("expected request %d of the burst to pass", requestIndex+1)
+		}
+	}
+	if limiter.allow(key) {
+		t.Fatalf("expected the bucket to be empty after the burst")
+	}
+	*currentTime = currentTime.Add(time.Second)
+	if !limiter.allow(key) || limiter.allow(key) {
+		t.Fatalf("expected exactly one token after one second at 60/min")
+	}
+	if !limiter.allow("http://example|127.0.0.2") {
+		t.Fatalf("expected another key to have its own bucket")
+	}
+}
+
+func TestSlidingWindowLimiter_SmoothsWindowBoundary(t *testing.T) {
+	currentTime := stubRateClock(t)
+	limiter := newSlidingWindowLimiter(10, rateLimitWindow)
+	key := "http://example|127.0.0.1"
+
+	*currentTime = currentTime.Truncate(rateLimitWindow).Add(50 * time.Second)
+	for requestIndex := 0; requestIndex < 10; requestIndex++ {
+		if !limiter.allow(key) {
+			t.Fatalf("expected request %d to pass", requestIndex+1)
+		}
+	}
+	*currentTime = currentTime.Add(40 * time.Second)
+	admitted := 0
+	for requestIndex := 0; requestIndex < 10; requestIndex++ {
+		if limiter.allow(key) {
+			admitted++
+		}
+	}
+	if admitted != 5 {
+		t.Fatalf("expected half of the previous window to still count, admitted %d", admitted)
+	}
+}
+
+func TestGcraLimiter_AllowsBurstThenSpacesRequests(t *testing.T) {
+	currentTime := stubRateClock(t)
+	limiter := newGcraLimiter(60, 2)
+	key := "http://example|127.0.0.1"
+
+	if !limiter.allow(key) || !limiter.allow(key) {
+		t.Fatalf("expected the burst of two to pass")
+	}
+	if limiter.allow(key) {
+		t.Fatalf("expected the third request to be early")
+	}
+	*currentTime = currentTime.Add(500 * time.Millisecond)
+	if limiter.allow(key) {
+		t.Fatalf("expected a request half an interval later to still be early")
+	}
+	*currentTime = currentTime.Add(500 * time.Millisecond)
+	if !limiter.allow(key) {
+		t.Fatalf("expected a request one emission interval later to pass")
+	}
+}
+
+func TestKeyedLimiter_ExpiresIdleKeysIndividually(t *testing.T) {
+	currentTime := stubRateClock(t)
+	limiter := newTokenBucketLimiter(60, 60)
+	sweepTime := currentTime.Add(rateLimiterSweepInterval)
+	limiter.allow("idle")
+	*currentTime = sweepTime.Add(-time.Second)
+	for requestIndex := 0; requestIndex < 60; requestIndex++ {
+		limiter.allow("busy")
+	}
+
+	*currentTime = sweepTime
+	if !limiter.allow("busy") || limiter.trackedKeys() != 1 {
+		t.Fatalf("expected only the refilled key to be dropped, tracking %d", limiter.trackedKeys())
+	}
+	if limiter.allow("busy") {
+		t.Fatalf("expected the busy key to keep its spent tokens across the sweep")
+	}
+}
+
+func TestLoadRateLimitSettings_SelectsAlgorithm(t *testing.T) {
+	t.Setenv(envKeyRateLimitAlgorithm, "")
+	t.Setenv(envKeyRateLimitRate, "")
+	t.Setenv(envKeyRateLimitBurst, "")
+	if settings, loadErr := loadRateLimitSettings(); loadErr != nil || settings.Algorithm != rateAlgorithmFixedWindow {
+		t.Fatalf("expected fixed_window by default, got %+v %v", settings, loadErr)
+	}
+	if _, isWindow := newRateLimiter(serverConfig{RateLimitPerMinute: 60}, "test").(*windowLimiter); !isWindow {
+		t.Fatalf("expected the fixed window limiter by default")
+	}
+
+	t.Setenv(envKeyRateLimitAlgorithm, "GCRA")
+	t.Setenv(envKeyRateLimitRate, "30")
+	t.Setenv(envKeyRateLimitBurst, "5")
+	settings, loadErr := loadRateLimitSettings()
+	if loadErr != nil || settings != (rateLimitSettings{Algorithm: rateAlgorithmGcra, RatePerMinute: 30, Burst: 5, Backend: rateBackendMemory, FailureMode: rateFailureLocal}) {
+		t.Fatalf("unexpected settings %+v %v", settings, loadErr)
+	}
+	if _, isGcra := newRateLimiter(serverConfig{RateLimit: settings}, "test").(*keyedLimiter[gcraState]); !isGcra {
+		t.Fatalf("expected a GCRA limiter")
+	}
+
+	for envKey, badValue := range map[string]string{envKeyRateLimitAlgorithm: "leaky", envKeyRateLimitRate: "0", envKeyRateLimitBurst: "many"} {
+		t.Setenv(envKey, badValue)
+		if _, loadErr := loadRateLimitSettings(); loadErr == nil {
+			t.Fatalf("expected %s=%q to be rejected", envKey, badValue)
+		}
+		t.Setenv(envKey, "")
+	}
+	for _, badRate := range []string{"NaN", "Inf", "1e309"} {
+		t.Setenv(envKeyRateLimitRate, badRate)
+		if _, loadErr := loadRateLimitSettings(); loadErr == nil {
+			t.Fatalf("expected %s=%q to be rejected", envKeyRateLimitRate, badRate)
+		}
+	}
+}
+
+func stubRateClock(t *testing.T) *time.Time {
+	t.Helper()
+	originalTimeNow := timeNow
+	t.Cleanup(func() { timeNow = originalTimeNow })
+	currentTime := time.Unix(1_700_000_000, 0)
+	timeNow = func() time.Time { return currentTime }
+	return &currentTime
+}
+
+func TestRateLimiters_ReportRemainingAndRetryAfter(t *testing.T) {
+	currentTime := stubRateClock(t)
+	key := "http://example|127.0.0.1"
+
+	windowDecisions := []rateDecision{}
+	window := &windowLimiter{windowEnd: currentTime.Unix() + 30, counts: make(map[string]int), perMinuteCap: 2}
+	for requestIndex := 0; requestIndex < 3; requestIndex++ {
+		windowDecisions = append(windowDecisions, window.decide(key))
+	}
+	if windowDecisions[0].Remaining != 1 || windowDecisions[1].Remaining != 0 || windowDecisions[2].Allowed {
+		t.Fatalf("unexpected fixed window decisions %+v", windowDecisions)
+	}
+	if retryAfter := windowDecisions[2].RetryAfter; retryAfter <= 0 || retryAfter > 30*time.Second {
+		t.Fatalf("expected Retry-After to point at the window end, got %v", retryAfter)
+	}
+
+	bucket := newTokenBucketLimiter(60, 2)
+	bucket.decide(key)
+	if decision := bucket.decide(key); decision.Remaining != 0 || decision.Reset != 2*time.Second || decision.Limit != 2 {
+		t.Fatalf("unexpected token bucket decision %+v", decision)
+	}
+	if decision := bucket.decide(key); decision.Allowed || decision.RetryAfter != time.Second {
+		t.Fatalf("expected one second until the next token, got %+v", decision)
+	}
+
+	gcra := newGcraLimiter(60, 3)
+	if decision := gcra.decide(key); decision.Remaining != 2 || decision.Reset != time.Second {
+		t.Fatalf("unexpected first GCRA decision %+v", decision)
+	}
+	gcra.decide(key)
+	gcra.decide(key)
+	if decision := gcra.decide(key); decision.Allowed || decision.RetryAfter != time.Second {
+		t.Fatalf("expected GCRA to refuse for one emission interval, got %+v", decision)
+	}
+	*currentTime = currentTime.Add(time.Second)
+	if decision := gcra.decide(key); !decision.Allowed || decision.Remaining != 0 {
+		t.Fatalf("expected one conforming request after an interval, got %+v", decision)
+	}
+}
+
+func TestRateDecision_TighterPrefersRefusalThenLeastRemaining(t *testing.T) {
+	roomy := rateDecision{Allowed: true, Limit: 100, Remaining: 90}
+	tight := rateDecision{Allowed: true, Limit: 10, Remaining: 1}
+	refused := rateDecision{Limit: 1000, Remaining: 0, RetryAfter: time.Second}
+
+	if roomy.tighter(tight) != tight || tight.tighter(roomy) != tight {
+		t.Fatalf("expected the decision with less room to win")
+	}
+	if tight.tighter(refused) != refused || refused.tighter(tight) != refused {
+		t.Fatalf("expected a refusal to win")
+	}
+	if (rateDecision{Allowed: true}).tighter(roomy) != roomy || roomy.tighter(rateDecision{Allowed: true}) != roomy {
+		t.Fatalf("expected a decision without a limit to be ignored")
+	}
+}
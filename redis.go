@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisSchemePlain       = "redis"
+	redisSchemeTLS         = "rediss"
+	defaultRedisPort       = "6379"
+	redisCommandTimeout    = 2 * time.Second
+	redisMaxIdleConnection = 16
+)
+
+// errRedisNil is a RESP null reply, including a SET NX that did not set.
+var errRedisNil = errors.New("redis: nil reply")
+
+type redisError string
+
+func (replyError redisError) Error() string { return "redis: " + string(replyError) }
+
+type redisClient struct {
+	address        string
+	useTLS         bool
+	username       string
+	password       string
+	database       int
+	commandTimeout time.Duration
+	idle           chan net.Conn
+}
+
+// No connection is opened until the first command.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	parsedURL, parseError := url.Parse(strings.TrimSpace(rawURL))
+	if parseError != nil {
+		return nil, fmt.Errorf("bad redis url: %v", parseError)
+	}
+	if parsedURL.Scheme != redisSchemePlain && parsedURL.Scheme != redisSchemeTLS {
+		return nil, fmt.Errorf("redis url must use redis:// or rediss://")
+	}
+	if parsedURL.Hostname() == "" {
+		return nil, fmt.Errorf("redis url needs a host")
+	}
+	port := parsedURL.Port()
+	if port == "" {
+		port = defaultRedisPort
+	}
+	client := &redisClient{
+		address:        net.JoinHostPort(parsedURL.Hostname(), port),
+		useTLS:         parsedURL.Scheme == redisSchemeTLS,
+		commandTimeout: redisCommandTimeout,
+		idle:           make(chan net.Conn, redisMaxIdleConnection),
+	}
+	if parsedURL.User != nil {
+		client.username = parsedURL.User.Username()
+		client.password, _ = parsedURL.User.Password()
+	}
+	if databasePath := strings.Trim(parsedURL.Path, "/"); databasePath != "" {
+		database, databaseError := strconv.Atoi(databasePath)
+		if databaseError != nil || database < 0 {
+			return nil, fmt.Errorf("bad redis database %q", databasePath)
+		}
+		client.database = database
+	}
+	return client, nil
+}
+
+func (client *redisClient) do(commandArguments ...string) (interface{}, error) {
+	connection, connectionError := client.acquire()
+	if connectionError != nil {
+		return nil, connectionError
+	}
+	reply, commandError := client.roundTrip(connection, commandArguments)
+	var replyError redisError
+	if commandError != nil && !errors.Is(commandError, errRedisNil) && !errors.As(commandError, &replyError) {
+		_ = connection.Close()
+		return nil, commandError
+	}
+	client.release(connection)
+	return reply, commandError
+}
+
+func (client *redisClient) roundTrip(connection net.Conn, commandArguments []string) (interface{}, error) {
+	if deadlineError := connection.SetDeadline(time.Now().Add(client.commandTimeout)); deadlineError != nil {
+		return nil, deadlineError
+	}
+	if _, writeError := connection.Write(encodeRedisCommand(commandArguments)); writeError != nil {
+		return nil, writeError
+	}
+	replyReader := bufio.NewReader(connection)
+	reply, replyError := readRedisReply(replyReader)
+	// Bytes past the reply would be lost with this reader; treat them as a broken connection
+	// so do() closes it rather than pooling it.
+	if replyReader.Buffered() != 0 {
+		return nil, fmt.Errorf("redis: %d unexpected bytes after reply", replyReader.Buffered())
+	}
+	return reply, replyError
+}
+
+func (client *redisClient) acquire() (net.Conn, error) {
+	select {
+	case idleConnection := <-client.idle:
+		return idleConnection, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: client.commandTimeout}
+	var connection net.Conn
+	var dialError error
+	if client.useTLS {
+		connection, dialError = tls.DialWithDialer(dialer, "tcp", client.address, &tls.Config{MinVersion: tls.VersionTLS12})
+	} else {
+		connection, dialError = dialer.Dial("tcp", client.address)
+	}
+	if dialError != nil {
+		return nil, fmt.Errorf("redis dial: %w", dialError)
+	}
+	if client.password != "" {
+		authArguments := []string{"AUTH", client.password}
+		if client.username != "" {
+			authArguments = []string{"AUTH", client.username, client.password}
+		}
+		if _, authError := client.roundTrip(connection, authArguments); authError != nil {
+			_ = connection.Close()
+			return nil, fmt.Errorf("redis auth: %w", authError)
+		}
+	}
+	if client.database != 0 {
+		if _, selectError := client.roundTrip(connection, []string{"SELECT", strconv.Itoa(client.database)}); selectError != nil {
+			_ = connection.Close()
+			return nil, fmt.Errorf("redis select: %w", selectError)
+		}
+	}
+	return connection, nil
+}
+
+func (client *redisClient) release(connection net.Conn) {
+	select {
+	case client.idle <- connection:
+	default:
+		_ = connection.Close()
+	}
+}
+
+func encodeRedisCommand(commandArguments []string) []byte {
+	var encoded strings.Builder
+	encoded.WriteString("*" + strconv.Itoa(len(commandArguments)) + "\r\n")
+	for _, argument := range commandArguments {
+		encoded.WriteString("$" + strconv.Itoa(len(argument)) + "\r\n" + argument + "\r\n")
+	}
+	return []byte(encoded.String())
+}
+
+// Each command gets its own reader so no bytes are left behind on a pooled connection.
+func readRedisReply(replyReader *bufio.Reader) (interface{}, error) {
+	line, readError := replyReader.ReadString('\n')
+	if readError != nil {
+		return nil, readError
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	payload := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		bulkLength, lengthError := strconv.Atoi(payload)
+		if lengthError != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", payload)
+		}
+		if bulkLength < 0 {
+			return nil, errRedisNil
+		}
+		bulk := make([]byte, bulkLength+2)
+		if _, bulkError := io.ReadFull(replyReader, bulk); bulkError != nil {
+			return nil, bulkError
+		}
+		return string(bulk[:bulkLength]), nil
+	case '*':
+		elementCount, countError := strconv.Atoi(payload)
+		if countError != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", payload)
+		}
+		if elementCount < 0 {
+			return nil, errRedisNil
+		}
+		// An error element is reported only after the whole array is read, so the connection
+		// stays in step with the server and can be pooled.
+		elements := make([]interface{}, 0, elementCount)
+		var firstReplyError error
+		for elementIndex := 0; elementIndex < elementCount; elementIndex++ {
+			element, elementError := readRedisReply(replyReader)
+			var replyError redisError
+			switch {
+			case elementError == nil, errors.Is(elementError, errRedisNil):
+			case errors.As(elementError, &replyError):
+				if firstReplyError == nil {
+					firstReplyError = elementError
+				}
+			default:
+				return nil, elementError
+			}
+			elements = append(elements, element)
+		}
+		if firstReplyError != nil {
+			return nil, firstReplyError
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
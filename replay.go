@@ -0,0 +1,235 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envKeyReplayStore = "REPLAY_STORE"
+	envKeyRedisURL    = "REDIS_URL"
+
+	replayStoreMemory = "memory"
+	replayStoreRedis  = "redis"
+
+	redisReplayKeyPrefix = "ets:dpop:jti:"
+
+	envKeyReplayCacheCapacity  = "REPLAY_CACHE_CAPACITY"
+	defaultReplayCacheCapacity = 1_000_000
+	replayShardCount           = 64
+	replayJanitorInterval      = 5 * time.Second
+)
+
+// An error from markOnce means the store could not answer; the proof must not be admitted.
+type proofReplayCache interface {
+	markOnce(proofID string, expirationTime time.Time) (bool, error)
+}
+
+type replayJanitor interface {
+	runJanitor(interval time.Duration, stop <-chan struct{})
+}
+
+// Forgetting an unexpired jti would reopen replay, so a full cache refuses instead.
+var errReplayCacheFull = errors.New("replay cache full")
+
+// replayStore is only correct for a single ETS instance.
+type replayStore struct {
+	hashSeed      maphash.Seed
+	shards        [replayShardCount]replayShard
+	shardCapacity int
+}
+
+type replayShard struct {
+	mutex    sync.Mutex
+	expiries map[string]int64
+	queue    replayExpiryQueue
+}
+
+type replayExpiry struct {
+	proofID   string
+	expiresAt int64
+}
+
+type replayExpiryQueue []replayExpiry
+
+func (queue replayExpiryQueue) Len() int { return len(queue) }
+func (queue replayExpiryQueue) Less(left, right int) bool {
+	return queue[left].expiresAt < queue[right].expiresAt
+}
+func (queue replayExpiryQueue) Swap(left, right int) {
+	queue[left], queue[right] = queue[right], queue[left]
+}
+func (queue *replayExpiryQueue) Push(entry any) { *queue = append(*queue, entry.(replayExpiry)) }
+func (queue *replayExpiryQueue) Pop() any {
+	previous := *queue
+	last := previous[len(previous)-1]
+	*queue = previous[:len(previous)-1]
+	return last
+}
+
+func newReplayStore(capacity int) *replayStore {
+	if capacity < replayShardCount {
+		capacity = replayShardCount
+	}
+	store := &replayStore{
+		hashSeed:      maphash.MakeSeed(),
+		shardCapacity: (capacity + replayShardCount - 1) / replayShardCount,
+	}
+	for shardIndex := range store.shards {
+		store.shards[shardIndex].expiries = make(map[string]int64)
+	}
+	return store
+}
+
+func (store *replayStore) markOnce(proofID string, expirationTime time.Time) (bool, error) {
+	shard := &store.shards[maphash.String(store.hashSeed, proofID)%replayShardCount]
+	currentNanos := timeNow().UnixNano()
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if cachedExpiry, exists := shard.expiries[proofID]; exists && cachedExpiry > currentNanos {
+		return false, nil
+	}
+	if len(shard.expiries) >= store.shardCapacity {
+		shard.pruneExpired(currentNanos)
+		if len(shard.expiries) >= store.shardCapacity {
+			return false, errReplayCacheFull
+		}
+	}
+	expiresAt := expirationTime.UnixNano()
+	shard.expiries[proofID] = expiresAt
+	heap.Push(&shard.queue, replayExpiry{proofID: proofID, expiresAt: expiresAt})
+	return true, nil
+}
+
+// An entry whose ID was re-marked with a later expiry is stale. The caller holds the shard mutex.
+func (shard *replayShard) pruneExpired(currentNanos int64) {
+	for len(shard.queue) > 0 && shard.queue[0].expiresAt <= currentNanos {
+		expired := heap.Pop(&shard.queue).(replayExpiry)
+		if shard.expiries[expired.proofID] == expired.expiresAt {
+			delete(shard.expiries, expired.proofID)
+		}
+	}
+}
+
+func (store *replayStore) prune() {
+	currentNanos := timeNow().UnixNano()
+	for shardIndex := range store.shards {
+		shard := &store.shards[shardIndex]
+		shard.mutex.Lock()
+		shard.pruneExpired(currentNanos)
+		shard.mutex.Unlock()
+	}
+}
+
+// Light traffic alone would never prune, so the janitor runs on a timer.
+func (store *replayStore) runJanitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			store.prune()
+		}
+	}
+}
+
+func (store *replayStore) liveEntries() []replayExpiry {
+	currentNanos := timeNow().UnixNano()
+	var entries []replayExpiry
+	for shardIndex := range store.shards {
+		shard := &store.shards[shardIndex]
+		shard.mutex.Lock()
+		for proofID, expiresAt := range shard.expiries {
+			if expiresAt > currentNanos {
+				entries = append(entries, replayExpiry{proofID: proofID, expiresAt: expiresAt})
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return entries
+}
+
+func (store *replayStore) liveCount() int {
+	total := 0
+	for shardIndex := range store.shards {
+		shard := &store.shards[shardIndex]
+		shard.mutex.Lock()
+		total += len(shard.expiries)
+		shard.mutex.Unlock()
+	}
+	return total
+}
+
+// SET NX PX lets the first replica to see a jti win.
+type redisReplayStore struct {
+	client *redisClient
+}
+
+func (store redisReplayStore) markOnce(proofID string, expirationTime time.Time) (bool, error) {
+	remainingMillis := expirationTime.Sub(timeNow()).Milliseconds()
+	if remainingMillis < 1 {
+		remainingMillis = 1
+	}
+	_, setError := store.client.do("SET", redisReplayKeyPrefix+proofID, "1", "NX", "PX", strconv.FormatInt(remainingMillis, 10))
+	if errors.Is(setError, errRedisNil) {
+		return false, nil
+	}
+	if setError != nil {
+		return false, fmt.Errorf("replay store: %w", setError)
+	}
+	return true, nil
+}
+
+func loadReplayCache() (proofReplayCache, error) {
+	switch backend := strings.ToLower(strings.TrimSpace(os.Getenv(envKeyReplayStore))); backend {
+	case "", replayStoreMemory:
+		capacity, capacityError := loadReplayCacheCapacity()
+		if capacityError != nil {
+			return nil, capacityError
+		}
+		return newReplayStore(capacity), nil
+	case replayStoreFile:
+		storePath := strings.TrimSpace(os.Getenv(envKeyReplayStorePath))
+		if storePath == "" {
+			return nil, fmt.Errorf("%s=file requires %s", envKeyReplayStore, envKeyReplayStorePath)
+		}
+		capacity, capacityError := loadReplayCacheCapacity()
+		if capacityError != nil {
+			return nil, capacityError
+		}
+		return openFileReplayStore(storePath, capacity)
+	case replayStoreRedis:
+		redisURL := strings.TrimSpace(os.Getenv(envKeyRedisURL))
+		if redisURL == "" {
+			return nil, fmt.Errorf("%s=redis requires %s", envKeyReplayStore, envKeyRedisURL)
+		}
+		client, clientError := newRedisClient(redisURL)
+		if clientError != nil {
+			return nil, fmt.Errorf("bad %s: %w", envKeyRedisURL, clientError)
+		}
+		return redisReplayStore{client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown %s %q", envKeyReplayStore, backend)
+	}
+}
+
+func loadReplayCacheCapacity() (int, error) {
+	rawCapacity := strings.TrimSpace(os.Getenv(envKeyReplayCacheCapacity))
+	if rawCapacity == "" {
+		return defaultReplayCacheCapacity, nil
+	}
+	capacity, parseError := strconv.Atoi(rawCapacity)
+	if parseError != nil || capacity <= 0 {
+		return 0, fmt.Errorf("bad %s: %q", envKeyReplayCacheCapacity, rawCapacity)
+	}
+	return capacity, nil
+}
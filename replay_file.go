@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envKeyReplayStorePath = "REPLAY_STORE_PATH"
+	replayStoreFile       = "file"
+
+	// replayCompactionMinimum keeps small logs from being rewritten on every tick.
+	replayCompactionMinimum = 1024
+	replayLogMaxLineBytes   = 1024
+)
+
+// Log lines are "<expiry unix nanos> <base64url proof ID>". Each proof is appended before
+// markOnce admits it.
+type fileReplayStore struct {
+	memory     *replayStore
+	path       string
+	logMutex   sync.Mutex
+	logFile    *os.File
+	logEntries int
+}
+
+func openFileReplayStore(path string, capacity int) (*fileReplayStore, error) {
+	store := &fileReplayStore{memory: newReplayStore(capacity), path: path}
+	if loadError := store.load(); loadError != nil {
+		return nil, loadError
+	}
+	store.logMutex.Lock()
+	defer store.logMutex.Unlock()
+	if compactError := store.compactLocked(); compactError != nil {
+		return nil, compactError
+	}
+	return store, nil
+}
+
+func (store *fileReplayStore) load() error {
+	logFile, openError := os.Open(store.path)
+	if errors.Is(openError, os.ErrNotExist) {
+		return nil
+	}
+	if openError != nil {
+		return fmt.Errorf("replay log: %w", openError)
+	}
+	defer logFile.Close()
+
+	currentNanos := timeNow().UnixNano()
+	skippedLines := 0
+	lineScanner := bufio.NewScanner(logFile)
+	lineScanner.Buffer(make([]byte, 0, replayLogMaxLineBytes), replayLogMaxLineBytes)
+	lineScanner.Split(skipOversizedLines(replayLogMaxLineBytes, &skippedLines))
+	for lineScanner.Scan() {
+		proofID, expiresAt, parsed := parseReplayLogLine(lineScanner.Text())
+		if !parsed {
+			skippedLines++
+			continue
+		}
+		if expiresAt <= currentNanos {
+			continue
+		}
+		if _, markError := store.memory.markOnce(proofID, time.Unix(0, expiresAt)); markError != nil {
+			return fmt.Errorf("replay log: %w", markError)
+		}
+	}
+	if scanError := lineScanner.Err(); scanError != nil {
+		return fmt.Errorf("replay log: %w", scanError)
+	}
+	if skippedLines > 0 {
+		log.Printf("replay log: skipped %d malformed or oversized lines in %s", skippedLines, store.path)
+	}
+	return nil
+}
+
+func (store *fileReplayStore) markOnce(proofID string, expirationTime time.Time) (bool, error) {
+	firstUse, markError := store.memory.markOnce(proofID, expirationTime)
+	if markError != nil || !firstUse {
+		return firstUse, markError
+	}
+	store.logMutex.Lock()
+	defer store.logMutex.Unlock()
+	if _, writeError := store.logFile.WriteString(formatReplayLogLine(proofID, expirationTime.UnixNano())); writeError != nil {
+		return false, fmt.Errorf("replay log: %w", writeError)
+	}
+	store.logEntries++
+	return true, nil
+}
+
+func (store *fileReplayStore) runJanitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			store.logMutex.Lock()
+			_ = store.logFile.Close()
+			store.logMutex.Unlock()
+			return
+		case <-ticker.C:
+			store.memory.prune()
+			store.logMutex.Lock()
+			if store.logEntries > replayCompactionMinimum && store.logEntries > 2*store.memory.liveCount() {
+				if compactError := store.compactLocked(); compactError != nil {
+					log.Printf("replay log compaction failed: %v", compactError)
+				}
+			}
+			store.logMutex.Unlock()
+		}
+	}
+}
+
+// A proof marked during the snapshot may be written twice, which load tolerates.
+func (store *fileReplayStore) compactLocked() error {
+	liveEntries := store.memory.liveEntries()
+	temporaryPath := store.path + ".tmp"
+	temporaryFile, createError := os.OpenFile(temporaryPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if createError != nil {
+		return fmt.Errorf("replay log: %w", createError)
+	}
+	logWriter := bufio.NewWriter(temporaryFile)
+	for _, entry := range liveEntries {
+		_, _ = logWriter.WriteString(formatReplayLogLine(entry.proofID, entry.expiresAt))
+	}
+	writeError := logWriter.Flush()
+	if writeError == nil {
+		writeError = temporaryFile.Sync()
+	}
+	if closeError := temporaryFile.Close(); writeError == nil {
+		writeError = closeError
+	}
+	if writeError == nil {
+		writeError = os.Rename(temporaryPath, store.path)
+	}
+	if writeError != nil {
+		_ = os.Remove(temporaryPath)
+		return fmt.Errorf("replay log: %w", writeError)
+	}
+
+	logFile, openError := os.OpenFile(store.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if openError != nil {
+		return fmt.Errorf("replay log: %w", openError)
+	}
+	if store.logFile != nil {
+		_ = store.logFile.Close()
+	}
+	store.logFile = logFile
+	store.logEntries = len(liveEntries)
+	return nil
+}
+
+// skipOversizedLines drops overlong lines instead of stopping the scan with bufio.ErrTooLong.
+func skipOversizedLines(maxLineBytes int, skippedLines *int) bufio.SplitFunc {
+	discarding := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		newlineIndex := bytes.IndexByte(data, '\n')
+		if discarding {
+			if newlineIndex < 0 {
+				return len(data), nil, nil
+			}
+			discarding = false
+			return newlineIndex + 1, nil, nil
+		}
+		if newlineIndex < 0 && len(data) >= maxLineBytes {
+			discarding = true
+			*skippedLines++
+			return len(data), nil, nil
+		}
+		return bufio.ScanLines(data, atEOF)
+	}
+}
+
+func formatReplayLogLine(proofID string, expiresAt int64) string {
+	return strconv.FormatInt(expiresAt, 10) + " " + base64.RawURLEncoding.EncodeToString([]byte(proofID)) + "\n"
+}
+
+func parseReplayLogLine(line string) (string, int64, bool) {
+	rawExpiry, encodedID, found := strings.Cut(line, " ")
+	if !found {
+		return "", 0, false
+	}
+	expiresAt, expiryError := strconv.ParseInt(rawExpiry, 10, 64)
+	proofID, decodeError := base64.RawURLEncoding.DecodeString(encodedID)
+	if expiryError != nil || decodeError != nil || len(proofID) == 0 {
+		return "", 0, false
+	}
+	return string(proofID), expiresAt, true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileReplayStore_RejectsProofsSeenBeforeRestart(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "replay.log")
+	beforeRestart, openErr := openFileReplayStore(logPath, defaultReplayCacheCapacity)
+	if openErr != nil {
+		t.Fatalf("openFileReplayStore: %v", openErr)
+	}
+	if firstUse, markErr := beforeRestart.markOnce("proof-1", timeNow().Add(time.Minute)); markErr != nil || !firstUse {
+		t.Fatalf("expected the first use to be accepted, got %v %v", firstUse, markErr)
+	}
+	if firstUse, markErr := beforeRestart.markOnce("proof with spaces\nand a newline", timeNow().Add(time.Minute)); markErr != nil || !firstUse {
+		t.Fatalf("expected an arbitrary jti to be accepted, got %v %v", firstUse, markErr)
+	}
+
+	afterRestart, reopenErr := openFileReplayStore(logPath, defaultReplayCacheCapacity)
+	if reopenErr != nil {
+		t.Fatalf("openFileReplayStore: %v", reopenErr)
+	}
+	for _, proofID := range []string{"proof-1", "proof with spaces\nand a newline"} {
+		if firstUse, markErr := afterRestart.markOnce(proofID, timeNow().Add(time.Minute)); markErr != nil || firstUse {
+			t.Fatalf("expected %q to be rejected after a restart, got %v %v", proofID, firstUse, markErr)
+		}
+	}
+	if firstUse, _ := afterRestart.markOnce("proof-2", timeNow().Add(time.Minute)); !firstUse {
+		t.Fatalf("expected an unseen proof to be accepted after a restart")
+	}
+}
+
+func TestOpenFileReplayStore_SkipsExpiredAndTornLinesAndCompacts(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "replay.log")
+	liveExpiry := timeNow().Add(time.Minute).UnixNano()
+	logContents := formatReplayLogLine("expired", timeNow().Add(-time.Minute).UnixNano()) +
+		formatReplayLogLine("live", liveExpiry) +
+		"not a replay line\n" +
+		strconv.FormatInt(liveExpiry, 10) + " "
+	if writeErr := os.WriteFile(logPath, []byte(logContents), 0o600); writeErr != nil {
+		t.Fatalf("os.WriteFile: %v", writeErr)
+	}
+
+	store, openErr := openFileReplayStore(logPath, defaultReplayCacheCapacity)
+	if openErr != nil {
+		t.Fatalf("openFileReplayStore: %v", openErr)
+	}
+	if firstUse, _ := store.markOnce("live", timeNow().Add(time.Minute)); firstUse {
+		t.Fatalf("expected the live entry to be restored")
+	}
+	if firstUse, _ := store.markOnce("expired", timeNow().Add(time.Minute)); !firstUse {
+		t.Fatalf("expected the expired entry to be dropped")
+	}
+
+	compactedLog, readErr := os.ReadFile(logPath)
+	if readErr != nil {
+		t.Fatalf("os.ReadFile: %v", readErr)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(compactedLog)), "\n"); len(lines) != 2 {
+		t.Fatalf("expected the live entry plus the new mark after compaction, got %q", compactedLog)
+	}
+}
+
+func TestOpenFileReplayStore_SkipsOversizedLines(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "replay.log")
+	liveExpiry := timeNow().Add(time.Minute).UnixNano()
+	logContents := formatReplayLogLine(strings.Repeat("x", 64<<10), liveExpiry) +
+		formatReplayLogLine("live", liveExpiry)
+	if writeErr := os.WriteFile(logPath, []byte(logContents), 0o600); writeErr != nil {
+		t.Fatalf("os.WriteFile: %v", writeErr)
+	}
+
+	store, openErr := openFileReplayStore(logPath, defaultReplayCacheCapacity)
+	if openErr != nil {
+		t.Fatalf("openFileReplayStore: %v", openErr)
+	}
+	if firstUse, _ := store.markOnce("live", timeNow().Add(time.Minute)); firstUse {
+		t.Fatalf("expected the entry after the oversized line to be restored")
+	}
+	if _, reopenErr := openFileReplayStore(logPath, defaultReplayCacheCapacity); reopenErr != nil {
+		t.Fatalf("expected the compacted log to reload: %v", reopenErr)
+	}
+}
+
+func TestFileReplayStore_CompactionDropsExpiredLines(t *testing.T) {
+	originalTimeNow := timeNow
+	t.Cleanup(func() { timeNow = originalTimeNow })
+	fixedTime := time.Unix(1_700_000_000, 0)
+	timeNow = func() time.Time { return fixedTime }
+
+	logPath := filepath.Join(t.TempDir(), "replay.log")
+	store, openErr := openFileReplayStore(logPath, defaultReplayCacheCapacity)
+	if openErr != nil {
+		t.Fatalf("openFileReplayStore: %v", openErr)
+	}
+	for proofIndex := 0; proofIndex < 100; proofIndex++ {
+		_, _ = store.markOnce("short-"+strconv.Itoa(proofIndex), fixedTime.Add(time.Second))
+	}
+	_, _ = store.markOnce("long", fixedTime.Add(time.Hour))
+
+	fixedTime = fixedTime.Add(time.Minute)
+	store.memory.prune()
+	store.logMutex.Lock()
+	compactErr := store.compactLocked()
+	store.logMutex.Unlock()
+	if compactErr != nil {
+		t.Fatalf("compactLocked: %v", compactErr)
+	}
+	_, _ = store.markOnce("after-compaction", fixedTime.Add(time.Hour))
+
+	compactedLog, readErr := os.ReadFile(logPath)
+	if readErr != nil {
+		t.Fatalf("os.ReadFile: %v", readErr)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(compactedLog)), "\n"); len(lines) != 2 || store.logEntries != 2 {
+		t.Fatalf("expected only live entries in the log, got %d lines", len(lines))
+	}
+	if _, statErr := os.Stat(logPath + ".tmp"); !os.IsNotExist(statErr) {
+		t.Fatalf("expected the temporary file to be renamed away, got %v", statErr)
+	}
+}
+
+func TestLoadReplayCache_FileBackendRequiresPath(t *testing.T) {
+	t.Setenv(envKeyReplayStore, "file")
+	t.Setenv(envKeyReplayStorePath, "")
+	if _, loadErr := loadReplayCache(); loadErr == nil {
+		t.Fatalf("expected file without %s to be rejected", envKeyReplayStorePath)
+	}
+	t.Setenv(envKeyReplayStorePath, filepath.Join(t.TempDir(), "replay.log"))
+	if replayCache, loadErr := loadReplayCache(); loadErr != nil {
+		t.Fatalf("loadReplayCache: %v", loadErr)
+	} else if _, isFile := replayCache.(*fileReplayStore); !isFile {
+		t.Fatalf("expected a file replay store, got %T", replayCache)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRedisReplayStore_RejectsJtiSeenByAnotherReplica(t *testing.T) {
+	fakeServer := startFakeRedis(t, "")
+	firstReplica := mustRedisReplayStore(t, "redis://"+fakeServer.address)
+	secondReplica := mustRedisReplayStore(t, "redis://"+fakeServer.address)
+
+	expiresAt := timeNow().Add(time.Minute)
+	if firstUse, markErr := firstReplica.markOnce("proof-1", expiresAt); markErr != nil || !firstUse {
+		t.Fatalf("expected the first replica to accept the proof, got %v %v", firstUse, markErr)
+	}
+	if firstUse, markErr := secondReplica.markOnce("proof-1", expiresAt); markErr != nil || firstUse {
+		t.Fatalf("expected the second replica to reject the replay, got %v %v", firstUse, markErr)
+	}
+
+	if firstUse, _ := firstReplica.markOnce("proof-short", timeNow().Add(30*time.Millisecond)); !firstUse {
+		t.Fatalf("expected a fresh proof to be accepted")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if firstUse, _ := secondReplica.markOnce("proof-short", timeNow().Add(time.Minute)); !firstUse {
+		t.Fatalf("expected the proof ID to be forgotten after its expiry")
+	}
+}
+
+func TestRedisReplayStore_ReportsUnavailableStore(t *testing.T) {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("net.Listen: %v", listenErr)
+	}
+	closedAddress := listener.Addr().String()
+	_ = listener.Close()
+
+	unavailableStore := mustRedisReplayStore(t, "redis://"+closedAddress)
+	if _, markErr := unavailableStore.markOnce("proof-1", timeNow().Add(time.Minute)); markErr == nil {
+		t.Fatalf("expected an error when the store is unreachable")
+	}
+}
+
+func TestHandleProtectedProxy_FailsClosedWhenReplayStoreErrors(t *testing.T) {
+	tokenSigningKey := []byte("abcdef0123456789abcdef0123456789")
+	gatewayConfig := serverConfig{
+		AllowedOrigins:  map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:   5 * time.Minute,
+		JwtHmacKey:      tokenSigningKey,
+		UpstreamTimeout: 10 * time.Second,
+	}
+	dpopKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	dpopJwk := publicJwk{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(dpopKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(dpopKey.Y.FillBytes(make([]byte, 32))),
+	}
+	thumbprint, thumbErr := jwkThumbprint(dpopJwk)
+	if thumbErr != nil {
+		t.Fatalf("jwkThumbprint: %v", thumbErr)
+	}
+
+	requestURL := "http://ets.example/api"
+	testCases := map[string]failingReplayCache{
+		"replay_store_unavailable": {markError: errors.New("store down")},
+		"replay_cache_full":        {markError: errReplayCacheFull},
+	}
+	for wantErrorCode, replayCache := range testCases {
+		request := httptest.NewRequest(http.MethodPost, requestURL, nil)
+		request.Header.Set("Origin", "https://app.example.com")
+		request.Header.Set("Authorization", "Bearer "+issueTestAccessTokenWithThumbprint(t, tokenSigningKey, "token-store-down", thumbprint))
+		request.Header.Set(headerDpop, mustCreateDpopProof(t, dpopKey, dpopJwk, http.MethodPost, requestURL, "proof-store-down", time.Now()))
+
+		upstreamCalled := false
+		upstreamProxy := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) { upstreamCalled = true })
+		rateLimiter := &windowLimiter{windowEnd: time.Now().Unix() + 60, counts: make(map[string]int), perMinuteCap: 100}
+		recorder := httptest.NewRecorder()
+		handleProtectedProxy(recorder, request, gatewayConfig, testApiRoute, replayCache, defaultRateLimitPolicy(rateLimiter), upstreamProxy)
+
+		if recorder.Code != http.StatusServiceUnavailable || upstreamCalled {
+			t.Fatalf("expected 503 without reaching the upstream, got %d", recorder.Code)
+		}
+		if !strings.Contains(recorder.Body.String(), wantErrorCode) {
+			t.Fatalf("expected %s, got %s", wantErrorCode, recorder.Body.String())
+		}
+	}
+}
+
+func TestReplayStore_RefusesNewProofsWhenFullUntilEntriesExpire(t *testing.T) {
+	originalTimeNow := timeNow
+	t.Cleanup(func() { timeNow = originalTimeNow })
+	fixedTime := time.Unix(1_700_000_000, 0)
+	timeNow = func() time.Time { return fixedTime }
+
+	store := newReplayStore(replayShardCount)
+	var fullErr error
+	for proofIndex := 0; proofIndex <= replayShardCount && fullErr == nil; proofIndex++ {
+		_, fullErr = store.markOnce("proof-"+strconv.Itoa(proofIndex), fixedTime.Add(time.Minute))
+	}
+	if !errors.Is(fullErr, errReplayCacheFull) {
+		t.Fatalf("expected a full shard to refuse new proofs, got %v", fullErr)
+	}
+	if firstUse, markErr := store.markOnce("proof-0", fixedTime.Add(time.Minute)); markErr != nil || firstUse {
+		t.Fatalf("expected a recorded proof to still read as a replay when full, got %v %v", firstUse, markErr)
+	}
+
+	fixedTime = fixedTime.Add(2 * time.Minute)
+	if firstUse, markErr := store.markOnce("proof-0", fixedTime.Add(time.Minute)); markErr != nil || !firstUse {
+		t.Fatalf("expected expired entries to free their slots, got %v %v", firstUse, markErr)
+	}
+}
+
+func TestReplayStore_PruneKeepsRemarkedProofs(t *testing.T) {
+	originalTimeNow := timeNow
+	t.Cleanup(func() { timeNow = originalTimeNow })
+	fixedTime := time.Unix(1_700_000_000, 0)
+	timeNow = func() time.Time { return fixedTime }
+
+	store := newReplayStore(defaultReplayCacheCapacity)
+	_, _ = store.markOnce("short", fixedTime.Add(time.Second))
+	_, _ = store.markOnce("long", fixedTime.Add(time.Hour))
+	fixedTime = fixedTime.Add(time.Minute)
+	if firstUse, _ := store.markOnce("short", fixedTime.Add(time.Hour)); !firstUse {
+		t.Fatalf("expected an expired proof ID to be accepted again")
+	}
+
+	store.prune()
+	if store.liveCount() != 2 {
+		t.Fatalf("expected the stale heap entry to leave the re-marked proof alone, got %d live", store.liveCount())
+	}
+	fixedTime = fixedTime.Add(2 * time.Hour)
+	store.prune()
+	if store.liveCount() != 0 {
+		t.Fatalf("expected every proof to be pruned, got %d live", store.liveCount())
+	}
+}
+
+func TestReplayStore_JanitorPrunesWithoutTraffic(t *testing.T) {
+	store := newReplayStore(defaultReplayCacheCapacity)
+	for proofIndex := 0; proofIndex < 100; proofIndex++ {
+		_, _ = store.markOnce("proof-"+strconv.Itoa(proofIndex), time.Now().Add(20*time.Millisecond))
+	}
+	stopJanitor := make(chan struct{})
+	defer close(stopJanitor)
+	go store.runJanitor(5*time.Millisecond, stopJanitor)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for store.liveCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the janitor to prune expired proofs, %d remain", store.liveCount())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLoadReplayCache_SelectsBackend(t *testing.T) {
+	t.Setenv(envKeyReplayStore, "")
+	if replayCache, loadErr := loadReplayCache(); loadErr != nil {
+		t.Fatalf("loadReplayCache: %v", loadErr)
+	} else if memoryStore, isMemory := replayCache.(*replayStore); !isMemory || memoryStore.shardCapacity != defaultReplayCacheCapacity/replayShardCount {
+		t.Fatalf("expected the in-process default, got %T", replayCache)
+	}
+	t.Setenv(envKeyReplayCacheCapacity, "6400")
+	if replayCache, _ := loadReplayCache(); replayCache.(*replayStore).shardCapacity != 100 {
+		t.Fatalf("expected %s to size the shards", envKeyReplayCacheCapacity)
+	}
+	t.Setenv(envKeyReplayCacheCapacity, "-1")
+	if _, loadErr := loadReplayCache(); loadErr == nil {
+		t.Fatalf("expected a non-positive capacity to be rejected")
+	}
+	t.Setenv(envKeyReplayStore, "redis")
+	t.Setenv(envKeyRedisURL, "")
+	if _, loadErr := loadReplayCache(); loadErr == nil {
+		t.Fatalf("expected redis without %s to be rejected", envKeyRedisURL)
+	}
+	t.Setenv(envKeyRedisURL, "redis://cache.internal:6380")
+	if replayCache, loadErr := loadReplayCache(); loadErr != nil {
+		t.Fatalf("loadReplayCache: %v", loadErr)
+	} else if _, isRedis := replayCache.(redisReplayStore); !isRedis {
+		t.Fatalf("expected a redis replay store, got %T", replayCache)
+	}
+	t.Setenv(envKeyReplayStore, "memcached")
+	if _, loadErr := loadReplayCache(); loadErr == nil {
+		t.Fatalf("expected an unknown backend to be rejected")
+	}
+}
+
+type failingReplayCache struct {
+	markError error
+}
+
+func (cache failingReplayCache) markOnce(string, time.Time) (bool, error) {
+	return false, cache.markError
+}
+
+func mustRedisReplayStore(t *testing.T, redisURL string) redisReplayStore {
+	t.Helper()
+	client, clientErr := newRedisClient(redisURL)
+	if clientErr != nil {
+		t.Fatalf("newRedisClient: %v", clientErr)
+	}
+	return redisReplayStore{client: client}
+}
+
+// The benchmarks hold 100k+ live proofs so a per-mark full sweep would dominate the profile.
+func BenchmarkReplayStore_MarkWith100kLiveProofs(b *testing.B) {
+	store := prefilledReplayStore(b, 100_000)
+	expiresAt := time.Now().Add(time.Hour)
+	b.ResetTimer()
+	for benchmarkIndex := 0; benchmarkIndex < b.N; benchmarkIndex++ {
+		_, _ = store.markOnce("bench-"+strconv.Itoa(benchmarkIndex), expiresAt)
+	}
+}
+
+func BenchmarkReplayStore_MarkParallelWith250kLiveProofs(b *testing.B) {
+	store := prefilledReplayStore(b, 250_000)
+	expiresAt := time.Now().Add(time.Hour)
+	var workerCounter atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(parallel *testing.PB) {
+		workerPrefix := "worker-" + strconv.FormatInt(workerCounter.Add(1), 10) + "-"
+		for proofIndex := 0; parallel.Next(); proofIndex++ {
+			_, _ = store.markOnce(workerPrefix+strconv.Itoa(proofIndex), expiresAt)
+		}
+	})
+}
+
+func prefilledReplayStore(b *testing.B, liveProofs int) *replayStore {
+	b.Helper()
+	store := newReplayStore(defaultReplayCacheCapacity * 10)
+	expiresAt := time.Now().Add(time.Hour)
+	for proofIndex := 0; proofIndex < liveProofs; proofIndex++ {
+		if _, markErr := store.markOnce("live-"+strconv.Itoa(proofIndex), expiresAt); markErr != nil {
+			b.Fatalf("markOnce: %v", markErr)
+		}
+	}
+	return store
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const legacyApiPathPrefix = "/api"
+
+var reservedPathPrefixes = []string{"/tvm", "/sdk", "/health", "/.well-known"}
+
+var defaultRouteMethods = []string{http.MethodGet, http.MethodPost}
+
+// OPTIONS is always answered by ETS.
+var proxiableMethods = map[string]struct{}{
+	http.MethodGet: {}, http.MethodHead: {}, http.MethodPost: {},
+	http.MethodPut: {}, http.MethodPatch: {}, http.MethodDelete: {},
+}
+
+type upstreamRoute struct {
+	PathPrefix      string
+	UpstreamBaseURL *url.URL
+	StripPrefix     bool
+	RewritePrefix   string
+	UpstreamAuth    upstreamAuthenticator
+	UpstreamTimeout time.Duration
+	RequestHeaders  headerPolicy
+	ResponseHeaders headerPolicy
+	// ForwardIdentity sends X-ETS-Jkt/Token-Id/Origin; IdentityAssertion adds a signed X-ETS-Assertion.
+	ForwardIdentity   bool
+	IdentityAssertion bool
+	// Streaming flushes every chunk and turns UpstreamTimeout into an idle timeout.
+	Streaming         bool
+	StreamMaxDuration time.Duration
+	WebSocket         bool
+	Methods           []string
+}
+
+type upstreamRoutesFile struct {
+	Routes []upstreamRouteConfig `json:"routes"`
+}
+
+type upstreamRouteConfig struct {
+	PathPrefix        string              `json:"pathPrefix"`
+	UpstreamBaseURL   string              `json:"upstreamBaseUrl"`
+	StripPrefix       bool                `json:"stripPrefix"`
+	RewritePrefix     string              `json:"rewritePrefix"`
+	UpstreamSecret    string              `json:"upstreamSecret"`
+	UpstreamSecretEnv string              `json:"upstreamSecretEnv"`
+	UpstreamAuth      *upstreamAuthConfig `json:"upstreamAuth"`
+	TimeoutSeconds    int                 `json:"timeoutSeconds"`
+	RequestHeaders    *headerPolicyConfig `json:"requestHeaders"`
+	ResponseHeaders   *headerPolicyConfig `json:"responseHeaders"`
+	ForwardIdentity   bool                `json:"forwardIdentity"`
+	IdentityAssertion bool                `json:"identityAssertion"`
+	Streaming         bool                `json:"streaming"`
+	StreamMaxSeconds  int                 `json:"streamMaxDurationSeconds"`
+	WebSocket         bool                `json:"websocket"`
+	Methods           []string            `json:"methods"`
+}
+
+func (route upstreamRoute) upstreamPath(publicPath string) string {
+	if !route.StripPrefix && route.RewritePrefix == "" {
+		return publicPath
+	}
+	remainingPath := strings.TrimPrefix(publicPath, route.PathPrefix)
+	rewrittenPath := strings.TrimSuffix(route.RewritePrefix, "/") + remainingPath
+	if !strings.HasPrefix(rewrittenPath, "/") {
+		rewrittenPath = "/" + rewrittenPath
+	}
+	return rewrittenPath
+}
+
+// upstreamRequestPath joins upstreamPath onto the base URL's path as the reverse proxy does.
+func (route upstreamRoute) upstreamRequestPath(publicPath string) string {
+	mappedPath := route.upstreamPath(publicPath)
+	if route.UpstreamBaseURL == nil || route.UpstreamBaseURL.Path == "" {
+		return mappedPath
+	}
+	return strings.TrimSuffix(route.UpstreamBaseURL.Path, "/") + "/" + strings.TrimPrefix(mappedPath, "/")
+}
+
+func (route upstreamRoute) allowedMethods() []string {
+	if len(route.Methods) == 0 {
+		return defaultRouteMethods
+	}
+	return route.Methods
+}
+
+func (route upstreamRoute) allowsMethod(httpMethod string) bool {
+	for _, allowedMethod := range route.allowedMethods() {
+		if allowedMethod == httpMethod {
+			return true
+		}
+	}
+	return false
+}
+
+func (route upstreamRoute) allowMethodsValue() string {
+	return strings.Join(append(append([]string{}, route.allowedMethods()...), http.MethodOptions), ", ")
+}
+
+func parseUpstreamRoutes(routesBytes []byte, defaultTimeout time.Duration) ([]upstreamRoute, error) {
+	var routesDocument upstreamRoutesFile
+	if unmarshalError := json.Unmarshal(routesBytes, &routesDocument); unmarshalError != nil {
+		return nil, fmt.Errorf("decode routes: %w", unmarshalError)
+	}
+	if len(routesDocument.Routes) == 0 {
+		return nil, fmt.Errorf("no routes defined")
+	}
+
+	parsedRoutes := make([]upstreamRoute, 0, len(routesDocument.Routes))
+	seenPrefixes := make(map[string]struct{})
+	for _, routeConfig := range routesDocument.Routes {
+		parsedRoute, routeError := routeConfig.build(defaultTimeout)
+		if routeError != nil {
+			return nil, fmt.Errorf("route %q: %w", routeConfig.PathPrefix, routeError)
+		}
+		if _, duplicate := seenPrefixes[parsedRoute.PathPrefix]; duplicate {
+			return nil, fmt.Errorf("route %q: duplicate pathPrefix", routeConfig.PathPrefix)
+		}
+		seenPrefixes[parsedRoute.PathPrefix] = struct{}{}
+		parsedRoutes = append(parsedRoutes, parsedRoute)
+	}
+	return parsedRoutes, nil
+}
+
+func (routeConfig upstreamRouteConfig) build(defaultTimeout time.Duration) (upstreamRoute, error) {
+	pathPrefix := strings.TrimSuffix(strings.TrimSpace(routeConfig.PathPrefix), "/")
+	if !strings.HasPrefix(pathPrefix, "/") {
+		return upstreamRoute{}, fmt.Errorf("pathPrefix must start with / and not be the root")
+	}
+	// http.ServeMux panics on pattern syntax, so only a plain, clean path is registered.
+	if path.Clean(pathPrefix) != pathPrefix || strings.ContainsAny(pathPrefix, "{}") || strings.IndexFunc(pathPrefix, unicode.IsSpace) >= 0 {
+		return upstreamRoute{}, fmt.Errorf("pathPrefix must be a clean path without spaces or {}")
+	}
+	for _, reservedPrefix := range reservedPathPrefixes {
+		if pathPrefix == reservedPrefix || strings.HasPrefix(pathPrefix, reservedPrefix+"/") {
+			return upstreamRoute{}, fmt.Errorf("pathPrefix collides with reserved %s", reservedPrefix)
+		}
+	}
+	if routeConfig.StripPrefix && routeConfig.RewritePrefix != "" {
+		return upstreamRoute{}, fmt.Errorf("stripPrefix and rewritePrefix are mutually exclusive")
+	}
+
+	upstreamBaseURL, parseURLError := parseUpstreamBaseURL(routeConfig.UpstreamBaseURL)
+	if parseURLError != nil {
+		return upstreamRoute{}, parseURLError
+	}
+
+	upstreamAuth, authError := routeConfig.upstreamAuthenticator()
+	if authError != nil {
+		return upstreamRoute{}, authError
+	}
+
+	upstreamTimeout := defaultTimeout
+	if routeConfig.TimeoutSeconds < 0 {
+		return upstreamRoute{}, fmt.Errorf("timeoutSeconds must be positive")
+	}
+	if routeConfig.TimeoutSeconds > 0 {
+		upstreamTimeout = time.Duration(routeConfig.TimeoutSeconds) * time.Second
+	}
+
+	if routeConfig.StreamMaxSeconds < 0 {
+		return upstreamRoute{}, fmt.Errorf("streamMaxDurationSeconds must be positive")
+	}
+	if routeConfig.StreamMaxSeconds > 0 && !routeConfig.Streaming {
+		return upstreamRoute{}, fmt.Errorf("streamMaxDurationSeconds requires streaming")
+	}
+
+	routeMethods, methodsError := parseRouteMethods(routeConfig.Methods)
+	if methodsError != nil {
+		return upstreamRoute{}, methodsError
+	}
+	if routeConfig.WebSocket && !(upstreamRoute{Methods: routeMethods}).allowsMethod(http.MethodGet) {
+		return upstreamRoute{}, fmt.Errorf("websocket requires GET in methods")
+	}
+
+	requestHeaders, requestHeadersError := routeConfig.RequestHeaders.build()
+	if requestHeadersError != nil {
+		return upstreamRoute{}, fmt.Errorf("requestHeaders %w", requestHeadersError)
+	}
+	responseHeaders, responseHeadersError := routeConfig.ResponseHeaders.build()
+	if responseHeadersError != nil {
+		return upstreamRoute{}, fmt.Errorf("responseHeaders %w", responseHeadersError)
+	}
+	if routeConfig.WebSocket {
+		requestHeaders.allowAlso(websocketHandshakeHeaders)
+		responseHeaders.allowAlso(websocketHandshakeHeaders)
+	}
+
+	return upstreamRoute{
+		PathPrefix:        pathPrefix,
+		UpstreamBaseURL:   upstreamBaseURL,
+		StripPrefix:       routeConfig.StripPrefix,
+		RewritePrefix:     routeConfig.RewritePrefix,
+		UpstreamAuth:      upstreamAuth,
+		UpstreamTimeout:   upstreamTimeout,
+		RequestHeaders:    requestHeaders,
+		ResponseHeaders:   responseHeaders,
+		ForwardIdentity:   routeConfig.ForwardIdentity || routeConfig.IdentityAssertion,
+		IdentityAssertion: routeConfig.IdentityAssertion,
+		Streaming:         routeConfig.Streaming,
+		StreamMaxDuration: time.Duration(routeConfig.StreamMaxSeconds) * time.Second,
+		WebSocket:         routeConfig.WebSocket,
+		Methods:           routeMethods,
+	}, nil
+}
+
+func parseRouteMethods(configuredMethods []string) ([]string, error) {
+	if len(configuredMethods) == 0 {
+		return nil, nil
+	}
+	routeMethods := make([]string, 0, len(configuredMethods))
+	seenMethods := make(map[string]struct{}, len(configuredMethods))
+	for _, configuredMethod := range configuredMethods {
+		httpMethod := strings.ToUpper(strings.TrimSpace(configuredMethod))
+		if _, proxiable := proxiableMethods[httpMethod]; !proxiable {
+			return nil, fmt.Errorf("unsupported method %q", configuredMethod)
+		}
+		if _, duplicate := seenMethods[httpMethod]; duplicate {
+			continue
+		}
+		seenMethods[httpMethod] = struct{}{}
+		routeMethods = append(routeMethods, httpMethod)
+	}
+	return routeMethods, nil
+}
+
+// The top-level upstreamSecret fields are shorthand for the `key` query parameter mode.
+func (routeConfig upstreamRouteConfig) upstreamAuthenticator() (upstreamAuthenticator, error) {
+	hasLegacySecret := routeConfig.UpstreamSecret != "" || routeConfig.UpstreamSecretEnv != ""
+	if routeConfig.UpstreamAuth != nil && hasLegacySecret {
+		return nil, fmt.Errorf("upstreamAuth and upstreamSecret are mutually exclusive")
+	}
+	if routeConfig.UpstreamAuth != nil {
+		return routeConfig.UpstreamAuth.build()
+	}
+	if !hasLegacySecret {
+		return nil, nil
+	}
+	return upstreamAuthConfig{
+		Mode:      upstreamAuthModeQuery,
+		Secret:    routeConfig.UpstreamSecret,
+		SecretEnv: routeConfig.UpstreamSecretEnv,
+	}.build()
+}
+
+func parseUpstreamBaseURL(rawURL string) (*url.URL, error) {
+	upstreamBaseURL, parseURLError := url.Parse(strings.TrimSpace(rawURL))
+	if parseURLError != nil {
+		return nil, fmt.Errorf("bad upstreamBaseUrl: %v", parseURLError)
+	}
+	if (upstreamBaseURL.Scheme != "http" && upstreamBaseURL.Scheme != "https") || upstreamBaseURL.Host == "" {
+		return nil, fmt.Errorf("upstreamBaseUrl must be an absolute http(s) URL")
+	}
+	return upstreamBaseURL, nil
+}
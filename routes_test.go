@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamRoute_UpstreamPathStripsOrRewritesPrefix(t *testing.T) {
+	testCases := []struct {
+		name       string
+		route      upstreamRoute
+		publicPath string
+		wantPath   string
+	}{
+		{"preserve", upstreamRoute{PathPrefix: "/api/search"}, "/api/search/q", "/api/search/q"},
+		{"strip", upstreamRoute{PathPrefix: "/api/search", StripPrefix: true}, "/api/search/q", "/q"},
+		{"strip exact", upstreamRoute{PathPrefix: "/api/search", StripPrefix: true}, "/api/search", "/"},
+		{"rewrite", upstreamRoute{PathPrefix: "/api/llm", RewritePrefix: "/v1/"}, "/api/llm/chat", "/v1/chat"},
+	}
+	for _, testCase := range testCases {
+		if gotPath := testCase.route.upstreamPath(testCase.publicPath); gotPath != testCase.wantPath {
+			t.Fatalf("%s: expected %s, got %s", testCase.name, testCase.wantPath, gotPath)
+		}
+	}
+}
+
+func TestParseUpstreamRoutes_AppliesDefaultsAndSecretEnv(t *testing.T) {
+	t.Setenv("SEARCH_SECRET", "search-secret")
+	parsedRoutes, parseErr := parseUpstreamRoutes([]byte(`{"routes":[
+		{"pathPrefix":"/api/search/","upstreamBaseUrl":"https://search.internal","stripPrefix":true,"upstreamSecretEnv":"SEARCH_SECRET"},
+		{"pathPrefix":"/api/llm","upstreamBaseUrl":"https://llm.internal","timeoutSeconds":120,"upstreamSecret":"inline"}
+	]}`), 40*time.Second)
+	if parseErr != nil {
+		t.Fatalf("parseUpstreamRoutes: %v", parseErr)
+	}
+	if len(parsedRoutes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(parsedRoutes))
+	}
+	searchRoute, llmRoute := parsedRoutes[0], parsedRoutes[1]
+	if searchRoute.PathPrefix != "/api/search" || searchRoute.UpstreamAuth != (queryParameterAuth{ParameterName: "key", Secret: "search-secret"}) || searchRoute.UpstreamTimeout != 40*time.Second {
+		t.Fatalf("unexpected search route: %+v", searchRoute)
+	}
+	if llmRoute.UpstreamTimeout != 120*time.Second || llmRoute.UpstreamAuth != (queryParameterAuth{ParameterName: "key", Secret: "inline"}) || llmRoute.UpstreamBaseURL.Host != "llm.internal" {
+		t.Fatalf("unexpected llm route: %+v", llmRoute)
+	}
+}
+
+func TestParseUpstreamRoutes_RejectsInvalidTables(t *testing.T) {
+	testCases := map[string]string{
+		"empty":              `{"routes":[]}`,
+		"relative prefix":    `{"routes":[{"pathPrefix":"api","upstreamBaseUrl":"https://a.internal"}]}`,
+		"root prefix":        `{"routes":[{"pathPrefix":"/","upstreamBaseUrl":"https://a.internal"}]}`,
+		"reserved prefix":    `{"routes":[{"pathPrefix":"/tvm/issue","upstreamBaseUrl":"https://a.internal"}]}`,
+		"duplicate prefix":   `{"routes":[{"pathPrefix":"/api","upstreamBaseUrl":"https://a.internal"},{"pathPrefix":"/api/","upstreamBaseUrl":"https://b.internal"}]}`,
+		"relative upstream":  `{"routes":[{"pathPrefix":"/api","upstreamBaseUrl":"a.internal"}]}`,
+		"strip and rewrite":  `{"routes":[{"pathPrefix":"/api","upstreamBaseUrl":"https://a.internal","stripPrefix":true,"rewritePrefix":"/v1"}]}`,
+		"missing secret env": `{"routes":[{"pathPrefix":"/api","upstreamBaseUrl":"https://a.internal","upstreamSecretEnv":"ETS_TEST_UNSET_SECRET"}]}`,
+	}
+	for testName, routesJSON := range testCases {
+		if _, parseErr := parseUpstreamRoutes([]byte(routesJSON), time.Second); parseErr == nil {
+			t.Fatalf("%s: expected routes to be rejected", testName)
+		}
+	}
+}
+
+func TestParseUpstreamRoutes_RejectsMuxPatternPrefixes(t *testing.T) {
+	for _, pathPrefix := range []string{"/api/{id}", "/api/{$}", "/a b", "GET /api", "/api//v1", "/api/../tvm", "/api/./v1", "/a\tpi"} {
+		routesJSON, marshalErr := json.Marshal(map[string]interface{}{"routes": []map[string]string{{"pathPrefix": pathPrefix, "upstreamBaseUrl": "https://a.internal"}}})
+		if marshalErr != nil {
+			t.Fatalf("json.Marshal: %v", marshalErr)
+		}
+		if _, parseErr := parseUpstreamRoutes(routesJSON, time.Second); parseErr == nil {
+			t.Fatalf("expected pathPrefix %q to be rejected", pathPrefix)
+		}
+	}
+}
+
+func TestParseUpstreamRoutes_Methods(t *testing.T) {
+	parsedRoutes, parseErr := parseUpstreamRoutes([]byte(`{"routes":[
+		{"pathPrefix":"/api/items","upstreamBaseUrl":"https://items.internal","methods":["get","put","PATCH","delete","GET"]},
+		{"pathPrefix":"/api/llm","upstreamBaseUrl":"https://llm.internal"}
+	]}`), time.Second)
+	if parseErr != nil {
+		t.Fatalf("parseUpstreamRoutes: %v", parseErr)
+	}
+	if got := parsedRoutes[0].allowMethodsValue(); got != "GET, PUT, PATCH, DELETE, OPTIONS" {
+		t.Fatalf("unexpected methods %q", got)
+	}
+	if parsedRoutes[0].allowsMethod(http.MethodPost) || !parsedRoutes[1].allowsMethod(http.MethodPost) || parsedRoutes[1].allowsMethod(http.MethodDelete) {
+		t.Fatalf("expected explicit methods to replace the GET/POST default")
+	}
+
+	for _, invalidRoute := range []string{
+		`{"pathPrefix":"/api","upstreamBaseUrl":"https://a.internal","methods":["TRACE"]}`,
+		`{"pathPrefix":"/api","upstreamBaseUrl":"https://a.internal","methods":["POST"],"websocket":true}`,
+	} {
+		if _, parseErr := parseUpstreamRoutes([]byte(`{"routes":[`+invalidRoute+`]}`), time.Second); parseErr == nil {
+			t.Fatalf("expected %s to be rejected", invalidRoute)
+		}
+	}
+}
+
+func TestNewHTTPServer_RoutesPrefixesToDistinctUpstreams(t *testing.T) {
+	type upstreamHit struct {
+		path string
+		key  string
+	}
+	searchHits := make(chan upstreamHit, 1)
+	searchUpstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		searchHits <- upstreamHit{request.URL.Path, request.URL.Query().Get("key")}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer searchUpstream.Close()
+	llmHits := make(chan upstreamHit, 1)
+	llmUpstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		llmHits <- upstreamHit{request.URL.Path, request.URL.Query().Get("key")}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer llmUpstream.Close()
+
+	parsedRoutes, parseErr := parseUpstreamRoutes([]byte(fmt.Sprintf(`{"routes":[
+		{"pathPrefix":"/api/search","upstreamBaseUrl":%q,"stripPrefix":true,"upstreamSecret":"search-secret"},
+		{"pathPrefix":"/api/llm","upstreamBaseUrl":%q,"rewritePrefix":"/v1","upstreamSecret":"llm-secret"}
+	]}`, searchUpstream.URL, llmUpstream.URL)), 10*time.Second)
+	if parseErr != nil {
+		t.Fatalf("parseUpstreamRoutes: %v", parseErr)
+	}
+
+	tokenSigningKey := []byte("0123456789abcdef0123456789abcdef")
+	httpServer := newHTTPServer(serverConfig{
+		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:      5 * time.Minute,
+		JwtHmacKey:         tokenSigningKey,
+		UpstreamRoutes:     parsedRoutes,
+		RateLimitPerMinute: 100,
+		UpstreamTimeout:    10 * time.Second,
+	})
+
+	dpopKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	dpopJwk := publicJwk{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(dpopKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(dpopKey.Y.FillBytes(make([]byte, 32))),
+	}
+	thumbprint, thumbErr := jwkThumbprint(dpopJwk)
+	if thumbErr != nil {
+		t.Fatalf("jwkThumbprint: %v", thumbErr)
+	}
+	accessToken := issueTestAccessTokenWithThumbprint(t, tokenSigningKey, "token-routes", thumbprint)
+
+	testCases := []struct {
+		requestURL string
+		hits       chan upstreamHit
+		want       upstreamHit
+	}{
+		{"http://ets.example/api/search/web", searchHits, upstreamHit{"/web", "search-secret"}},
+		{"http://ets.example/api/llm/chat", llmHits, upstreamHit{"/v1/chat", "llm-secret"}},
+	}
+	for requestIndex, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, testCase.requestURL, strings.NewReader(`{}`))
+		request.Header.Set("Origin", "https://app.example.com")
+		request.Header.Set("Authorization", "Bearer "+accessToken)
+		request.Header.Set(headerDpop, mustCreateDpopProof(t, dpopKey, dpopJwk, http.MethodPost, testCase.requestURL, fmt.Sprintf("route-proof-%d", requestIndex), time.Now()))
+
+		httpServer.Handler.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNoContent {
+			t.Fatalf("%s: expected 204, got %d (%s)", testCase.requestURL, recorder.Code, recorder.Body.String())
+		}
+		select {
+		case gotHit := <-testCase.hits:
+			if gotHit != testCase.want {
+				t.Fatalf("%s: expected upstream hit %+v, got %+v", testCase.requestURL, testCase.want, gotHit)
+			}
+		default:
+			t.Fatalf("%s: expected the request to reach its own upstream", testCase.requestURL)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "http://ets.example/api/other", nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	httpServer.Handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected unrouted path to return 404, got %d", recorder.Code)
+	}
+}
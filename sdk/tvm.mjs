@@ -6,11 +6,15 @@
  *   baseUrl: string,                       // e.g., "https://ets.mprlab.com"
  *   tokenPath?: string,                    // default "/tvm/issue"
  *   apiPath?: string,                      // default "/api"
+ *   maxRateLimitRetries?: number,          // default 1; 429s retried after Retry-After
+ *   maxRetryDelayMs?: number,              // default 10000; longer waits return the 429
  * }
  *
  * Returns: {
  *   postJson(payload: any, init?: {signal?: AbortSignal, path?: string}): Promise<any>
  *   fetchResponse(payload: any, init?: {signal?: AbortSignal, path?: string}): Promise<Response>
+ *   openWebSocket(path: string, protocols?: string[]): Promise<WebSocket>
+ *   rateLimit(): {limit: number, remaining: number, resetSeconds: number} | null
  * }
  */
 
@@ -18,6 +22,8 @@ export function createGatewayClient(options) {
   const normalizedOptions = normalizeOptions(options);
   const keyState = { cryptoKeyPair: null };
   const tokenState = { accessToken: null, expiresAtEpochSeconds: 0 };
+  const rateLimitState = { retryAtMs: 0, latest: null };
+  const nonceState = { value: null };
 
   async function postJson(requestPayload, init) {
     const response = await fetchResponse(requestPayload, init);
@@ -33,7 +39,31 @@ export function createGatewayClient(options) {
     return jsonBody;
   }
 
+  // fetchResponse waits out any Retry-After the gateway announced, then retries a 429 with a
+  // fresh DPoP proof while the wait stays within maxRetryDelayMs. A 401 that hands out a new
+  // DPoP-Nonce (use_dpop_nonce) is retried once with that nonce.
   async function fetchResponse(requestPayload, init) {
+    let rateLimitRetries = 0;
+    let nonceRetried = false;
+    for (;;) {
+      await waitUntil(rateLimitState.retryAtMs, init?.signal);
+      const sentNonce = nonceState.value;
+      const response = await sendOnce(requestPayload, init);
+      recordRateLimit(rateLimitState, response);
+      recordDpopNonce(nonceState, response);
+      if (response.status === 401 && !nonceRetried && nonceState.value !== sentNonce) {
+        nonceRetried = true;
+        continue;
+      }
+      const retryDelayMs = rateLimitState.retryAtMs - Date.now();
+      if (response.status !== 429 || rateLimitRetries >= normalizedOptions.maxRateLimitRetries || retryDelayMs > normalizedOptions.maxRetryDelayMs) {
+        return response;
+      }
+      rateLimitRetries++;
+    }
+  }
+
+  async function sendOnce(requestPayload, init) {
     const effectivePath = init?.path || normalizedOptions.apiPath;
     const requestUrl = joinUrl(normalizedOptions.baseUrl, effectivePath);
     const methodName = (init?.method || "POST").toUpperCase();
@@ -42,13 +72,17 @@ export function createGatewayClient(options) {
     const { accessToken } = await ensureAccessToken({
       normalizedOptions,
       cryptoKeyPair,
-      tokenState
+      tokenState,
+      rateLimitState,
+      nonceState
     });
 
     const dpopJwt = await createDpopJwt({
       requestUrl: requestUrl,
       httpMethod: methodName,
-      cryptoKeyPair: cryptoKeyPair
+      cryptoKeyPair: cryptoKeyPair,
+      nonce: nonceState.value,
+      accessToken: accessToken
     });
 
     const headers = {
@@ -75,7 +109,39 @@ export function createGatewayClient(options) {
     return response;
   }
 
-  return { postJson, fetchResponse };
+  // Browsers cannot set headers on WebSocket upgrades, so the token and proof travel as
+  // Sec-WebSocket-Protocol entries; ETS strips them and answers "ets" if the upstream picks none.
+  async function openWebSocket(path, protocols) {
+    const requestUrl = joinUrl(normalizedOptions.baseUrl, path || normalizedOptions.apiPath);
+    const cryptoKeyPair = await ensureKeyPair(keyState);
+    const { accessToken } = await ensureAccessToken({
+      normalizedOptions,
+      cryptoKeyPair,
+      tokenState,
+      rateLimitState,
+      nonceState
+    });
+    const dpopJwt = await createDpopJwt({
+      requestUrl: requestUrl,
+      httpMethod: "GET",
+      cryptoKeyPair: cryptoKeyPair,
+      nonce: nonceState.value,
+      accessToken: accessToken
+    });
+    const socketUrl = requestUrl.replace(/^http/, "ws");
+    return new WebSocket(socketUrl, [
+      "ets",
+      ...(protocols || []),
+      "ets-access-token." + accessToken,
+      "ets-dpop." + dpopJwt
+    ]);
+  }
+
+  function rateLimit() {
+    return rateLimitState.latest;
+  }
+
+  return { postJson, fetchResponse, openWebSocket, rateLimit };
 }
 
 /* ---------- internals ---------- */
@@ -87,10 +153,50 @@ function normalizeOptions(options) {
   return {
     baseUrl: options.baseUrl.replace(/\/+$/, ""),
     tokenPath: options.tokenPath || "/tvm/issue",
-    apiPath: options.apiPath || "/api"
+    apiPath: options.apiPath || "/api",
+    maxRateLimitRetries: Number.isInteger(options.maxRateLimitRetries) ? options.maxRateLimitRetries : 1,
+    maxRetryDelayMs: Number.isFinite(options.maxRetryDelayMs) ? options.maxRetryDelayMs : 10000
   };
 }
 
+// recordRateLimit keeps the latest RateLimit-* snapshot and, on a 429, when to try again.
+function recordRateLimit(rateLimitState, response) {
+  const limitHeader = response.headers.get("RateLimit-Limit");
+  if (limitHeader !== null) {
+    rateLimitState.latest = {
+      limit: Number(limitHeader),
+      remaining: Number(response.headers.get("RateLimit-Remaining") || 0),
+      resetSeconds: Number(response.headers.get("RateLimit-Reset") || 0)
+    };
+  }
+  if (response.status === 429) {
+    const retryAfterSeconds = Number(response.headers.get("Retry-After") || 1);
+    rateLimitState.retryAtMs = Date.now() + Math.max(retryAfterSeconds, 1) * 1000;
+  }
+}
+
+// recordDpopNonce keeps the latest server nonce; the gateway sends one with issued tokens,
+// verified responses, and use_dpop_nonce challenges.
+function recordDpopNonce(nonceState, response) {
+  const nonceHeader = response.headers.get("DPoP-Nonce");
+  if (nonceHeader) {
+    nonceState.value = nonceHeader;
+  }
+}
+
+function waitUntil(epochMs, signal) {
+  const delayMs = epochMs - Date.now();
+  if (delayMs <= 0) return Promise.resolve();
+  if (signal?.aborted) return Promise.reject(signal.reason);
+  return new Promise((resolve, reject) => {
+    const timer = setTimeout(resolve, delayMs);
+    signal?.addEventListener("abort", () => {
+      clearTimeout(timer);
+      reject(signal.reason);
+    }, { once: true });
+  });
+}
+
 async function ensureKeyPair(state) {
   if (state.cryptoKeyPair) return state.cryptoKeyPair;
   const generatedKeyPair = await crypto.subtle.generateKey(
@@ -102,7 +208,7 @@ async function ensureKeyPair(state) {
   return generatedKeyPair;
 }
 
-async function ensureAccessToken({ normalizedOptions, cryptoKeyPair, tokenState }) {
+async function ensureAccessToken({ normalizedOptions, cryptoKeyPair, tokenState, rateLimitState, nonceState }) {
   const marginSeconds = 20;
   const nowSeconds = Math.floor(Date.now() / 1000);
   if (tokenState.accessToken && tokenState.expiresAtEpochSeconds - nowSeconds > marginSeconds) {
@@ -114,11 +220,19 @@ async function ensureAccessToken({ normalizedOptions, cryptoKeyPair, tokenState
     dpopPublicJwk: { kty: publicJwk.kty, crv: publicJwk.crv, x: publicJwk.x, y: publicJwk.y }
   };
 
-  const tokenResponse = await fetch(joinUrl(normalizedOptions.baseUrl, normalizedOptions.tokenPath), {
+  const tokenUrl = joinUrl(normalizedOptions.baseUrl, normalizedOptions.tokenPath);
+  const issueProof = await createDpopJwt({ requestUrl: tokenUrl, httpMethod: "POST", cryptoKeyPair: cryptoKeyPair });
+  const tokenResponse = await fetch(tokenUrl, {
     method: "POST",
-    headers: { "Content-Type": "application/json" },
+    headers: { "Content-Type": "application/json", "DPoP": issueProof },
     body: JSON.stringify(requestBody)
   });
+  if (rateLimitState) {
+    recordRateLimit(rateLimitState, tokenResponse);
+  }
+  if (nonceState) {
+    recordDpopNonce(nonceState, tokenResponse);
+  }
   if (!tokenResponse.ok) {
     const textBody = await tokenResponse.text();
     throw new Error("Token vending failed: " + tokenResponse.status + " " + textBody);
@@ -149,7 +263,7 @@ function joinUrl(base, path) {
   return left + right;
 }
 
-async function createDpopJwt({ requestUrl, httpMethod, cryptoKeyPair }) {
+async function createDpopJwt({ requestUrl, httpMethod, cryptoKeyPair, nonce, accessToken }) {
   const parsed = new URL(requestUrl);
   const protectedHeader = { typ: "dpop+jwt", alg: "ES256" };
   const publicJwk = await crypto.subtle.exportKey("jwk", cryptoKeyPair.publicKey);
@@ -161,6 +275,13 @@ async function createDpopJwt({ requestUrl, httpMethod, cryptoKeyPair }) {
     jti: crypto.randomUUID(),
     iat: Math.floor(Date.now() / 1000)
   };
+  if (nonce) {
+    payload.nonce = nonce;
+  }
+  if (accessToken) {
+    const tokenDigest = await crypto.subtle.digest("SHA-256", new TextEncoder().encode(accessToken));
+    payload.ath = base64UrlEncodeBytes(new Uint8Array(tokenDigest));
+  }
 
   const signingInput = base64UrlEncodeFromObject(protectedHeader) + "." + base64UrlEncodeFromObject(payload);
   const signatureDer = await crypto.subtle.sign(
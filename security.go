@@ -1,13 +1,10 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/big"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -20,6 +17,7 @@ const (
 	headerAccessControlAllowHeaders = "Access-Control-Allow-Headers"
 	headerAccessControlAllowMethods = "Access-Control-Allow-Methods"
 	headerVary                      = "Vary"
+	headerAllow                     = "Allow"
 
 	headerAllowHeadersValue = "Authorization, Content-Type, DPoP"
 	headerAllowMethodsValue = "GET, POST, OPTIONS"
@@ -29,12 +27,11 @@ const (
 	forwardedProtoHeader = "X-Forwarded-Proto"
 )
 
-type publicJwk struct {
-	KeyType string `json:"kty"`
-	Curve   string `json:"crv"`
-	X       string `json:"x"`
-	Y       string `json:"y"`
-}
+// forbiddenDpopHeaderMembers point at keys other than the embedded jwk, or (crit) demand
+// extensions ETS does not implement; a DPoP proof carrying any of them is rejected.
+var forbiddenDpopHeaderMembers = []string{"crit", "kid", "jku", "x5c", "x5u"}
+
+var errUnexpectedJwsHeader = errors.New("unexpected JWS header member")
 
 type dpopHeader struct {
 	Type string    `json:"typ"`
@@ -43,10 +40,12 @@ type dpopHeader struct {
 }
 
 type dpopPayload struct {
-	HttpMethod string `json:"htm"`
-	HttpUri    string `json:"htu"`
-	JwtID      string `json:"jti"`
-	IssuedAt   int64  `json:"iat"`
+	HttpMethod      string `json:"htm"`
+	HttpUri         string `json:"htu"`
+	JwtID           string `json:"jti"`
+	IssuedAt        int64  `json:"iat"`
+	Nonce           string `json:"nonce,omitempty"`
+	AccessTokenHash string `json:"ath,omitempty"`
 }
 
 type confirmation struct {
@@ -58,12 +57,6 @@ type accessClaims struct {
 	Confirmation confirmation `json:"cnf"`
 }
 
-func jwkThumbprint(jwkObject publicJwk) (string, error) {
-	canonical := fmt.Sprintf("{\"crv\":\"%s\",\"kty\":\"%s\",\"x\":\"%s\",\"y\":\"%s\"}", jwkObject.Curve, jwkObject.KeyType, jwkObject.X, jwkObject.Y)
-	sha256Digest := sha256.Sum256([]byte(canonical))
-	return base64.RawURLEncoding.EncodeToString(sha256Digest[:]), nil
-}
-
 func parseCompactJws(compactJwsString string) (dpopHeader, dpopPayload, []byte, []byte, error) {
 	parts := stringsSplit(compactJwsString, ".")
 	if len(parts) != 3 {
@@ -83,42 +76,21 @@ func parseCompactJws(compactJwsString string) (dpopHeader, dpopPayload, []byte,
 	}
 	var headerObject dpopHeader
 	var payloadObject dpopPayload
-	if json.Unmarshal(headerBytes, &headerObject) != nil {
+	var headerMembers map[string]json.RawMessage
+	if json.Unmarshal(headerBytes, &headerMembers) != nil || json.Unmarshal(headerBytes, &headerObject) != nil {
 		return dpopHeader{}, dpopPayload{}, nil, nil, fmt.Errorf("hdr")
 	}
+	for _, forbiddenMember := range forbiddenDpopHeaderMembers {
+		if _, present := headerMembers[forbiddenMember]; present {
+			return dpopHeader{}, dpopPayload{}, nil, nil, fmt.Errorf("%w %q", errUnexpectedJwsHeader, forbiddenMember)
+		}
+	}
 	if json.Unmarshal(payloadBytes, &payloadObject) != nil {
 		return dpopHeader{}, dpopPayload{}, nil, nil, fmt.Errorf("pl")
 	}
 	return headerObject, payloadObject, []byte(parts[0] + "." + parts[1]), signatureBytes, nil
 }
 
-func ecdsaKeyFromJwk(jwkObject publicJwk) (*ecdsa.PublicKey, error) {
-	if jwkObject.KeyType != "EC" || jwkObject.Curve != "P-256" {
-		return nil, fmt.Errorf("unsupported")
-	}
-	xCoordinateBytes, decodeXError := base64.RawURLEncoding.DecodeString(jwkObject.X)
-	if decodeXError != nil {
-		return nil, decodeXError
-	}
-	yCoordinateBytes, decodeYError := base64.RawURLEncoding.DecodeString(jwkObject.Y)
-	if decodeYError != nil {
-		return nil, decodeYError
-	}
-	xCoordinate := new(big.Int).SetBytes(xCoordinateBytes)
-	yCoordinate := new(big.Int).SetBytes(yCoordinateBytes)
-	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: xCoordinate, Y: yCoordinate}, nil
-}
-
-func verifyEs256(signingInput []byte, joseSignature []byte, publicKey *ecdsa.PublicKey) bool {
-	if len(joseSignature) != 64 {
-		return false
-	}
-	rComponent := new(big.Int).SetBytes(joseSignature[:32])
-	sComponent := new(big.Int).SetBytes(joseSignature[32:])
-	digest := sha256.Sum256(signingInput)
-	return ecdsa.Verify(publicKey, digest[:], rComponent, sComponent)
-}
-
 func audienceHas(audience jwt.ClaimStrings, expected string) bool {
 	for _, value := range audience {
 		if value == expected {
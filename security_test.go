@@ -18,14 +18,15 @@ func TestEcdsaKeyFromJwk_RoundTrip(t *testing.T) {
 	publicJwk := publicJwk{
 		KeyType: "EC",
 		Curve:   "P-256",
-		X:       base64.RawURLEncoding.EncodeToString(publicKey.X.Bytes()),
-		Y:       base64.RawURLEncoding.EncodeToString(publicKey.Y.Bytes()),
+		X:       base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, 32))),
 	}
-	parsed, parseErr := ecdsaKeyFromJwk(publicJwk)
+	parsedKey, parseErr := publicKeyFromJwk(publicJwk)
 	if parseErr != nil {
-		t.Fatalf("ecdsaKeyFromJwk: %v", parseErr)
+		t.Fatalf("publicKeyFromJwk: %v", parseErr)
 	}
-	if parsed.X.Cmp(publicKey.X) != 0 || parsed.Y.Cmp(publicKey.Y) != 0 {
+	parsed, isEcdsa := parsedKey.(*ecdsa.PublicKey)
+	if !isEcdsa || parsed.X.Cmp(publicKey.X) != 0 || parsed.Y.Cmp(publicKey.Y) != 0 {
 		t.Fatalf("parsed key does not match original")
 	}
 }
@@ -46,17 +47,43 @@ func TestVerifyEs256_ValidAndInvalid(t *testing.T) {
 	copy(signatureJose[32-len(rInt.Bytes()):32], rInt.Bytes())
 	copy(signatureJose[64-len(sInt.Bytes()):64], sInt.Bytes())
 
-	if !verifyEs256(signingInput, signatureJose, &privateKey.PublicKey) {
+	verifyEs256 := dpopAlgorithms["ES256"].verify
+	if !verifyEs256(&privateKey.PublicKey, signingInput, signatureJose) {
 		t.Fatalf("verifyEs256 should accept a valid signature")
 	}
 
 	// flip a bit -> must fail
 	signatureJose[0] ^= 0x01
-	if verifyEs256(signingInput, signatureJose, &privateKey.PublicKey) {
+	if verifyEs256(&privateKey.PublicKey, signingInput, signatureJose) {
 		t.Fatalf("verifyEs256 should reject a tampered signature")
 	}
 }
 
+func TestParseCompactJws_SplitsAndRejectsMalformedInput(t *testing.T) {
+	headerPart := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"dpop+jwt","alg":"ES256"}`))
+	payloadPart := base64.RawURLEncoding.EncodeToString([]byte(`{"htm":"GET","jti":"j1"}`))
+	signaturePart := base64.RawURLEncoding.EncodeToString([]byte("sig"))
+
+	header, payload, signingInput, signature, parseErr := parseCompactJws(headerPart + "." + payloadPart + "." + signaturePart)
+	if parseErr != nil {
+		t.Fatalf("parseCompactJws: %v", parseErr)
+	}
+	if header.Alg != "ES256" || payload.HttpMethod != "GET" || payload.JwtID != "j1" || string(signingInput) != headerPart+"."+payloadPart || string(signature) != "sig" {
+		t.Fatalf("unexpected parse result %+v %+v %q %q", header, payload, signingInput, signature)
+	}
+
+	for _, malformed := range []string{
+		headerPart + "." + payloadPart,
+		headerPart + "." + payloadPart + "." + signaturePart + ".extra",
+		"%%%." + payloadPart + "." + signaturePart,
+		headerPart + "." + base64.RawURLEncoding.EncodeToString([]byte("not json")) + "." + signaturePart,
+	} {
+		if _, _, _, _, parseErr := parseCompactJws(malformed); parseErr == nil {
+			t.Fatalf("expected %q to be rejected", malformed)
+		}
+	}
+}
+
 // helper: sha256 over bytes returning digest
 func sha256sum(data []byte) []byte {
 	sum := sha256.New()
@@ -1,54 +1,89 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"time"
 )
 
-func newReverseProxy(gatewayConfig serverConfig) *httputil.ReverseProxy {
-	reverseProxy := httputil.NewSingleHostReverseProxy(gatewayConfig.UpstreamBaseURL)
+func newReverseProxy(route upstreamRoute) *httputil.ReverseProxy {
+	reverseProxy := httputil.NewSingleHostReverseProxy(route.UpstreamBaseURL)
+	if route.Streaming {
+		reverseProxy.FlushInterval = streamFlushImmediately
+	}
 	originalDirector := reverseProxy.Director
 	reverseProxy.Director = func(incomingRequest *http.Request) {
+		if upstreamPath := route.upstreamPath(incomingRequest.URL.Path); upstreamPath != incomingRequest.URL.Path {
+			incomingRequest.URL.Path = upstreamPath
+			incomingRequest.URL.RawPath = ""
+		}
 		originalDirector(incomingRequest)
-		if gatewayConfig.UpstreamSecretKey != "" {
-			queryValues := incomingRequest.URL.Query()
-			queryValues.Set("key", gatewayConfig.UpstreamSecretKey)
-			incomingRequest.URL.RawQuery = queryValues.Encode()
+		stripClientCredentials(incomingRequest.Header)
+		route.RequestHeaders.apply(incomingRequest.Header)
+		applyCallerIdentity(incomingRequest, route)
+		if route.UpstreamAuth != nil {
+			if authError := route.UpstreamAuth.authenticate(incomingRequest); authError != nil {
+				log.Printf("upstream auth error: %v", authError)
+				incomingRequest.Body = failingBody{cause: authError}
+			}
+		}
+	}
+	if route.UpstreamAuth != nil {
+		reverseProxy.Transport = authFailureGuardTransport{next: http.DefaultTransport}
+	}
+	reverseProxy.ModifyResponse = func(upstreamResponse *http.Response) error {
+		dropUpstreamRateLimitHeaders(upstreamResponse)
+		route.ResponseHeaders.apply(upstreamResponse.Header)
+		if route.WebSocket {
+			selectWebSocketMarker(upstreamResponse)
 		}
+		return nil
 	}
 	reverseProxy.ErrorHandler = func(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, proxyError error) {
 		log.Printf("reverse proxy error: %v", proxyError)
+		if errors.Is(proxyError, errSignedBodyTooLarge) {
+			httpErrorJSON(httpResponseWriter, http.StatusRequestEntityTooLarge, "request_too_large")
+			return
+		}
 		httpErrorJSON(httpResponseWriter, http.StatusBadGateway, "upstream_error")
 	}
 	return reverseProxy
 }
 
 func newHTTPServer(gatewayConfig serverConfig) *http.Server {
-	// reverse proxy (base origin only, no path)
-	upstreamReverseProxy := newReverseProxy(gatewayConfig)
-
-	replayCacheStore := &replayStore{seen: make(map[string]int64)}
-	rateLimiterWindow := &windowLimiter{
-		windowEnd:    timeNow().Unix() + 60,
-		counts:       make(map[string]int),
-		perMinuteCap: gatewayConfig.RateLimitPerMinute,
+	var replayCacheStore proofReplayCache = newReplayStore(defaultReplayCacheCapacity)
+	if gatewayConfig.ReplayCache != nil {
+		replayCacheStore = gatewayConfig.ReplayCache
+	}
+	stopJanitor := make(chan struct{})
+	if janitor, needsJanitor := replayCacheStore.(replayJanitor); needsJanitor {
+		go janitor.runJanitor(replayJanitorInterval, stopJanitor)
 	}
+	requestRateLimits := newRateLimitPolicy(gatewayConfig)
+	tokenIssueGuard := newIssuanceGuard(gatewayConfig)
 
 	httpServerMux := http.NewServeMux()
 	AttachGatewaySdk(httpServerMux)
 	httpServerMux.HandleFunc("/tvm/issue", func(httpResponseWriter http.ResponseWriter, httpRequest *http.Request) {
-		handleTokenIssue(httpResponseWriter, httpRequest, gatewayConfig)
+		handleTokenIssue(httpResponseWriter, httpRequest, gatewayConfig, tokenIssueGuard)
 	})
-	protectedProxyHandler := func(httpResponseWriter http.ResponseWriter, httpRequest *http.Request) {
-		handleProtectedProxy(httpResponseWriter, httpRequest, gatewayConfig, replayCacheStore, rateLimiterWindow, upstreamReverseProxy)
+	for _, route := range gatewayConfig.UpstreamRoutes {
+		// one reverse proxy per route so upstreams never share settings
+		upstreamReverseProxy := newReverseProxy(route)
+		protectedProxyHandler := func(httpResponseWriter http.ResponseWriter, httpRequest *http.Request) {
+			handleProtectedProxy(httpResponseWriter, httpRequest, gatewayConfig, route, replayCacheStore, requestRateLimits, upstreamReverseProxy)
+		}
+		httpServerMux.HandleFunc(route.PathPrefix, protectedProxyHandler)
+		httpServerMux.HandleFunc(route.PathPrefix+"/", protectedProxyHandler)
 	}
-	httpServerMux.HandleFunc("/api", protectedProxyHandler)
-	httpServerMux.HandleFunc("/api/", protectedProxyHandler)
 	httpServerMux.HandleFunc("/health", handleHealth)
+	httpServerMux.HandleFunc("/.well-known/jwks.json", func(httpResponseWriter http.ResponseWriter, httpRequest *http.Request) {
+		handleJwks(httpResponseWriter, httpRequest, gatewayConfig)
+	})
 
-	return &http.Server{
+	httpServer := &http.Server{
 		Addr:              gatewayConfig.ListenAddress,
 		Handler:           httpServerMux,
 		ReadHeaderTimeout: 10 * time.Second,
@@ -56,6 +91,8 @@ func newHTTPServer(gatewayConfig serverConfig) *http.Server {
 		WriteTimeout:      60 * time.Second,
 		IdleTimeout:       120 * time.Second,
 	}
+	httpServer.RegisterOnShutdown(func() { close(stopJanitor) })
+	return httpServer
 }
 
 // tiny indirection to ease testing (can be stubbed)
@@ -14,12 +14,13 @@ func TestNewReverseProxy_AppendsSecretWhenMissing(t *testing.T) {
 	if parseErr != nil {
 		t.Fatalf("url.Parse: %v", parseErr)
 	}
-	config := serverConfig{
-		UpstreamBaseURL:   upstreamURL,
-		UpstreamSecretKey: "super-secret",
+	route := upstreamRoute{
+		PathPrefix:      "/api",
+		UpstreamBaseURL: upstreamURL,
+		UpstreamAuth:    queryParameterAuth{ParameterName: "key", Secret: "super-secret"},
 	}
 
-	reverseProxy := newReverseProxy(config)
+	reverseProxy := newReverseProxy(route)
 	request, requestErr := http.NewRequest(http.MethodGet, "http://ets.example/api?prompt=hi", nil)
 	if requestErr != nil {
 		t.Fatalf("http.NewRequest: %v", requestErr)
@@ -41,12 +42,13 @@ func TestNewReverseProxy_OverridesExistingSecret(t *testing.T) {
 	if parseErr != nil {
 		t.Fatalf("url.Parse: %v", parseErr)
 	}
-	config := serverConfig{
-		UpstreamBaseURL:   upstreamURL,
-		UpstreamSecretKey: "super-secret",
+	route := upstreamRoute{
+		PathPrefix:      "/api",
+		UpstreamBaseURL: upstreamURL,
+		UpstreamAuth:    queryParameterAuth{ParameterName: "key", Secret: "super-secret"},
 	}
 
-	reverseProxy := newReverseProxy(config)
+	reverseProxy := newReverseProxy(route)
 	request, requestErr := http.NewRequest(http.MethodGet, "http://ets.example/api?prompt=hi&key=user", nil)
 	if requestErr != nil {
 		t.Fatalf("http.NewRequest: %v", requestErr)
@@ -69,8 +71,7 @@ func TestNewHTTPServer_RoutesApiSubpaths(t *testing.T) {
 		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
 		TokenLifetime:      5 * time.Minute,
 		JwtHmacKey:         []byte("0123456789abcdef0123456789abcdef"),
-		UpstreamBaseURL:    upstreamURL,
-		UpstreamSecretKey:  "",
+		UpstreamRoutes:     []upstreamRoute{{PathPrefix: "/api", UpstreamBaseURL: upstreamURL, UpstreamTimeout: 10 * time.Second}},
 		RateLimitPerMinute: 60,
 		UpstreamTimeout:    10 * time.Second,
 	}
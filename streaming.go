@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const streamFlushImmediately = -1
+
+// The upstream timeout is an idle timeout here: every chunk restarts it, capped by the
+// route's maximum stream duration.
+type streamingResponseWriter struct {
+	http.ResponseWriter
+	responseController *http.ResponseController
+	idleTimer          *time.Timer
+	idleTimeout        time.Duration
+	streamDeadline     time.Time
+}
+
+func (streamWriter *streamingResponseWriter) Write(chunk []byte) (int, error) {
+	streamWriter.keepAlive()
+	return streamWriter.ResponseWriter.Write(chunk)
+}
+
+func (streamWriter *streamingResponseWriter) Flush() {
+	_ = streamWriter.responseController.Flush()
+}
+
+func (streamWriter *streamingResponseWriter) Unwrap() http.ResponseWriter {
+	return streamWriter.ResponseWriter
+}
+
+func (streamWriter *streamingResponseWriter) keepAlive() {
+	streamWriter.idleTimer.Reset(streamWriter.idleTimeout)
+	streamWriter.extendWriteDeadline()
+}
+
+// Writers without deadline support are left alone.
+func (streamWriter *streamingResponseWriter) extendWriteDeadline() {
+	writeDeadline := timeNow().Add(streamWriter.idleTimeout)
+	if !streamWriter.streamDeadline.IsZero() && writeDeadline.After(streamWriter.streamDeadline) {
+		writeDeadline = streamWriter.streamDeadline
+	}
+	_ = streamWriter.responseController.SetWriteDeadline(writeDeadline)
+}
+
+func serveStreamingUpstream(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, route upstreamRoute, idleTimeout time.Duration, upstreamProxy http.Handler) {
+	streamContext, cancelStream := context.WithCancel(httpRequest.Context())
+	defer cancelStream()
+
+	var streamDeadline time.Time
+	if route.StreamMaxDuration > 0 {
+		streamDeadline = timeNow().Add(route.StreamMaxDuration)
+		var cancelDeadline context.CancelFunc
+		streamContext, cancelDeadline = context.WithTimeout(streamContext, route.StreamMaxDuration)
+		defer cancelDeadline()
+	}
+
+	idleTimer := time.AfterFunc(idleTimeout, cancelStream)
+	defer idleTimer.Stop()
+
+	streamWriter := &streamingResponseWriter{
+		ResponseWriter:     httpResponseWriter,
+		responseController: http.NewResponseController(httpResponseWriter),
+		idleTimer:          idleTimer,
+		idleTimeout:        idleTimeout,
+		streamDeadline:     streamDeadline,
+	}
+	streamWriter.extendWriteDeadline()
+	upstreamProxy.ServeHTTP(streamWriter, httpRequest.WithContext(streamContext))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeStreamingUpstream_FlushesEventsPastServerWriteTimeout(t *testing.T) {
+	firstEventReceived := make(chan struct{})
+	upstreamURL := startEventStreamUpstream(t, func(writer http.ResponseWriter, flusher http.Flusher, request *http.Request) {
+		fmt.Fprint(writer, "data: 0\n\n")
+		flusher.Flush()
+		select {
+		case <-firstEventReceived:
+		case <-time.After(2 * time.Second):
+			return
+		}
+		for eventIndex := 1; eventIndex < 6; eventIndex++ {
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintf(writer, "data: %d\n\n", eventIndex)
+			flusher.Flush()
+		}
+	})
+
+	route := upstreamRoute{PathPrefix: "/api", UpstreamBaseURL: upstreamURL, Streaming: true}
+	gatewayURL := startStreamingGateway(t, route, 200*time.Millisecond, 100*time.Millisecond)
+
+	response, requestErr := http.Get(gatewayURL + "/api/stream")
+	if requestErr != nil {
+		t.Fatalf("GET: %v", requestErr)
+	}
+	defer response.Body.Close()
+
+	eventReader := bufio.NewReader(response.Body)
+	if firstLine, _ := eventReader.ReadString('\n'); firstLine != "data: 0\n" {
+		t.Fatalf("expected the first event to be flushed before the stream ends, got %q", firstLine)
+	}
+	close(firstEventReceived)
+
+	receivedEvents := readEventLines(eventReader)
+	if len(receivedEvents) != 5 || receivedEvents[4] != "data: 5" {
+		t.Fatalf("expected the stream to outlive the server write timeout, got %v", receivedEvents)
+	}
+}
+
+func TestServeStreamingUpstream_CancelsIdleStream(t *testing.T) {
+	upstreamCancelled := make(chan struct{})
+	upstreamURL := startEventStreamUpstream(t, func(writer http.ResponseWriter, flusher http.Flusher, request *http.Request) {
+		fmt.Fprint(writer, "data: only\n\n")
+		flusher.Flush()
+		select {
+		case <-request.Context().Done():
+			close(upstreamCancelled)
+		case <-time.After(2 * time.Second):
+		}
+	})
+
+	route := upstreamRoute{PathPrefix: "/api", UpstreamBaseURL: upstreamURL, Streaming: true}
+	gatewayURL := startStreamingGateway(t, route, 100*time.Millisecond, time.Minute)
+
+	startTime := time.Now()
+	response, requestErr := http.Get(gatewayURL + "/api/stream")
+	if requestErr != nil {
+		t.Fatalf("GET: %v", requestErr)
+	}
+	defer response.Body.Close()
+	receivedEvents := readEventLines(bufio.NewReader(response.Body))
+
+	if len(receivedEvents) != 1 {
+		t.Fatalf("expected the event sent before stalling, got %v", receivedEvents)
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Fatalf("expected the idle stream to be cut after the idle timeout, took %v", elapsed)
+	}
+	select {
+	case <-upstreamCancelled:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the upstream request to be cancelled")
+	}
+}
+
+func TestServeStreamingUpstream_EnforcesMaximumDuration(t *testing.T) {
+	upstreamURL := startEventStreamUpstream(t, func(writer http.ResponseWriter, flusher http.Flusher, request *http.Request) {
+		for {
+			select {
+			case <-request.Context().Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+				fmt.Fprint(writer, "data: tick\n\n")
+				flusher.Flush()
+			}
+		}
+	})
+
+	route := upstreamRoute{PathPrefix: "/api", UpstreamBaseURL: upstreamURL, Streaming: true, StreamMaxDuration: 200 * time.Millisecond}
+	gatewayURL := startStreamingGateway(t, route, time.Second, time.Minute)
+
+	startTime := time.Now()
+	response, requestErr := http.Get(gatewayURL + "/api/stream")
+	if requestErr != nil {
+		t.Fatalf("GET: %v", requestErr)
+	}
+	defer response.Body.Close()
+	receivedEvents := readEventLines(bufio.NewReader(response.Body))
+
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Fatalf("expected the stream to stop at its maximum duration, took %v", elapsed)
+	}
+	if len(receivedEvents) == 0 {
+		t.Fatalf("expected events before the maximum duration elapsed")
+	}
+}
+
+func TestParseUpstreamRoutes_StreamingSettings(t *testing.T) {
+	parsedRoutes, parseErr := parseUpstreamRoutes([]byte(`{"routes":[{"pathPrefix":"/api/llm","upstreamBaseUrl":"https://llm.internal",
+		"streaming":true,"streamMaxDurationSeconds":600}]}`), time.Second)
+	if parseErr != nil {
+		t.Fatalf("parseUpstreamRoutes: %v", parseErr)
+	}
+	if !parsedRoutes[0].Streaming || parsedRoutes[0].StreamMaxDuration != 10*time.Minute {
+		t.Fatalf("unexpected streaming settings: %+v", parsedRoutes[0])
+	}
+	if newReverseProxy(parsedRoutes[0]).FlushInterval != streamFlushImmediately {
+		t.Fatalf("expected streaming routes to flush immediately")
+	}
+
+	if _, parseErr := parseUpstreamRoutes([]byte(`{"routes":[{"pathPrefix":"/api","upstreamBaseUrl":"https://a.internal",
+		"streamMaxDurationSeconds":60}]}`), time.Second); parseErr == nil {
+		t.Fatalf("expected streamMaxDurationSeconds without streaming to be rejected")
+	}
+}
+
+func startEventStreamUpstream(t *testing.T, streamEvents func(http.ResponseWriter, http.Flusher, *http.Request)) *url.URL {
+	t.Helper()
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set(headerContentType, "text/event-stream")
+		writer.WriteHeader(http.StatusOK)
+		streamEvents(writer, writer.(http.Flusher), request)
+	}))
+	t.Cleanup(upstreamServer.Close)
+	upstreamURL, parseErr := url.Parse(upstreamServer.URL)
+	if parseErr != nil {
+		t.Fatalf("url.Parse: %v", parseErr)
+	}
+	return upstreamURL
+}
+
+func startStreamingGateway(t *testing.T, route upstreamRoute, idleTimeout time.Duration, serverWriteTimeout time.Duration) string {
+	t.Helper()
+	reverseProxy := newReverseProxy(route)
+	gatewayServer := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		serveStreamingUpstream(writer, request, route, idleTimeout, reverseProxy)
+	}))
+	gatewayServer.Config.WriteTimeout = serverWriteTimeout
+	gatewayServer.Start()
+	t.Cleanup(gatewayServer.Close)
+	return gatewayServer.URL
+}
+
+func readEventLines(eventReader *bufio.Reader) []string {
+	var eventLines []string
+	for {
+		line, readErr := eventReader.ReadString('\n')
+		if strings.HasPrefix(line, "data: ") {
+			eventLines = append(eventLines, strings.TrimSuffix(line, "\n"))
+		}
+		if readErr != nil {
+			return eventLines
+		}
+	}
+}
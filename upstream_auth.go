@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	upstreamAuthModeQuery  = "query"
+	upstreamAuthModeHeader = "header"
+	upstreamAuthModeBearer = "bearer"
+	upstreamAuthModeHmac   = "hmac"
+
+	defaultUpstreamSecretQueryParameter = "key"
+	defaultUpstreamSecretHeader         = "X-API-Key"
+	defaultUpstreamSignatureHeader      = "X-ETS-Signature"
+	upstreamTimestampHeader             = "X-ETS-Timestamp"
+	upstreamSignatureVersionPrefix      = "v1="
+
+	maxSignedBodyBytes = 10 << 20
+)
+
+var errSignedBodyTooLarge = fmt.Errorf("body exceeds %d bytes signing limit", maxSignedBodyBytes)
+
+type upstreamAuthenticator interface {
+	authenticate(upstreamRequest *http.Request) error
+}
+
+type queryParameterAuth struct {
+	ParameterName string
+	Secret        string
+}
+
+type staticHeaderAuth struct {
+	HeaderName  string
+	HeaderValue string
+}
+
+type hmacSignatureAuth struct {
+	Secret          []byte
+	SignatureHeader string
+}
+
+type upstreamAuthConfig struct {
+	Mode      string `json:"mode"`
+	Name      string `json:"name"`
+	Secret    string `json:"secret"`
+	SecretEnv string `json:"secretEnv"`
+}
+
+func (auth queryParameterAuth) authenticate(upstreamRequest *http.Request) error {
+	queryValues := upstreamRequest.URL.Query()
+	queryValues.Set(auth.ParameterName, auth.Secret)
+	upstreamRequest.URL.RawQuery = queryValues.Encode()
+	return nil
+}
+
+func (auth staticHeaderAuth) authenticate(upstreamRequest *http.Request) error {
+	upstreamRequest.Header.Set(auth.HeaderName, auth.HeaderValue)
+	return nil
+}
+
+func (auth hmacSignatureAuth) authenticate(upstreamRequest *http.Request) error {
+	var bodyBytes []byte
+	if upstreamRequest.Body != nil && upstreamRequest.Body != http.NoBody {
+		readBytes, readError := io.ReadAll(io.LimitReader(upstreamRequest.Body, maxSignedBodyBytes+1))
+		_ = upstreamRequest.Body.Close()
+		if readError != nil {
+			return fmt.Errorf("read body for signing: %w", readError)
+		}
+		if len(readBytes) > maxSignedBodyBytes {
+			return errSignedBodyTooLarge
+		}
+		bodyBytes = readBytes
+		upstreamRequest.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		upstreamRequest.ContentLength = int64(len(bodyBytes))
+	}
+
+	timestamp := strconv.FormatInt(timeNow().Unix(), 10)
+	upstreamRequest.Header.Set(upstreamTimestampHeader, timestamp)
+	upstreamRequest.Header.Set(auth.SignatureHeader, upstreamSignatureVersionPrefix+auth.signature(upstreamRequest.Method, upstreamRequest.URL.RequestURI(), timestamp, bodyBytes))
+	return nil
+}
+
+// signature is hex(HMAC-SHA256(secret, METHOD \n REQUEST-URI \n TIMESTAMP \n hex(SHA256(body)))).
+func (auth hmacSignatureAuth) signature(method string, requestURI string, timestamp string, bodyBytes []byte) string {
+	bodyDigest := sha256.Sum256(bodyBytes)
+	signingMac := hmac.New(sha256.New, auth.Secret)
+	signingMac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n" + hex.EncodeToString(bodyDigest[:])))
+	return hex.EncodeToString(signingMac.Sum(nil))
+}
+
+func (authConfig upstreamAuthConfig) build() (upstreamAuthenticator, error) {
+	upstreamSecret := authConfig.Secret
+	if authConfig.SecretEnv != "" {
+		upstreamSecret = strings.TrimSpace(os.Getenv(authConfig.SecretEnv))
+		if upstreamSecret == "" {
+			return nil, fmt.Errorf("missing %s", authConfig.SecretEnv)
+		}
+	}
+	if upstreamSecret == "" {
+		return nil, fmt.Errorf("upstreamAuth requires secret or secretEnv")
+	}
+
+	switch authConfig.Mode {
+	case upstreamAuthModeQuery:
+		return queryParameterAuth{ParameterName: valueOrDefault(authConfig.Name, defaultUpstreamSecretQueryParameter), Secret: upstreamSecret}, nil
+	case upstreamAuthModeHeader:
+		return staticHeaderAuth{HeaderName: valueOrDefault(authConfig.Name, defaultUpstreamSecretHeader), HeaderValue: upstreamSecret}, nil
+	case upstreamAuthModeBearer:
+		return staticHeaderAuth{HeaderName: headerAuthorization, HeaderValue: "Bearer " + upstreamSecret}, nil
+	case upstreamAuthModeHmac:
+		return hmacSignatureAuth{Secret: []byte(upstreamSecret), SignatureHeader: valueOrDefault(authConfig.Name, defaultUpstreamSignatureHeader)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstreamAuth mode %q", authConfig.Mode)
+	}
+}
+
+func valueOrDefault(value string, defaultValue string) string {
+	if trimmed := strings.TrimSpace(value); trimmed != "" {
+		return trimmed
+	}
+	return defaultValue
+}
+
+// failingBody makes the transport refuse a request whose upstream authentication failed.
+type failingBody struct {
+	cause error
+}
+
+func (body failingBody) Read([]byte) (int, error) { return 0, body.cause }
+func (body failingBody) Close() error             { return nil }
+
+// Refusing before any byte is sent keeps unauthenticated headers from reaching the upstream.
+type authFailureGuardTransport struct {
+	next http.RoundTripper
+}
+
+func (transport authFailureGuardTransport) RoundTrip(upstreamRequest *http.Request) (*http.Response, error) {
+	if failedBody, authFailed := upstreamRequest.Body.(failingBody); authFailed {
+		return nil, failedBody.cause
+	}
+	return transport.next.RoundTrip(upstreamRequest)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestUpstreamAuthConfig_BuildsEachStrategy(t *testing.T) {
+	t.Setenv("LLM_SECRET", "env-secret")
+	testCases := []struct {
+		name       string
+		authConfig upstreamAuthConfig
+		verify     func(t *testing.T, request *http.Request)
+	}{
+		{"query default name", upstreamAuthConfig{Mode: "query", Secret: "s1"}, func(t *testing.T, request *http.Request) {
+			if request.URL.Query().Get("key") != "s1" {
+				t.Fatalf("expected key query parameter, got %q", request.URL.RawQuery)
+			}
+		}},
+		{"query custom name", upstreamAuthConfig{Mode: "query", Name: "api_key", Secret: "s2"}, func(t *testing.T, request *http.Request) {
+			if request.URL.Query().Get("api_key") != "s2" || request.URL.Query().Get("prompt") != "hi" {
+				t.Fatalf("expected api_key next to existing parameters, got %q", request.URL.RawQuery)
+			}
+		}},
+		{"static header", upstreamAuthConfig{Mode: "header", SecretEnv: "LLM_SECRET"}, func(t *testing.T, request *http.Request) {
+			if request.Header.Get("X-API-Key") != "env-secret" {
+				t.Fatalf("expected X-API-Key header, got %v", request.Header)
+			}
+		}},
+		{"bearer", upstreamAuthConfig{Mode: "bearer", Secret: "s3"}, func(t *testing.T, request *http.Request) {
+			if request.Header.Get("Authorization") != "Bearer s3" {
+				t.Fatalf("expected bearer authorization, got %q", request.Header.Get("Authorization"))
+			}
+		}},
+	}
+	for _, testCase := range testCases {
+		authenticator, buildErr := testCase.authConfig.build()
+		if buildErr != nil {
+			t.Fatalf("%s: build: %v", testCase.name, buildErr)
+		}
+		request := httptest.NewRequest(http.MethodGet, "http://upstream.example/v1?prompt=hi", nil)
+		request.Header.Set("Authorization", "Bearer client-token")
+		if authErr := authenticator.authenticate(request); authErr != nil {
+			t.Fatalf("%s: authenticate: %v", testCase.name, authErr)
+		}
+		testCase.verify(t, request)
+	}
+}
+
+func TestUpstreamAuthConfig_RejectsIncompleteConfig(t *testing.T) {
+	testCases := map[string]upstreamAuthConfig{
+		"unknown mode":   {Mode: "mtls", Secret: "s"},
+		"missing secret": {Mode: "bearer"},
+		"unset env":      {Mode: "header", SecretEnv: "ETS_TEST_UNSET_SECRET"},
+	}
+	for testName, authConfig := range testCases {
+		if _, buildErr := authConfig.build(); buildErr == nil {
+			t.Fatalf("%s: expected error", testName)
+		}
+	}
+	if _, parseErr := parseUpstreamRoutes([]byte(`{"routes":[{"pathPrefix":"/api","upstreamBaseUrl":"https://a.internal",
+		"upstreamSecret":"s","upstreamAuth":{"mode":"bearer","secret":"s"}}]}`), time.Second); parseErr == nil {
+		t.Fatalf("expected upstreamSecret and upstreamAuth together to be rejected")
+	}
+}
+
+func TestHmacSignatureAuth_SignsMethodUriTimestampAndBodyThroughProxy(t *testing.T) {
+	originalTimeNow := timeNow
+	t.Cleanup(func() { timeNow = originalTimeNow })
+	fixedTime := time.Unix(1700000000, 0)
+	timeNow = func() time.Time { return fixedTime }
+
+	signingAuth := hmacSignatureAuth{Secret: []byte("hmac-secret"), SignatureHeader: defaultUpstreamSignatureHeader}
+	requestBody := `{"prompt":"hello"}`
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		receivedBody, _ := io.ReadAll(request.Body)
+		if string(receivedBody) != requestBody {
+			t.Errorf("expected body to be forwarded intact, got %q", receivedBody)
+		}
+		timestamp := request.Header.Get(upstreamTimestampHeader)
+		if timestamp != strconv.FormatInt(fixedTime.Unix(), 10) {
+			t.Errorf("unexpected timestamp header %q", timestamp)
+		}
+		expectedSignature := "v1=" + signingAuth.signature(request.Method, request.URL.RequestURI(), timestamp, receivedBody)
+		if request.Header.Get(defaultUpstreamSignatureHeader) != expectedSignature {
+			t.Errorf("signature mismatch: got %q want %q", request.Header.Get(defaultUpstreamSignatureHeader), expectedSignature)
+		}
+		if request.URL.Path != "/v1/chat" {
+			t.Errorf("expected rewritten path to be signed and forwarded, got %s", request.URL.Path)
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstreamServer.Close()
+
+	upstreamURL, parseErr := url.Parse(upstreamServer.URL)
+	if parseErr != nil {
+		t.Fatalf("url.Parse: %v", parseErr)
+	}
+	reverseProxy := newReverseProxy(upstreamRoute{PathPrefix: "/api/llm", RewritePrefix: "/v1", UpstreamBaseURL: upstreamURL, UpstreamAuth: signingAuth})
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "http://ets.example/api/llm/chat?stream=1", strings.NewReader(requestBody))
+	reverseProxy.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", recorder.Code)
+	}
+
+	tamperedSignature := signingAuth.signature(http.MethodPost, "/v1/chat?stream=1", "1700000000", []byte(`{"prompt":"tampered"}`))
+	if tamperedSignature == signingAuth.signature(http.MethodPost, "/v1/chat?stream=1", "1700000000", []byte(requestBody)) {
+		t.Fatalf("expected signature to depend on the body")
+	}
+}
+
+func TestNewReverseProxy_AuthFailureNeverReachesUpstream(t *testing.T) {
+	upstreamCalled := false
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		upstreamCalled = true
+	}))
+	defer upstreamServer.Close()
+	upstreamURL, parseErr := url.Parse(upstreamServer.URL)
+	if parseErr != nil {
+		t.Fatalf("url.Parse: %v", parseErr)
+	}
+
+	reverseProxy := newReverseProxy(upstreamRoute{PathPrefix: "/api", UpstreamBaseURL: upstreamURL, UpstreamAuth: hmacSignatureAuth{Secret: []byte("s"), SignatureHeader: defaultUpstreamSignatureHeader}})
+	oversizedBody := bytes.NewReader(make([]byte, maxSignedBodyBytes+1))
+	recorder := httptest.NewRecorder()
+	reverseProxy.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "http://ets.example/api", oversizedBody))
+	if recorder.Code != http.StatusRequestEntityTooLarge || !strings.Contains(recorder.Body.String(), "request_too_large") {
+		t.Fatalf("expected 413 for a body over the signing limit, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	reverseProxy.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "http://ets.example/api", iotest.ErrReader(errors.New("client went away"))))
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 when reading the body for signing fails, got %d", recorder.Code)
+	}
+	if upstreamCalled {
+		t.Fatalf("expected unsigned requests to never reach the upstream")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	headerConnection             = "Connection"
+	headerUpgrade                = "Upgrade"
+	headerWebSocketProtocol      = "Sec-WebSocket-Protocol"
+	websocketUpgradeToken        = "websocket"
+	websocketTokenQueryParam     = "access_token"
+	websocketProofQueryParam     = "dpop"
+	websocketProtocolMarker      = "ets"
+	websocketTokenProtocolPrefix = "ets-access-token."
+	websocketProofProtocolPrefix = "ets-dpop."
+)
+
+// websocketHandshakeHeaders must survive route header allow lists or the upgrade breaks.
+var websocketHandshakeHeaders = []string{
+	headerConnection, headerUpgrade, headerWebSocketProtocol,
+	"Sec-WebSocket-Key", "Sec-WebSocket-Version", "Sec-WebSocket-Extensions", "Sec-WebSocket-Accept",
+}
+
+type websocketMarkerContextKey struct{}
+
+func isWebSocketUpgrade(httpRequest *http.Request) bool {
+	if !stringsEqualFold(strings.TrimSpace(httpRequest.Header.Get(headerUpgrade)), websocketUpgradeToken) {
+		return false
+	}
+	for _, connectionValue := range httpRequest.Header.Values(headerConnection) {
+		for _, connectionToken := range strings.Split(connectionValue, ",") {
+			if stringsEqualFold(strings.TrimSpace(connectionToken), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Browsers cannot set headers on a WebSocket, so credentials arrive in the query string or
+// Sec-WebSocket-Protocol. Explicit headers take precedence.
+func promoteWebSocketCredentials(httpRequest *http.Request) *http.Request {
+	remainingQuery, queryToken, queryProof := removeQueryCredentials(httpRequest.URL.RawQuery)
+	httpRequest.URL.RawQuery = remainingQuery
+
+	var remainingProtocols []string
+	var protocolToken, protocolProof string
+	markerOffered := false
+	for _, protocolValue := range httpRequest.Header.Values(headerWebSocketProtocol) {
+		for _, offeredProtocol := range strings.Split(protocolValue, ",") {
+			offeredProtocol = strings.TrimSpace(offeredProtocol)
+			switch {
+			case offeredProtocol == "":
+			case offeredProtocol == websocketProtocolMarker:
+				markerOffered = true
+			case strings.HasPrefix(offeredProtocol, websocketTokenProtocolPrefix):
+				protocolToken = strings.TrimPrefix(offeredProtocol, websocketTokenProtocolPrefix)
+			case strings.HasPrefix(offeredProtocol, websocketProofProtocolPrefix):
+				protocolProof = strings.TrimPrefix(offeredProtocol, websocketProofProtocolPrefix)
+			default:
+				remainingProtocols = append(remainingProtocols, offeredProtocol)
+			}
+		}
+	}
+	httpRequest.Header.Del(headerWebSocketProtocol)
+	if len(remainingProtocols) > 0 {
+		httpRequest.Header.Set(headerWebSocketProtocol, strings.Join(remainingProtocols, ", "))
+	}
+
+	if httpRequest.Header.Get(headerAuthorization) == "" {
+		if accessToken := firstNonEmpty(protocolToken, queryToken); accessToken != "" {
+			httpRequest.Header.Set(headerAuthorization, "Bearer "+accessToken)
+		}
+	}
+	if httpRequest.Header.Get(headerDpop) == "" {
+		if dpopProof := firstNonEmpty(protocolProof, queryProof); dpopProof != "" {
+			httpRequest.Header.Set(headerDpop, dpopProof)
+		}
+	}
+	if !markerOffered {
+		return httpRequest
+	}
+	return httpRequest.WithContext(context.WithValue(httpRequest.Context(), websocketMarkerContextKey{}, true))
+}
+
+// The remaining parameters keep their bytes and order so the client's htu still matches.
+func removeQueryCredentials(rawQuery string) (string, string, string) {
+	if rawQuery == "" {
+		return "", "", ""
+	}
+	var keptParameters []string
+	var accessToken, dpopProof string
+	for _, rawParameter := range strings.Split(rawQuery, "&") {
+		rawName, rawValue, _ := strings.Cut(rawParameter, "=")
+		parameterName, nameError := url.QueryUnescape(rawName)
+		if nameError != nil {
+			keptParameters = append(keptParameters, rawParameter)
+			continue
+		}
+		switch parameterName {
+		case websocketTokenQueryParam:
+			accessToken, _ = url.QueryUnescape(rawValue)
+		case websocketProofQueryParam:
+			dpopProof, _ = url.QueryUnescape(rawValue)
+		default:
+			keptParameters = append(keptParameters, rawParameter)
+		}
+	}
+	return strings.Join(keptParameters, "&"), accessToken, dpopProof
+}
+
+// Browsers fail a handshake that offered protocols but got none back.
+func selectWebSocketMarker(upstreamResponse *http.Response) {
+	if upstreamResponse.StatusCode != http.StatusSwitchingProtocols || upstreamResponse.Header.Get(headerWebSocketProtocol) != "" {
+		return
+	}
+	if markerOffered, _ := upstreamResponse.Request.Context().Value(websocketMarkerContextKey{}).(bool); markerOffered {
+		upstreamResponse.Header.Set(headerWebSocketProtocol, websocketProtocolMarker)
+	}
+}
+
+type websocketResponseWriter struct {
+	http.ResponseWriter
+	handshakeTimer *time.Timer
+}
+
+func (websocketWriter *websocketResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	websocketWriter.handshakeTimer.Stop()
+	clientConnection, bufferedReadWriter, hijackError := http.NewResponseController(websocketWriter.ResponseWriter).Hijack()
+	if hijackError != nil {
+		return nil, nil, hijackError
+	}
+	_ = clientConnection.SetDeadline(time.Time{})
+	return clientConnection, bufferedReadWriter, nil
+}
+
+func (websocketWriter *websocketResponseWriter) Unwrap() http.ResponseWriter {
+	return websocketWriter.ResponseWriter
+}
+
+// The upstream timeout covers the handshake only.
+func serveWebSocketUpstream(httpResponseWriter http.ResponseWriter, httpRequest *http.Request, handshakeTimeout time.Duration, upstreamProxy http.Handler) {
+	tunnelContext, cancelTunnel := context.WithCancel(httpRequest.Context())
+	defer cancelTunnel()
+	handshakeTimer := time.AfterFunc(handshakeTimeout, cancelTunnel)
+	defer handshakeTimer.Stop()
+
+	websocketWriter := &websocketResponseWriter{ResponseWriter: httpResponseWriter, handshakeTimer: handshakeTimer}
+	upstreamProxy.ServeHTTP(websocketWriter, httpRequest.WithContext(tunnelContext))
+}
+
+func firstNonEmpty(candidates ...string) string {
+	for _, candidate := range candidates {
+		if candidate != "" {
+			return candidate
+		}
+	}
+	return ""
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type websocketUpstreamHandshake struct {
+	rawQuery      string
+	protocols     string
+	authorization string
+	dpop          string
+}
+
+func TestHandleProtectedProxy_TunnelsWebSocketWithProtocolCredentials(t *testing.T) {
+	gateway := startWebSocketGateway(t, true)
+
+	requestPath := "/api/ws?room=1"
+	proof := gateway.proof(t, requestPath, "ws-proof-protocol")
+	clientConnection, response := gateway.dial(t, requestPath, http.Header{
+		headerWebSocketProtocol: {"ets, chat, " + websocketTokenProtocolPrefix + gateway.accessToken + ", " + websocketProofProtocolPrefix + proof},
+	})
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", response.StatusCode)
+	}
+	if response.Header.Get(headerWebSocketProtocol) != "chat" {
+		t.Fatalf("expected the upstream's subprotocol choice, got %q", response.Header.Get(headerWebSocketProtocol))
+	}
+
+	upstreamHandshake := <-gateway.handshakes
+	if upstreamHandshake.protocols != "chat" || upstreamHandshake.authorization != "" || upstreamHandshake.dpop != "" {
+		t.Fatalf("expected credentials to be removed before the upstream, got %+v", upstreamHandshake)
+	}
+	if upstreamHandshake.rawQuery != "room=1" {
+		t.Fatalf("unexpected upstream query %q", upstreamHandshake.rawQuery)
+	}
+
+	// outlive the gateway's read timeout to prove the tunnel cleared it
+	time.Sleep(200 * time.Millisecond)
+	assertWebSocketEcho(t, clientConnection, "ping")
+}
+
+func TestHandleProtectedProxy_TunnelsWebSocketWithQueryCredentials(t *testing.T) {
+	gateway := startWebSocketGateway(t, false)
+
+	proof := gateway.proof(t, "/api/ws?room=1&lang=en", "ws-proof-query")
+	requestPath := "/api/ws?room=1&access_token=" + gateway.accessToken + "&lang=en&dpop=" + proof
+	clientConnection, response := gateway.dial(t, requestPath, http.Header{headerWebSocketProtocol: {websocketProtocolMarker}})
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", response.StatusCode)
+	}
+	if response.Header.Get(headerWebSocketProtocol) != websocketProtocolMarker {
+		t.Fatalf("expected ETS to answer the offered marker protocol, got %q", response.Header.Get(headerWebSocketProtocol))
+	}
+	if upstreamHandshake := <-gateway.handshakes; upstreamHandshake.rawQuery != "room=1&lang=en" || upstreamHandshake.protocols != "" {
+		t.Fatalf("expected credentials to be removed from the query, got %+v", upstreamHandshake)
+	}
+	assertWebSocketEcho(t, clientConnection, "hello")
+}
+
+func TestHandleProtectedProxy_RejectsWebSocketUpgrades(t *testing.T) {
+	gateway := startWebSocketGateway(t, false)
+
+	_, missingCredentials := gateway.dial(t, "/api/ws", nil)
+	if missingCredentials.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, got %d", missingCredentials.StatusCode)
+	}
+
+	proof := gateway.proof(t, "/api/plain", "ws-proof-plain")
+	_, plainRoute := gateway.dial(t, "/api/plain?access_token="+gateway.accessToken+"&dpop="+proof, nil)
+	if plainRoute.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 on a route without websocket, got %d", plainRoute.StatusCode)
+	}
+	select {
+	case upstreamHandshake := <-gateway.handshakes:
+		t.Fatalf("expected no upstream handshake, got %+v", upstreamHandshake)
+	default:
+	}
+}
+
+func TestRemoveQueryCredentials_KeepsOtherParametersInOrder(t *testing.T) {
+	remainingQuery, accessToken, dpopProof := removeQueryCredentials("b=2&access_token=tok%2E1&a=1&dpop=proof&b=3")
+	if remainingQuery != "b=2&a=1&b=3" || accessToken != "tok.1" || dpopProof != "proof" {
+		t.Fatalf("unexpected result %q %q %q", remainingQuery, accessToken, dpopProof)
+	}
+}
+
+type websocketTestGateway struct {
+	gatewayAddress string
+	accessToken    string
+	dpopKey        *ecdsa.PrivateKey
+	dpopJwk        publicJwk
+	handshakes     chan websocketUpstreamHandshake
+}
+
+func startWebSocketGateway(t *testing.T, selectChatProtocol bool) websocketTestGateway {
+	t.Helper()
+	handshakes := make(chan websocketUpstreamHandshake, 2)
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handshakes <- websocketUpstreamHandshake{
+			rawQuery:      request.URL.RawQuery,
+			protocols:     request.Header.Get(headerWebSocketProtocol),
+			authorization: request.Header.Get(headerAuthorization),
+			dpop:          request.Header.Get(headerDpop),
+		}
+		upstreamConnection, bufferedReadWriter, hijackErr := http.NewResponseController(writer).Hijack()
+		if hijackErr != nil {
+			t.Errorf("hijack: %v", hijackErr)
+			return
+		}
+		defer upstreamConnection.Close()
+		acceptDigest := sha1.Sum([]byte(request.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		handshakeResponse := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(acceptDigest[:]) + "\r\n"
+		if selectChatProtocol {
+			handshakeResponse += "Sec-WebSocket-Protocol: chat\r\n"
+		}
+		_, _ = bufferedReadWriter.WriteString(handshakeResponse + "\r\n")
+		_ = bufferedReadWriter.Flush()
+		_, _ = io.Copy(upstreamConnection, bufferedReadWriter)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	parsedRoutes, parseErr := parseUpstreamRoutes([]byte(fmt.Sprintf(`{"routes":[
+		{"pathPrefix":"/api/ws","upstreamBaseUrl":%q,"stripPrefix":true,"websocket":true,"requestHeaders":{"allow":["Accept"]}},
+		{"pathPrefix":"/api/plain","upstreamBaseUrl":%q}
+	]}`, upstreamServer.URL, upstreamServer.URL)), time.Second)
+	if parseErr != nil {
+		t.Fatalf("parseUpstreamRoutes: %v", parseErr)
+	}
+	tokenSigningKey := []byte("0123456789abcdef0123456789abcdef")
+	httpServer := newHTTPServer(serverConfig{
+		AllowedOrigins:     map[string]struct{}{"https://app.example.com": {}},
+		TokenLifetime:      5 * time.Minute,
+		JwtHmacKey:         tokenSigningKey,
+		UpstreamRoutes:     parsedRoutes,
+		RateLimitPerMinute: 100,
+		UpstreamTimeout:    time.Second,
+	})
+	gatewayServer := httptest.NewUnstartedServer(httpServer.Handler)
+	gatewayServer.Config.ReadTimeout = 100 * time.Millisecond
+	gatewayServer.Start()
+	t.Cleanup(gatewayServer.Close)
+
+	dpopKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", keyErr)
+	}
+	dpopJwk := publicJwk{
+		KeyType: "EC",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(dpopKey.X.FillBytes(make([]byte, 32))),
+		Y:       base64.RawURLEncoding.EncodeToString(dpopKey.Y.FillBytes(make([]byte, 32))),
+	}
+	thumbprint, thumbErr := jwkThumbprint(dpopJwk)
+	if thumbErr != nil {
+		t.Fatalf("jwkThumbprint: %v", thumbErr)
+	}
+	return websocketTestGateway{
+		gatewayAddress: strings.TrimPrefix(gatewayServer.URL, "http://"),
+		accessToken:    issueTestAccessTokenWithThumbprint(t, tokenSigningKey, "token-websocket", thumbprint),
+		dpopKey:        dpopKey,
+		dpopJwk:        dpopJwk,
+		handshakes:     handshakes,
+	}
+}
+
+func (gateway websocketTestGateway) proof(t *testing.T, requestPath string, jwtID string) string {
+	t.Helper()
+	return mustCreateDpopProof(t, gateway.dpopKey, gateway.dpopJwk, http.MethodGet, "http://"+gateway.gatewayAddress+requestPath, jwtID, time.Now())
+}
+
+// dial performs a raw WebSocket opening handshake; the tunnel is byte-transparent, so the
+// tests exchange plain bytes instead of frames.
+func (gateway websocketTestGateway) dial(t *testing.T, requestPath string, extraHeaders http.Header) (net.Conn, *http.Response) {
+	t.Helper()
+	clientConnection, dialErr := net.Dial("tcp", gateway.gatewayAddress)
+	if dialErr != nil {
+		t.Fatalf("net.Dial: %v", dialErr)
+	}
+	t.Cleanup(func() { _ = clientConnection.Close() })
+
+	handshakeRequest, requestErr := http.NewRequest(http.MethodGet, "http://"+gateway.gatewayAddress+requestPath, nil)
+	if requestErr != nil {
+		t.Fatalf("http.NewRequest: %v", requestErr)
+	}
+	handshakeRequest.Header.Set("Origin", "https://app.example.com")
+	handshakeRequest.Header.Set(headerConnection, "Upgrade")
+	handshakeRequest.Header.Set(headerUpgrade, "websocket")
+	handshakeRequest.Header.Set("Sec-WebSocket-Version", "13")
+	handshakeRequest.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for headerName, headerValues := range extraHeaders {
+		handshakeRequest.Header[headerName] = headerValues
+	}
+	if writeErr := handshakeRequest.Write(clientConnection); writeErr != nil {
+		t.Fatalf("write handshake: %v", writeErr)
+	}
+	_ = clientConnection.SetReadDeadline(time.Now().Add(2 * time.Second))
+	handshakeResponse, readErr := http.ReadResponse(bufio.NewReader(clientConnection), handshakeRequest)
+	if readErr != nil {
+		t.Fatalf("read handshake response: %v", readErr)
+	}
+	return clientConnection, handshakeResponse
+}
+
+func assertWebSocketEcho(t *testing.T, clientConnection net.Conn, message string) {
+	t.Helper()
+	if _, writeErr := clientConnection.Write([]byte(message)); writeErr != nil {
+		t.Fatalf("write through tunnel: %v", writeErr)
+	}
+	echoed := make([]byte, len(message))
+	_ = clientConnection.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, readErr := io.ReadFull(clientConnection, echoed); readErr != nil || string(echoed) != message {
+		t.Fatalf("expected %q echoed through the tunnel, got %q (%v)", message, echoed, readErr)
+	}
+}